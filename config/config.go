@@ -1,8 +1,12 @@
 package config
 
 type Config struct {
-	FrontendHost    string `env:"FRONTEND_HOST" validate:"required"`
-	FrontendURL     string `env:"FRONTEND_URL" validate:"required"`
-	BackendURL      string `env:"BACKEND_URL" validate:"required"`
-	UseInsecureHTTP bool   `env:"USE_INSECURE_HTTP"`
+	FrontendHost      string `env:"FRONTEND_HOST" validate:"required"`
+	FrontendURL       string `env:"FRONTEND_URL" validate:"required"`
+	BackendURL        string `env:"BACKEND_URL" validate:"required"`
+	UseInsecureHTTP   bool   `env:"USE_INSECURE_HTTP"`
+	StorageBackend    string `env:"STORAGE_BACKEND" validate:"omitempty,oneof=json bolt memory"`
+	DataPath          string `env:"DATA_PATH"`
+	EncryptionKey     string `env:"ENCRYPTION_KEY" validate:"omitempty,base64"`
+	EncryptionKeyFile string `env:"ENCRYPTION_KEY_FILE" validate:"excluded_with=EncryptionKey"`
 }
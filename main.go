@@ -42,12 +42,26 @@ func run() error {
 		return fmt.Errorf("validation of config failed: %w", err)
 	}
 
-	repo := repository.NewJsonFile()
+	repo, err := repository.New(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create repository: %w", err)
+	}
+	defer func() {
+		_ = repo.Close()
+	}()
+
 	signingKey, err := getSigningKey(repo)
 	if err != nil {
 		return err
 	}
 
+	err = repository.KeyAuditLog(repo, &signingKey)
+	if errors.Is(err, common.ErrAuditLogInvalid) {
+		log.Warn().Caller().Err(err).Msg("audit log is not a valid chain for the audit key")
+	} else if err != nil {
+		return err
+	}
+
 	s, err := server.New(cfg, signingKey, repo)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
@@ -65,7 +79,7 @@ func run() error {
 	return s.Stop()
 }
 
-func getSigningKey(repo *repository.JsonFile) (models.SigningKey, error) {
+func getSigningKey(repo common.Repository) (models.SigningKey, error) {
 	signingKey, err := repo.GetSigningKey()
 	if errors.Is(err, common.ErrNotFound) {
 		signingKey, err = generateSigningKey()
@@ -91,8 +105,10 @@ func generateSigningKey() (models.SigningKey, error) {
 		return models.SigningKey{}, fmt.Errorf("failed to generate signing key: %w", err)
 	}
 
+	// A new key starts with an empty audit log, so there is no unkeyed log to accept
 	return models.SigningKey{
-		PrivateKey: sk,
-		PublicKey:  pk,
+		PrivateKey:    sk,
+		PublicKey:     pk,
+		AuditLogKeyed: true,
 	}, nil
 }
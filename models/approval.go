@@ -0,0 +1,151 @@
+package models
+
+import (
+	"golang.org/x/exp/slices"
+	"math/big"
+	"strings"
+)
+
+const (
+	OperationTransaction             = "transaction"
+	OperationWalletExport            = "wallet_export"
+	OperationCredentialRemoval       = "credential_removal"
+	OperationEmergencyContactRemoval = "emergency_contact_removal"
+	OperationPolicyLoosening         = "policy_loosening"
+)
+
+const (
+	TransactionActionSend     = "send"
+	TransactionActionSign     = "sign"
+	TransactionActionSpeedUp  = "speed_up"
+	TransactionActionCancel   = "cancel"
+	TransactionActionSchedule = "schedule"
+)
+
+// QuorumRule requires the approval of multiple distinct credentials for an operation
+type QuorumRule struct {
+	Operation   string `json:"operation" validate:"required,oneof=transaction wallet_export credential_removal emergency_contact_removal policy_loosening"`
+	Credentials int    `json:"credentials" validate:"required,min=2"`
+	// Transaction rules only apply to transactions spending more than the threshold of the token on the chain.
+	// An empty chain matches every chain, an empty token the native currency and an empty threshold every transaction.
+	ChainID   string `json:"chain_id" validate:"omitempty,hexadecimal"`
+	Token     string `json:"token" validate:"omitempty,ethereum_address"`
+	Threshold string `json:"threshold" validate:"omitempty,number"`
+}
+
+// PendingApproval collects the approvals of distinct credentials for an operation until its quorum is reached
+type PendingApproval struct {
+	ID          string                      `json:"id"`
+	Operation   string                      `json:"operation"`
+	Subject     string                      `json:"subject"` //Wallet, credential or contact the operation applies to
+	Required    int                         `json:"required"`
+	Approvals   []Approval                  `json:"approvals"`
+	CreatedAt   int64                       `json:"created_at"`
+	ExpiresAt   int64                       `json:"expires_at"`
+	Transaction *PendingTransactionApproval `json:"transaction,omitempty"`
+	Export      *PendingWalletExport        `json:"export,omitempty"`
+	Policy      *Policy                     `json:"policy,omitempty"`
+}
+
+type PendingTransactionApproval struct {
+	Action    string            `json:"action"`
+	Params    TransactionParams `json:"params"`
+	Replaces  string            `json:"replaces"`   //Hash of the transaction replaced by speed ups and cancellations
+	ExecuteAt int64             `json:"execute_at"` //Execution time of scheduled transactions
+}
+
+type Approval struct {
+	Credential string `json:"credential"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// AppliesTo reports whether a transaction that spends the amounts given by lower case token address on chainID is covered by the rule
+func (r QuorumRule) AppliesTo(chainID string, spent map[string]*big.Int) bool {
+	return exceedsThreshold(r.ChainID, r.Token, r.Threshold, chainID, spent)
+}
+
+// RequiredCredentials returns the number of credentials needed to satisfy every quorum rule of the policy
+func (p Policy) RequiredCredentials() int {
+	required := 1
+	for _, rule := range p.QuorumRules {
+		if rule.Credentials > required {
+			required = rule.Credentials
+		}
+	}
+
+	return required
+}
+
+func (a PendingApproval) IsApprovedBy(credential string) bool {
+	return slices.IndexFunc(a.Approvals, func(approval Approval) bool {
+		return approval.Credential == credential
+	}) != -1
+}
+
+func (a PendingApproval) IsComplete() bool {
+	return len(a.Approvals) >= a.Required
+}
+
+// Credentials returns the names of the approving credentials
+func (a PendingApproval) Credentials() []string {
+	names := make([]string, len(a.Approvals))
+	for i, approval := range a.Approvals {
+		names[i] = approval.Credential
+	}
+
+	return names
+}
+
+// PruneApprovals removes and returns the pending approvals that expired before now
+func (u *User) PruneApprovals(now int64) []PendingApproval {
+	expired := make([]PendingApproval, 0)
+	for id, approval := range u.PendingApprovals {
+		if approval.ExpiresAt < now {
+			expired = append(expired, approval)
+			delete(u.PendingApprovals, id)
+		}
+	}
+
+	return expired
+}
+
+// exceedsThreshold reports whether a transaction on chainID spends more than threshold of token on ruleChainID.
+// spent holds the amounts by lower case token address. An empty ruleChainID matches every chain and an empty threshold every amount.
+func exceedsThreshold(ruleChainID, token, threshold, chainID string, spent map[string]*big.Int) bool {
+	if ruleChainID != "" && !strings.EqualFold(ruleChainID, chainID) {
+		return false
+	}
+
+	amount, ok := spent[strings.ToLower(token)]
+	if !ok {
+		return false
+	}
+	if threshold == "" {
+		return true
+	}
+
+	parsed, ok := new(big.Int).SetString(threshold, 10)
+	return !ok || amount.Cmp(parsed) > 0
+}
+
+// isStricterQuorum reports whether updated requires at least as much as previous for the same operation and asset
+func isStricterQuorum(updated, previous QuorumRule) bool {
+	return updated.Operation == previous.Operation &&
+		strings.EqualFold(updated.ChainID, previous.ChainID) &&
+		strings.EqualFold(updated.Token, previous.Token) &&
+		updated.Credentials >= previous.Credentials &&
+		!isHigherThreshold(updated.Threshold, previous.Threshold)
+}
+
+// isHigherThreshold reports whether the threshold updated covers fewer transactions than previous.
+// An empty threshold covers every transaction.
+func isHigherThreshold(updated, previous string) bool {
+	if updated == "" {
+		return false
+	}
+	if previous == "" {
+		return true
+	}
+
+	return isHigherLimit(updated, previous)
+}
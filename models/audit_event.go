@@ -0,0 +1,114 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const (
+	AuditRegistration             = "registration"
+	AuditBackupRestore            = "backup_restore"
+	AuditBackupExport             = "backup_export"
+	AuditLogin                    = "login"
+	AuditOTPCreated               = "otp_created"
+	AuditOTPLogin                 = "otp_login"
+	AuditOTPLoginFailed           = "otp_login_failed"
+	AuditCredentialAdded          = "credential_added"
+	AuditCredentialRemoved        = "credential_removed"
+	AuditWalletCreated            = "wallet_created"
+	AuditWalletImported           = "wallet_imported"
+	AuditWalletExported           = "wallet_exported"
+	AuditWalletRenamed            = "wallet_renamed"
+	AuditWalletArchived           = "wallet_archived"
+	AuditWalletVisibility         = "wallet_visibility_changed"
+	AuditWalletDeleted            = "wallet_deleted"
+	AuditContractABISaved         = "contract_abi_saved"
+	AuditContractABIRemoved       = "contract_abi_removed"
+	AuditPolicyUpdated            = "policy_updated"
+	AuditApprovalRequested        = "approval_requested"
+	AuditApprovalGiven            = "approval_given"
+	AuditApprovalRejected         = "approval_rejected"
+	AuditMnemonicRevealed         = "mnemonic_revealed"
+	AuditPersonalSign             = "personal_sign"
+	AuditTypedDataSign            = "typed_data_sign"
+	AuditEthSign                  = "eth_sign"
+	AuditTransactionSign          = "transaction_sign"
+	AuditTransactionSend          = "transaction_send"
+	AuditTransactionSpeedUp       = "transaction_speed_up"
+	AuditTransactionCancel        = "transaction_cancel"
+	AuditTransactionScheduled     = "transaction_scheduled"
+	AuditTransactionTimeLocked    = "transaction_time_locked"
+	AuditScheduledSent            = "scheduled_transaction_sent"
+	AuditScheduledFailed          = "scheduled_transaction_failed"
+	AuditScheduledCancelled       = "scheduled_transaction_cancelled"
+	AuditRecurringCreated         = "recurring_payment_created"
+	AuditRecurringCancelled       = "recurring_payment_cancelled"
+	AuditEmergencyContactAdded    = "emergency_contact_added"
+	AuditEmergencyContactRemoved  = "emergency_contact_removed"
+	AuditEmergencyContactResponse = "emergency_contact_response"
+	AuditEmergencyAccessRequested = "emergency_access_requested"
+	AuditEmergencyAccessDenied    = "emergency_access_denied"
+	AuditEmergencyTakeover        = "emergency_takeover"
+	AuditEmergencyGrantReceived   = "emergency_grant_received"
+	AuditEmergencyGrantResponse   = "emergency_grant_response"
+	AuditEmergencyGrantRequested  = "emergency_grant_access_requested"
+	AuditEmergencyGrantRemoved    = "emergency_grant_removed"
+	AuditEmergencyGrantDenied     = "emergency_grant_denied"
+	AuditEmergencyGrantTakeover   = "emergency_grant_takeover"
+)
+
+// AuditEvent is an entry of the append-only audit log.
+// Every event contains the hash of its predecessor, so removing or altering an event breaks the chain.
+// The hashes are keyed with the audit key of the enclave, so the chain can not be rebuilt without it.
+type AuditEvent struct {
+	Sequence   uint64            `json:"sequence"`
+	Timestamp  int64             `json:"timestamp"`
+	Type       string            `json:"type"`
+	Credential string            `json:"credential"`
+	Details    map[string]string `json:"details"`
+	PrevHash   string            `json:"prev_hash"`
+	Hash       string            `json:"hash"`
+}
+
+// CalculateHash returns the HMAC-SHA256 of the event with key.
+// A nil key returns the unkeyed SHA-256 used by older versions of the enclave.
+func (e AuditEvent) CalculateHash(key []byte) string {
+	e.Hash = ""
+
+	// Map keys are sorted by json.Marshal, so the encoding is deterministic
+	data, _ := json.Marshal(e)
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type AuditEvents []AuditEvent
+
+// Verify checks the hashes of all events with key and that they form a continuous chain.
+// previous is the event before the first one, or nil if the events start at the beginning of the log.
+func (a AuditEvents) Verify(key []byte, previous *AuditEvent) bool {
+	for i, event := range a {
+		if event.Hash != event.CalculateHash(key) {
+			return false
+		}
+
+		if previous == nil && (event.Sequence != 1 || event.PrevHash != "") {
+			return false
+		}
+		if previous != nil && (event.PrevHash != previous.Hash || event.Sequence != previous.Sequence+1) {
+			return false
+		}
+
+		previous = &a[i]
+	}
+
+	return true
+}
@@ -0,0 +1,19 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ContractABI is an ABI uploaded by the user for a contract on a single chain
+type ContractABI struct {
+	Name    string          `json:"name"`
+	ChainID string          `json:"chain_id"`
+	Address string          `json:"address"`
+	ABI     json.RawMessage `json:"abi"`
+}
+
+// ContractABIKey returns the key of the ABI of a contract in User.ContractABIs
+func ContractABIKey(chainID, address string) string {
+	return strings.ToLower(chainID + ":" + address)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Next gives up after this many years, which only happens for impossible dates like the 31st of February
+const maxCronSearchYears = 5
+
+// CronSchedule is a parsed cron expression with the fields minute, hour, day of month, month and day of week.
+// Every field is a bitset of the values it matches. Schedules are evaluated in UTC.
+type CronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// Like in cron, a day matches either field if both the day of month and the day of week are restricted
+	restrictedDayOfMonth, restrictedDayOfWeek bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// ParseCronSchedule parses a cron expression of five fields. Fields support *, values, ranges, lists and steps like */15 or 1-5.
+func ParseCronSchedule(expression string) (CronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return CronSchedule{}, fmt.Errorf("cron expression must have %d fields", len(cronFields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		parsed, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return CronSchedule{}, err
+		}
+		bits[i] = parsed
+	}
+
+	return CronSchedule{
+		minute:               bits[0],
+		hour:                 bits[1],
+		dayOfMonth:           bits[2],
+		month:                bits[3],
+		dayOfWeek:            bits[4],
+		restrictedDayOfMonth: !strings.HasPrefix(fields[2], "*"),
+		restrictedDayOfWeek:  !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s", stepPart, f.name)
+			}
+			step = parsed
+		}
+
+		start, end := f.min, f.max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			start, err = parseCronValue(from, f)
+			if err != nil {
+				return 0, err
+			}
+
+			end = start
+			if isRange {
+				end, err = parseCronValue(to, f)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = f.max
+			}
+
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q in %s", rangePart, f.name)
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseCronValue(value string, f cronField) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < f.min || parsed > f.max {
+		return 0, fmt.Errorf("%s must be between %d and %d", f.name, f.min, f.max)
+	}
+
+	return parsed, nil
+}
+
+// Next returns the first time matching the schedule that is strictly after after, or the zero time if there is none
+func (s CronSchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxCronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if !cronMatches(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cronMatches(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cronMatches(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := cronMatches(s.dayOfMonth, t.Day())
+	dayOfWeek := cronMatches(s.dayOfWeek, int(t.Weekday()))
+
+	if s.restrictedDayOfMonth && s.restrictedDayOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+
+	return dayOfMonth && dayOfWeek
+}
+
+func cronMatches(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"* * * * *", true},
+		{"*/15 8-18 * * 1-5", true},
+		{"0 0 1,15 * *", true},
+		{"30 8-10/2 * * 0,6", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 7", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"1- * * * *", false},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCronSchedule(tt.expression)
+		if tt.valid != (err == nil) {
+			t.Errorf("unexpected result for %q: %v", tt.expression, err)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	// The 1st of January 2024 is a Monday
+	tests := []struct {
+		name       string
+		expression string
+		after      time.Time
+		next       time.Time
+	}{
+		{"step", "*/15 * * * *", date(2024, 1, 1, 10, 7).Add(30 * time.Second), date(2024, 1, 1, 10, 15)},
+		{"strictly after", "*/15 * * * *", date(2024, 1, 1, 10, 15), date(2024, 1, 1, 10, 30)},
+		{"range with step", "30 8-10/2 * * 1-5", date(2024, 1, 5, 10, 30), date(2024, 1, 8, 8, 30)},
+		{"month rollover", "0 0 1 * *", date(2024, 1, 31, 12, 0), date(2024, 2, 1, 0, 0)},
+		{"months without the day", "0 0 31 * *", date(2024, 1, 31, 0, 0), date(2024, 3, 31, 0, 0)},
+		{"year rollover", "59 23 31 12 *", date(2024, 12, 31, 23, 59), date(2025, 12, 31, 23, 59)},
+		{"leap day", "0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		{"day of week", "0 0 * * 5", date(2024, 1, 5, 0, 0), date(2024, 1, 12, 0, 0)},
+		{"day of month or day of week matches the day of week", "0 0 13 * 5", date(2024, 1, 1, 0, 0), date(2024, 1, 5, 0, 0)},
+		{"day of month or day of week matches the day of month", "0 0 13 * 5", date(2024, 1, 12, 0, 0), date(2024, 1, 13, 0, 0)},
+		{"day of month with a step and day of week both match", "0 0 */10 * 1", date(2024, 1, 1, 0, 0), date(2024, 3, 11, 0, 0)},
+		{"impossible date", "0 0 30 2 *", date(2024, 1, 1, 0, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if next := schedule.Next(tt.after); !next.Equal(tt.next) {
+				t.Errorf("expected %s, got %s", tt.next, next)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+	"math/big"
+)
+
+// BaseDerivationPath is the BIP-44 path of Ethereum accounts. Wallets are derived at BaseDerivationPath/i.
+const BaseDerivationPath = "m/44'/60'/0'/0"
+
+var errInvalidChildKey = errors.New("derived key is invalid, use the next index")
+
+type HDSeed struct {
+	Mnemonic  string `json:"mnemonic"`
+	NextIndex uint32 `json:"next_index"`
+	Revealed  bool   `json:"revealed"` //The mnemonic can only be revealed to the user once
+}
+
+func NewHDSeed() (HDSeed, error) {
+	entropy, err := bip39.NewEntropy(256)
+	if err != nil {
+		return HDSeed{}, fmt.Errorf("failed to generate entropy: %w", err)
+	}
+
+	mnemonic, err := bip39.NewMnemonic(entropy)
+	if err != nil {
+		return HDSeed{}, fmt.Errorf("failed to generate mnemonic: %w", err)
+	}
+
+	return HDSeed{
+		Mnemonic: mnemonic,
+	}, nil
+}
+
+func (h HDSeed) DeriveWallet(name string, public bool, index uint32) (Wallet, error) {
+	return NewWalletFromMnemonic(name, public, h.Mnemonic, "", fmt.Sprintf("%s/%d", BaseDerivationPath, index))
+}
+
+// EnsureHDSeed creates the HD seed of users that registered before HD wallets were supported
+func (u *User) EnsureHDSeed() error {
+	if u.HDSeed != nil {
+		return nil
+	}
+
+	seed, err := NewHDSeed()
+	if err != nil {
+		return err
+	}
+
+	u.HDSeed = &seed
+	return nil
+}
+
+// ReserveHDIndex returns the index of the next HD wallet. Every index is only returned once.
+func (u *User) ReserveHDIndex() (uint32, error) {
+	if err := u.EnsureHDSeed(); err != nil {
+		return 0, err
+	}
+
+	index := u.HDSeed.NextIndex
+	u.HDSeed.NextIndex++
+
+	return index, nil
+}
+
+// NewWalletFromMnemonic derives the wallet at path from a BIP-39 mnemonic and an optional passphrase
+func NewWalletFromMnemonic(name string, public bool, mnemonic, passphrase, path string) (Wallet, error) {
+	if !bip39.IsMnemonicValid(mnemonic) {
+		return Wallet{}, errors.New("mnemonic is invalid")
+	}
+
+	derivationPath, err := accounts.ParseDerivationPath(path)
+	if err != nil {
+		return Wallet{}, fmt.Errorf("derivation path is invalid: %w", err)
+	}
+
+	sk, err := deriveKey(bip39.NewSeed(mnemonic, passphrase), derivationPath)
+	if err != nil {
+		return Wallet{}, err
+	}
+
+	return Wallet{
+		Name:           name,
+		PrivateKeyHex:  hex.EncodeToString(crypto.FromECDSA(sk)),
+		Address:        crypto.PubkeyToAddress(sk.PublicKey).Hex(),
+		Public:         public,
+		DerivationPath: derivationPath.String(),
+	}, nil
+}
+
+// deriveKey implements the private key derivation of BIP-32
+// See https://github.com/bitcoin/bips/blob/master/bip-0032.mediawiki
+func deriveKey(seed []byte, path accounts.DerivationPath) (*ecdsa.PrivateKey, error) {
+	key, chainCode := hmacSHA512([]byte("Bitcoin seed"), seed)
+
+	n := crypto.S256().Params().N
+	if k := new(big.Int).SetBytes(key); k.Sign() == 0 || k.Cmp(n) >= 0 {
+		return nil, errInvalidChildKey
+	}
+
+	for _, index := range path {
+		var data []byte
+		if index >= 0x80000000 {
+			data = append([]byte{0x00}, key...)
+		} else {
+			sk, err := crypto.ToECDSA(key)
+			if err != nil {
+				return nil, err
+			}
+			data = crypto.CompressPubkey(&sk.PublicKey)
+		}
+		data = binary.BigEndian.AppendUint32(data, index)
+
+		il, ir := hmacSHA512(chainCode, data)
+
+		tweak := new(big.Int).SetBytes(il)
+		if tweak.Cmp(n) >= 0 {
+			return nil, errInvalidChildKey
+		}
+
+		child := tweak.Add(tweak, new(big.Int).SetBytes(key))
+		child.Mod(child, n)
+		if child.Sign() == 0 {
+			return nil, errInvalidChildKey
+		}
+
+		key = child.FillBytes(make([]byte, 32))
+		chainCode = ir
+	}
+
+	return crypto.ToECDSA(key)
+}
+
+func hmacSHA512(key, data []byte) ([]byte, []byte) {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	return sum[:32], sum[32:]
+}
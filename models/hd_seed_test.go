@@ -0,0 +1,68 @@
+package models
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+// Test vector 1 of BIP-32
+func TestDeriveKey(t *testing.T) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		key  string
+	}{
+		{"m", "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"},
+		{"m/0'", "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{"m/0'/1", "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{"m/0'/1/2'", "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca"},
+		{"m/0'/1/2'/2", "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4"},
+		{"m/0'/1/2'/2/1000000000", "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// ParseDerivationPath requires at least one component
+			var path accounts.DerivationPath
+			if tt.path != "m" {
+				path, err = accounts.ParseDerivationPath(tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sk, err := deriveKey(seed, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(crypto.FromECDSA(sk)); got != tt.key {
+				t.Errorf("expected key %s, got %s", tt.key, got)
+			}
+		})
+	}
+}
+
+func TestNewWalletFromMnemonic(t *testing.T) {
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+	wallet, err := NewWalletFromMnemonic("Main", false, mnemonic, "", BaseDerivationPath+"/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wallet.Address != "0x9858EfFD232B4033E47d90003D41EC34EcaEda94" {
+		t.Errorf("unexpected address %s", wallet.Address)
+	}
+	if wallet.DerivationPath != "m/44'/60'/0'/0/0" {
+		t.Errorf("unexpected derivation path %s", wallet.DerivationPath)
+	}
+
+	if _, err = NewWalletFromMnemonic("Main", false, mnemonic+" abandon", "", BaseDerivationPath+"/0"); err == nil {
+		t.Error("an invalid mnemonic has been accepted")
+	}
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"strings"
+)
+
+// NonceReservation keeps a nonce of a wallet on a chain from being used by another transaction
+type NonceReservation struct {
+	ChainID   string `json:"chain_id"`
+	Address   string `json:"address"`
+	Nonce     uint64 `json:"nonce"`
+	Challenge string `json:"challenge"`  //Challenge of the ceremony holding the reservation, empty once the transaction has been signed
+	ExpiresAt int64  `json:"expires_at"` //Unix timestamp after which the nonce is released
+}
+
+// ReserveNonce returns the lowest nonce of the wallet that is neither used according to the node nor reserved.
+// Gaps left behind by released reservations are therefore filled first.
+func (u *User) ReserveNonce(chainID, address string, pendingNonce uint64, challenge string, now, expiresAt int64) uint64 {
+	u.pruneNonceReservations(chainID, address, pendingNonce, now)
+
+	reserved := make(map[uint64]bool)
+	for _, r := range u.NonceReservations {
+		if r.matches(chainID, address) {
+			reserved[r.Nonce] = true
+		}
+	}
+
+	nonce := pendingNonce
+	for reserved[nonce] {
+		nonce++
+	}
+
+	u.NonceReservations = append(u.NonceReservations, NonceReservation{
+		ChainID:   chainID,
+		Address:   address,
+		Nonce:     nonce,
+		Challenge: challenge,
+		ExpiresAt: expiresAt,
+	})
+
+	return nonce
+}
+
+// ReserveChosenNonce reserves a nonce chosen by the caller. It returns false if the node reports the nonce as used or another
+// transaction reserved it already, because the spend ledger identifies transactions by their nonce.
+func (u *User) ReserveChosenNonce(chainID, address string, nonce, pendingNonce uint64, challenge string, now, expiresAt int64) bool {
+	u.pruneNonceReservations(chainID, address, pendingNonce, now)
+
+	if nonce < pendingNonce {
+		return false
+	}
+	for _, r := range u.NonceReservations {
+		if r.matches(chainID, address) && r.Nonce == nonce {
+			return false
+		}
+	}
+
+	u.NonceReservations = append(u.NonceReservations, NonceReservation{
+		ChainID:   chainID,
+		Address:   address,
+		Nonce:     nonce,
+		Challenge: challenge,
+		ExpiresAt: expiresAt,
+	})
+
+	return true
+}
+
+// ReleaseNonce releases a reserved nonce, for example if its transaction could not be sent
+func (u *User) ReleaseNonce(chainID, address string, nonce uint64) {
+	reservations := make([]NonceReservation, 0, len(u.NonceReservations))
+	for _, r := range u.NonceReservations {
+		if !r.matches(chainID, address) || r.Nonce != nonce {
+			reservations = append(reservations, r)
+		}
+	}
+	u.NonceReservations = reservations
+}
+
+// RetainNonce keeps the nonce reserved after its ceremony finished until expiresAt.
+// The reservation is released earlier once the node reports the nonce as used.
+func (u *User) RetainNonce(challenge string, expiresAt int64) {
+	for i := range u.NonceReservations {
+		if u.NonceReservations[i].Challenge == challenge {
+			u.NonceReservations[i].Challenge = ""
+			u.NonceReservations[i].ExpiresAt = expiresAt
+		}
+	}
+}
+
+// ExtendNonce keeps a reserved nonce until expiresAt, for example while its transaction waits for approvals
+func (u *User) ExtendNonce(chainID, address string, nonce uint64, expiresAt int64) {
+	for i, r := range u.NonceReservations {
+		if r.matches(chainID, address) && r.Nonce == nonce && r.ExpiresAt < expiresAt {
+			u.NonceReservations[i].ExpiresAt = expiresAt
+		}
+	}
+}
+
+// pruneNonceReservations releases reservations that are used according to the node, expired,
+// or whose ceremony has been abandoned in favor of another one
+func (u *User) pruneNonceReservations(chainID, address string, pendingNonce uint64, now int64) {
+	reservations := make([]NonceReservation, 0, len(u.NonceReservations))
+	for _, r := range u.NonceReservations {
+		if r.matches(chainID, address) && r.Nonce < pendingNonce {
+			continue
+		}
+		if r.ExpiresAt < now {
+			continue
+		}
+		if _, ok := u.WebauthnData.PendingTransactions[r.Challenge]; r.Challenge != "" && !ok {
+			continue
+		}
+
+		reservations = append(reservations, r)
+	}
+	u.NonceReservations = reservations
+}
+
+func (r NonceReservation) matches(chainID, address string) bool {
+	return r.ChainID == chainID && strings.EqualFold(r.Address, address)
+}
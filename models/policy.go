@@ -0,0 +1,280 @@
+package models
+
+import (
+	"golang.org/x/exp/slices"
+	"math/big"
+	"strings"
+)
+
+const (
+	ContractRuleAllow = "allow"
+	ContractRuleDeny  = "deny"
+)
+
+// Spend ledger entries are kept as long as the longest limit period
+const spendLedgerRetention = 7 * 24 * 60 * 60
+
+// Policy restricts the transactions the user can initiate, independent of the webauthn assertion approving them
+type Policy struct {
+	SpendLimits             []SpendLimit         `json:"spend_limits" validate:"dive"`
+	Allowlist               []string             `json:"allowlist" validate:"dive,ethereum_address"` //If not empty, only these destinations and the own wallets can be used
+	Denylist                []string             `json:"denylist" validate:"dive,ethereum_address"`
+	ContractRules           []ContractRule       `json:"contract_rules" validate:"dive"`
+	OnlyAllowedContracts    bool                 `json:"only_allowed_contracts"` //Rejects calls to contracts without a matching allow rule
+	BlockUnlimitedApprovals bool                 `json:"block_unlimited_approvals"`
+	QuorumRules             []QuorumRule         `json:"quorum_rules" validate:"dive"`
+	DelayRules              []DelayRule          `json:"delay_rules" validate:"dive"`
+	SignInDomains           []string             `json:"sign_in_domains" validate:"dive,required,max=253"` //Domains trusted for Sign-In with Ethereum besides the requesting origin
+	SignatureExemptions     []SignatureExemption `json:"signature_exemptions" validate:"dive"`             //Messages are signed with a webauthn ceremony unless an exemption matches
+	AllowEthSign            bool                 `json:"allow_eth_sign"`                                   //eth_sign signs arbitrary hashes, including those of transactions
+}
+
+// SpendLimit limits the amount a wallet can spend of the native currency or a token.
+// Amounts are decimal strings in base units, an empty amount means no limit.
+type SpendLimit struct {
+	Wallet  string `json:"wallet" validate:"required,ethereum_address"`
+	ChainID string `json:"chain_id" validate:"required,hexadecimal"`
+	Token   string `json:"token" validate:"omitempty,ethereum_address"` //Empty for the native currency
+	Daily   string `json:"daily" validate:"omitempty,number"`
+	Weekly  string `json:"weekly" validate:"omitempty,number"`
+}
+
+// ContractRule allows or denies calls to a contract. Deny rules take precedence over allow rules.
+type ContractRule struct {
+	ChainID string   `json:"chain_id" validate:"required,hexadecimal"`
+	Address string   `json:"address" validate:"required,ethereum_address"`
+	Methods []string `json:"methods" validate:"dive,required"` //Selectors or names of bundled methods the rule applies to, all methods if empty
+	Action  string   `json:"action" validate:"required,oneof=allow deny"`
+}
+
+// DelayRule holds back transactions spending more than the threshold of the token on the chain, so they can be cancelled.
+// An empty chain matches every chain, an empty token the native currency and an empty threshold every transaction.
+type DelayRule struct {
+	ChainID   string `json:"chain_id" validate:"omitempty,hexadecimal"`
+	Token     string `json:"token" validate:"omitempty,ethereum_address"`
+	Threshold string `json:"threshold" validate:"omitempty,number"`
+	Delay     int64  `json:"delay" validate:"required,min=60,max=2592000"` //Seconds
+}
+
+// SpendEntry records an amount spent by a signed transaction, so it counts towards the spend limits
+type SpendEntry struct {
+	Wallet    string `json:"wallet"`
+	ChainID   string `json:"chain_id"`
+	Token     string `json:"token"` //Empty for the native currency
+	Amount    string `json:"amount"`
+	Nonce     uint64 `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func NewPolicy() Policy {
+	return Policy{
+		SpendLimits:         make([]SpendLimit, 0),
+		Allowlist:           make([]string, 0),
+		Denylist:            make([]string, 0),
+		ContractRules:       make([]ContractRule, 0),
+		QuorumRules:         make([]QuorumRule, 0),
+		DelayRules:          make([]DelayRule, 0),
+		SignInDomains:       make([]string, 0),
+		SignatureExemptions: make([]SignatureExemption, 0),
+	}
+}
+
+func (l SpendLimit) Matches(wallet, chainID, token string) bool {
+	return strings.EqualFold(l.Wallet, wallet) && strings.EqualFold(l.ChainID, chainID) && strings.EqualFold(l.Token, token)
+}
+
+// Matches reports whether the rule applies to a call of method with selector on the contract at address
+func (r ContractRule) Matches(chainID, address, method, selector string) bool {
+	if !strings.EqualFold(r.ChainID, chainID) || !strings.EqualFold(r.Address, address) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+
+	return slices.IndexFunc(r.Methods, func(m string) bool {
+		return (method != "" && m == method) || strings.EqualFold(m, selector)
+	}) != -1
+}
+
+// Loosens reports whether p allows anything that previous did not.
+// Changes that can not be classified are treated as loosening.
+func (p Policy) Loosens(previous Policy) bool {
+	for _, old := range previous.SpendLimits {
+		i := slices.IndexFunc(p.SpendLimits, func(l SpendLimit) bool {
+			return l.Matches(old.Wallet, old.ChainID, old.Token)
+		})
+		if i == -1 || isHigherLimit(p.SpendLimits[i].Daily, old.Daily) || isHigherLimit(p.SpendLimits[i].Weekly, old.Weekly) {
+			return true
+		}
+	}
+
+	if len(previous.Allowlist) > 0 && (len(p.Allowlist) == 0 || !containsAllAddresses(previous.Allowlist, p.Allowlist)) {
+		return true
+	}
+	if !containsAllAddresses(p.Denylist, previous.Denylist) {
+		return true
+	}
+	if !containsAllAddresses(previous.SignInDomains, p.SignInDomains) {
+		return true
+	}
+	for _, exemption := range p.SignatureExemptions {
+		if !slices.Contains(previous.SignatureExemptions, exemption) {
+			return true
+		}
+	}
+
+	for _, rule := range previous.ContractRules {
+		if rule.Action == ContractRuleDeny && !containsRule(p.ContractRules, rule) {
+			return true
+		}
+	}
+	for _, rule := range p.ContractRules {
+		if rule.Action == ContractRuleAllow && !containsRule(previous.ContractRules, rule) {
+			return true
+		}
+	}
+
+	for _, old := range previous.QuorumRules {
+		stricter := slices.ContainsFunc(p.QuorumRules, func(r QuorumRule) bool {
+			return isStricterQuorum(r, old)
+		})
+		if !stricter {
+			return true
+		}
+	}
+
+	for _, old := range previous.DelayRules {
+		stricter := slices.ContainsFunc(p.DelayRules, func(r DelayRule) bool {
+			return strings.EqualFold(r.ChainID, old.ChainID) &&
+				strings.EqualFold(r.Token, old.Token) &&
+				r.Delay >= old.Delay &&
+				!isHigherThreshold(r.Threshold, old.Threshold)
+		})
+		if !stricter {
+			return true
+		}
+	}
+
+	return (previous.OnlyAllowedContracts && !p.OnlyAllowedContracts) ||
+		(previous.BlockUnlimitedApprovals && !p.BlockUnlimitedApprovals) ||
+		(!previous.AllowEthSign && p.AllowEthSign)
+}
+
+func (r DelayRule) AppliesTo(chainID string, spent map[string]*big.Int) bool {
+	return exceedsThreshold(r.ChainID, r.Token, r.Threshold, chainID, spent)
+}
+
+// IsAllowlisted reports whether address can be used as destination. An empty allowlist allows every address.
+func (p Policy) IsAllowlisted(address string) bool {
+	return len(p.Allowlist) == 0 || containsAddress(p.Allowlist, address)
+}
+
+func (p Policy) IsDenylisted(address string) bool {
+	return containsAddress(p.Denylist, address)
+}
+
+func (p Policy) IsTrustedSignInDomain(domain string) bool {
+	return containsAddress(p.SignInDomains, domain)
+}
+
+// RequiresSignatureCeremony reports whether a message of signatureType has to be confirmed with a webauthn assertion
+func (p Policy) RequiresSignatureCeremony(wallet, signatureType, primaryType string) bool {
+	return !slices.ContainsFunc(p.SignatureExemptions, func(e SignatureExemption) bool {
+		return e.Matches(wallet, signatureType, primaryType)
+	})
+}
+
+// Spent returns the amount of token the wallet spent since the unix timestamp since.
+// The entry of the nonce excluded is skipped, because a transaction replacing it does not spend twice.
+func (u *User) Spent(wallet, chainID, token string, since int64, excluded uint64) *big.Int {
+	total := new(big.Int)
+	for _, e := range u.SpendLedger {
+		if e.Timestamp < since || e.Nonce == excluded || !e.matches(wallet, chainID) || !strings.EqualFold(e.Token, token) {
+			continue
+		}
+
+		amount, ok := new(big.Int).SetString(e.Amount, 10)
+		if ok {
+			total.Add(total, amount)
+		}
+	}
+
+	return total
+}
+
+// RecordSpend adds the entries of a signed transaction to the ledger.
+// Entries of a transaction with the same nonce are replaced and entries older than the longest limit period are pruned.
+func (u *User) RecordSpend(wallet, chainID string, nonce uint64, entries []SpendEntry, now int64) {
+	u.RemoveSpend(wallet, chainID, nonce)
+
+	ledger := make([]SpendEntry, 0, len(u.SpendLedger)+len(entries))
+	for _, e := range u.SpendLedger {
+		if e.Timestamp >= now-spendLedgerRetention {
+			ledger = append(ledger, e)
+		}
+	}
+	u.SpendLedger = append(ledger, entries...)
+}
+
+// RemoveSpend removes the entries of a transaction, for example if it could not be sent
+func (u *User) RemoveSpend(wallet, chainID string, nonce uint64) {
+	ledger := make([]SpendEntry, 0, len(u.SpendLedger))
+	for _, e := range u.SpendLedger {
+		if !e.matches(wallet, chainID) || e.Nonce != nonce {
+			ledger = append(ledger, e)
+		}
+	}
+	u.SpendLedger = ledger
+}
+
+func (e SpendEntry) matches(wallet, chainID string) bool {
+	return strings.EqualFold(e.Wallet, wallet) && strings.EqualFold(e.ChainID, chainID)
+}
+
+// isHigherLimit reports whether the limit updated allows more than previous. An empty limit is unlimited.
+func isHigherLimit(updated, previous string) bool {
+	if previous == "" {
+		return false
+	}
+	if updated == "" {
+		return true
+	}
+
+	u, ok := new(big.Int).SetString(updated, 10)
+	if !ok {
+		return true
+	}
+	p, ok := new(big.Int).SetString(previous, 10)
+	if !ok {
+		return true
+	}
+
+	return u.Cmp(p) > 0
+}
+
+// containsAllAddresses reports whether every address of subset is in set
+func containsAllAddresses(set, subset []string) bool {
+	for _, address := range subset {
+		if !containsAddress(set, address) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAddress(addresses []string, address string) bool {
+	return slices.IndexFunc(addresses, func(a string) bool {
+		return strings.EqualFold(a, address)
+	}) != -1
+}
+
+func containsRule(rules []ContractRule, rule ContractRule) bool {
+	return slices.IndexFunc(rules, func(r ContractRule) bool {
+		return r.Action == rule.Action &&
+			strings.EqualFold(r.ChainID, rule.ChainID) &&
+			strings.EqualFold(r.Address, rule.Address) &&
+			slices.Equal(r.Methods, rule.Methods)
+	}) != -1
+}
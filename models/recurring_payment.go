@@ -0,0 +1,115 @@
+package models
+
+import (
+	"math/big"
+	"time"
+)
+
+const (
+	RecurringActive    = "active"
+	RecurringCompleted = "completed" //The end date or the maximum amount has been reached
+	RecurringCancelled = "cancelled"
+)
+
+// RecurringPayment is a transfer of native currency or of an ERC-20 token that the user authorized once
+// and that the enclave sends on every run of Schedule
+type RecurringPayment struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	ChainID    string `json:"chain_id"`
+	Token      string `json:"token"`      //Empty for the native currency
+	Amount     string `json:"amount"`     //Amount of every payment in the smallest unit of the token
+	Schedule   string `json:"schedule"`   //Cron expression evaluated in UTC
+	EndAt      int64  `json:"end_at"`     //Zero if the payments do not end
+	MaxAmount  string `json:"max_amount"` //Total of all payments, empty if unlimited
+	Paid       string `json:"paid"`       //Total of the payments that have been sent or are being sent
+	Credential string `json:"credential"` //Name of the credential that authorized the payments
+	Status     string `json:"status"`
+	NextRunAt  int64  `json:"next_run_at"`
+	LastRunAt  int64  `json:"last_run_at"`
+	Runs       int    `json:"runs"`
+	LastError  string `json:"last_error"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+func (p RecurringPayment) IsDue(now int64) bool {
+	return p.Status == RecurringActive && p.NextRunAt <= now
+}
+
+// CanPay reports whether another payment stays within the maximum amount
+func (p RecurringPayment) CanPay() bool {
+	if p.MaxAmount == "" {
+		return true
+	}
+
+	maxAmount, _ := new(big.Int).SetString(p.MaxAmount, 10)
+	total := new(big.Int).Add(parseAmount(p.Paid), parseAmount(p.Amount))
+	return maxAmount != nil && total.Cmp(maxAmount) <= 0
+}
+
+// AddPaid adds a payment of Amount to the total. Negative counts remove payments that have not been sent.
+func (p *RecurringPayment) AddPaid(count int64) {
+	amount := new(big.Int).Mul(parseAmount(p.Amount), big.NewInt(count))
+	paid := new(big.Int).Add(parseAmount(p.Paid), amount)
+	if paid.Sign() < 0 {
+		paid.SetInt64(0)
+	}
+
+	p.Paid = paid.String()
+}
+
+// Advance moves the payment past the run at NextRunAt. Runs missed while the enclave was down are skipped,
+// so the payment is completed once the schedule, the end date or the maximum amount allow no further run.
+func (p *RecurringPayment) Advance(schedule CronSchedule, now time.Time) {
+	p.LastRunAt = p.NextRunAt
+	p.UpdatedAt = now.Unix()
+
+	after := time.Unix(p.NextRunAt, 0)
+	if now.After(after) {
+		after = now
+	}
+
+	next := schedule.Next(after)
+	if next.IsZero() || (p.EndAt != 0 && next.Unix() > p.EndAt) || !p.CanPay() {
+		p.Status = RecurringCompleted
+		return
+	}
+
+	p.NextRunAt = next.Unix()
+}
+
+// Refund removes a run that has not been sent from the total. A payment completed because the maximum amount
+// had been reached is active again if the schedule and the end date allow another run.
+func (p *RecurringPayment) Refund(schedule CronSchedule, now time.Time) {
+	p.AddPaid(-1)
+	p.UpdatedAt = now.Unix()
+	if p.Status != RecurringCompleted || !p.CanPay() {
+		return
+	}
+
+	after := time.Unix(p.LastRunAt, 0)
+	if now.After(after) {
+		after = now
+	}
+
+	next := schedule.Next(after)
+	if next.IsZero() || (p.EndAt != 0 && next.Unix() > p.EndAt) {
+		return
+	}
+
+	p.Status = RecurringActive
+	p.NextRunAt = next.Unix()
+}
+
+// parseAmount parses a decimal amount, invalid amounts are treated as zero
+func parseAmount(amount string) *big.Int {
+	parsed, ok := new(big.Int).SetString(amount, 10)
+	if !ok {
+		return new(big.Int)
+	}
+
+	return parsed
+}
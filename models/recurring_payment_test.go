@@ -0,0 +1,51 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecurringPaymentRefund(t *testing.T) {
+	schedule, err := ParseCronSchedule("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastRun := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	now := lastRun.Add(30 * time.Minute)
+	completed := RecurringPayment{
+		Amount:    "10",
+		MaxAmount: "20",
+		Paid:      "20",
+		Status:    RecurringCompleted,
+		NextRunAt: lastRun.Unix(),
+		LastRunAt: lastRun.Unix(),
+	}
+
+	tests := []struct {
+		name      string
+		modify    func(p *RecurringPayment)
+		status    string
+		nextRunAt int64
+	}{
+		{"reactivated below the maximum amount", func(p *RecurringPayment) {}, RecurringActive, lastRun.Add(time.Hour).Unix()},
+		{"completed at the end date", func(p *RecurringPayment) { p.EndAt = lastRun.Unix() }, RecurringCompleted, lastRun.Unix()},
+		{"cancelled", func(p *RecurringPayment) { p.Status = RecurringCancelled }, RecurringCancelled, lastRun.Unix()},
+		{"active", func(p *RecurringPayment) { p.Status = RecurringActive; p.NextRunAt = lastRun.Add(time.Hour).Unix() }, RecurringActive, lastRun.Add(time.Hour).Unix()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := completed
+			tt.modify(&payment)
+
+			payment.Refund(schedule, now)
+			if payment.Paid != "10" {
+				t.Errorf("expected 10 paid, got %s", payment.Paid)
+			}
+			if payment.Status != tt.status || payment.NextRunAt != tt.nextRunAt {
+				t.Errorf("expected status %s and next run at %d, got %s and %d", tt.status, tt.nextRunAt, payment.Status, payment.NextRunAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package models
+
+const (
+	ScheduledWaiting   = "scheduled"
+	ScheduledSending   = "sending" //Signed, but the broadcast has not been confirmed by the node yet
+	ScheduledSent      = "sent"
+	ScheduledFailed    = "failed"
+	ScheduledCancelled = "cancelled"
+)
+
+const (
+	ScheduleKindScheduled  = "scheduled"   //Scheduled by the user for a point in time
+	ScheduleKindTimeLocked = "time_locked" //Held back by a delay rule of the policy
+	ScheduleKindRecurring  = "recurring"   //A run of a recurring payment
+)
+
+// Failed attempts to send a scheduled transaction are repeated this many times before it fails
+const MaxScheduledAttempts = 3
+
+// ScheduledTransaction is a transaction approved by the user that is sent by the enclave at ExecuteAt.
+// The nonce and the fees are chosen when the transaction is sent, so scheduled transactions do not block other transactions.
+type ScheduledTransaction struct {
+	ID             string            `json:"id"`
+	Kind           string            `json:"kind"`
+	Params         TransactionParams `json:"params"`
+	Credential     string            `json:"credential"` //Names of the credentials that approved the transaction
+	Status         string            `json:"status"`
+	ExecuteAt      int64             `json:"execute_at"`
+	CreatedAt      int64             `json:"created_at"`
+	UpdatedAt      int64             `json:"updated_at"`
+	Attempts       int               `json:"attempts"`
+	RawTransaction string            `json:"raw_transaction"` //Kept while sending, so a broadcast interrupted by a restart is repeated instead of signing again
+	Hash           string            `json:"hash"`
+	Error          string            `json:"error"`
+	Recurring      string            `json:"recurring"` //ID of the recurring payment of a run, empty otherwise
+}
+
+// PendingSchedule is a transaction to be scheduled once its webauthn ceremony has been finalized
+type PendingSchedule struct {
+	Params    TransactionParams `json:"params"`
+	ExecuteAt int64             `json:"execute_at"`
+}
+
+// IsDue reports whether the scheduler has to work on the transaction at the unix timestamp now
+func (s ScheduledTransaction) IsDue(now int64) bool {
+	return (s.Status == ScheduledWaiting && s.ExecuteAt <= now) || s.Status == ScheduledSending
+}
+
+func (s ScheduledTransaction) IsCancellable() bool {
+	return s.Status == ScheduledWaiting
+}
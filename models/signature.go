@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	SignatureTypePersonal  = "personal_sign"
+	SignatureTypeTypedData = "typed_data"
+	SignatureTypeEthSign   = "eth_sign"
+)
+
+// PendingSignature holds a message until signing it has been confirmed with a webauthn assertion
+type PendingSignature struct {
+	Type      string          `json:"type"`
+	From      string          `json:"from"`
+	Message   string          `json:"message"`    //Message of personal_sign or hash of eth_sign
+	TypedData json.RawMessage `json:"typed_data"` //Typed data, kept as json so the signed data matches the previewed data exactly
+	Version   string          `json:"version"`    //Version of eth_signTypedData the typed data is encoded with
+	Origin    string          `json:"origin"`
+}
+
+// SignatureExemption lets matching messages be signed without a webauthn ceremony.
+// An empty wallet matches every wallet and an empty primary type every typed data message.
+type SignatureExemption struct {
+	Wallet      string `json:"wallet" validate:"omitempty,ethereum_address"`
+	Type        string `json:"type" validate:"required,oneof=personal_sign typed_data"`
+	PrimaryType string `json:"primary_type" validate:"omitempty,max=256"` //Only used for typed data
+}
+
+func (e SignatureExemption) Matches(wallet, signatureType, primaryType string) bool {
+	return (e.Wallet == "" || strings.EqualFold(e.Wallet, wallet)) &&
+		e.Type == signatureType &&
+		(e.PrimaryType == "" || e.PrimaryType == primaryType)
+}
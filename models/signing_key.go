@@ -1,8 +1,22 @@
 package models
 
-import "crypto/ed25519"
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
 
 type SigningKey struct {
-	PrivateKey ed25519.PrivateKey `json:"private_key"`
-	PublicKey  ed25519.PublicKey  `json:"public_key"`
+	PrivateKey    ed25519.PrivateKey `json:"private_key"`
+	PublicKey     ed25519.PublicKey  `json:"public_key"`
+	AuditLogKeyed bool               `json:"audit_log_keyed"` //Set once the audit log is hashed with AuditKey, unkeyed logs are rejected afterwards
+}
+
+// AuditKey derives the key of the audit log hash chain from the private key
+func (s SigningKey) AuditKey() []byte {
+	key := make([]byte, 32)
+	_, _ = io.ReadFull(hkdf.New(sha256.New, s.PrivateKey.Seed(), nil, []byte("elonwallet audit log")), key)
+
+	return key
 }
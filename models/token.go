@@ -0,0 +1,10 @@
+package models
+
+type Token struct {
+	Symbol   string `json:"symbol"`
+	Address  string `json:"address"`
+	Decimals int64  `json:"decimals"`
+}
+
+// Tokens maps the hex encoded chain id to the ERC-20 tokens whose balances are queried on that chain
+type Tokens map[string][]Token
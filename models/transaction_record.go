@@ -0,0 +1,51 @@
+package models
+
+const (
+	TransactionPending   = "pending"
+	TransactionConfirmed = "confirmed"
+	TransactionReverted  = "reverted"
+	TransactionDropped   = "dropped"
+)
+
+// FinalityConfirmations is the number of confirmations after which a mined transaction is no longer tracked
+const FinalityConfirmations = 12
+
+// TransactionRecord is a transaction that has been sent by the enclave
+type TransactionRecord struct {
+	Hash                 string            `json:"hash"`
+	ChainID              string            `json:"chain_id"`
+	From                 string            `json:"from"`
+	To                   string            `json:"to"`
+	Nonce                uint64            `json:"nonce"`
+	Params               TransactionParams `json:"params"`
+	Type                 string            `json:"type"` //Type of the signed transaction, either 0x1 or 0x2 like in TransactionParams
+	Gas                  uint64            `json:"gas"`
+	GasPrice             string            `json:"gas_price"` //Fees of the signed transaction as decimal strings
+	MaxFeePerGas         string            `json:"max_fee_per_gas"`
+	MaxPriorityFeePerGas string            `json:"max_priority_fee_per_gas"`
+	Replaces             string            `json:"replaces"`    //Hash of the transaction that is sped up or cancelled by this transaction
+	ReplacedBy           string            `json:"replaced_by"` //Hash of the newest transaction that replaces this transaction
+	Credential           string            `json:"credential"`  //Name of the credential that approved the transaction
+	Status               string            `json:"status"`
+	SentAt               int64             `json:"sent_at"`
+	UpdatedAt            int64             `json:"updated_at"`
+	BlockNumber          uint64            `json:"block_number"` //0 as long as the transaction has not been mined
+	BlockHash            string            `json:"block_hash"`
+	GasUsed              uint64            `json:"gas_used"`
+	EffectiveGasPrice    string            `json:"effective_gas_price"`
+	Confirmations        uint64            `json:"confirmations"`
+}
+
+// Replaceable reports whether a speed up or cancellation can still be attempted
+func (t TransactionRecord) Replaceable() bool {
+	return t.Status == TransactionPending && t.BlockNumber == 0
+}
+
+// Settled reports whether the status of the transaction can no longer change
+func (t TransactionRecord) Settled() bool {
+	if t.Status == TransactionDropped {
+		return true
+	}
+
+	return t.BlockNumber != 0 && t.Confirmations >= FinalityConfirmations
+}
@@ -7,13 +7,21 @@ import (
 )
 
 type User struct {
+	Version                 uint64                             `json:"version"` //Incremented on every update, used for optimistic concurrency control
 	WebauthnData            WebauthnData                       `json:"webauthn_data"`
 	Wallets                 Wallets                            `json:"wallets"`
+	HDSeed                  *HDSeed                            `json:"hd_seed"`
 	OTP                     OTP                                `json:"otp,omitempty"`
 	Email                   string                             `json:"email"`
 	Networks                []Network                          `json:"networks"`
 	EmergencyAccessContacts map[string]*EmergencyAccessContact `json:"emergency_access_contacts"`
 	EmergencyAccessGrants   map[string]*EmergencyAccessGrant   `json:"emergency_access_grants"`
+	NonceReservations       []NonceReservation                 `json:"nonce_reservations"`
+	ContractABIs            map[string]ContractABI             `json:"contract_abis"` //Uses ContractABIKey as its keys
+	Policy                  Policy                             `json:"policy"`
+	SpendLedger             []SpendEntry                       `json:"spend_ledger"`
+	PendingApprovals        map[string]PendingApproval         `json:"pending_approvals"`
+	RecurringPayments       map[string]RecurringPayment        `json:"recurring_payments"`
 }
 
 func NewUser(email string, displayName string) User {
@@ -31,9 +39,27 @@ func NewUser(email string, displayName string) User {
 			Credentials:         make(map[string]webauthn.Credential),
 			Sessions:            make(map[string]webauthn.SessionData),
 			PendingTransactions: make(map[string]TransactionParams),
+			PendingExports:      make(map[string]PendingWalletExport),
+			PendingSchedules:    make(map[string]PendingSchedule),
+			PendingRecurring:    make(map[string]RecurringPayment),
+			PendingSignatures:   make(map[string]PendingSignature),
 		},
 		Wallets:                 make(Wallets, 0),
 		EmergencyAccessContacts: make(map[string]*EmergencyAccessContact),
 		EmergencyAccessGrants:   make(map[string]*EmergencyAccessGrant),
+		NonceReservations:       make([]NonceReservation, 0),
+		ContractABIs:            make(map[string]ContractABI),
+		Policy:                  NewPolicy(),
+		SpendLedger:             make([]SpendEntry, 0),
+		PendingApprovals:        make(map[string]PendingApproval),
+		RecurringPayments:       make(map[string]RecurringPayment),
 	}
 }
+
+// ResetCeremonies removes all ongoing webauthn ceremonies together with the nonces and approvals reserved for them.
+// The amounts spent by discarded approvals stay in the spend ledger.
+func (u *User) ResetCeremonies() {
+	u.WebauthnData.ResetCeremonies()
+	u.NonceReservations = make([]NonceReservation, 0)
+	u.PendingApprovals = make(map[string]PendingApproval)
+}
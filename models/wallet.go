@@ -11,10 +11,12 @@ import (
 )
 
 type Wallet struct {
-	Name          string `json:"name"`
-	PrivateKeyHex string `json:"private_key_hex"`
-	Address       string `json:"address"`
-	Public        bool   `json:"public"`
+	Name           string `json:"name"`
+	PrivateKeyHex  string `json:"private_key_hex"`
+	Address        string `json:"address"`
+	Public         bool   `json:"public"`
+	DerivationPath string `json:"derivation_path,omitempty"` //Empty for wallets that were not derived from the HD seed
+	Archived       bool   `json:"archived"`                  //Archived wallets are hidden by the frontend
 }
 
 func NewWallet(name string, public bool) (Wallet, error) {
@@ -23,24 +25,28 @@ func NewWallet(name string, public bool) (Wallet, error) {
 		return Wallet{}, fmt.Errorf("failed to generate ecdsa secret key: %w", err)
 	}
 
-	pk := sk.Public()
-	pkECDSA := pk.(*ecdsa.PublicKey)
+	return NewWalletFromPrivateKey(name, public, sk), nil
+}
 
+func NewWalletFromPrivateKey(name string, public bool, sk *ecdsa.PrivateKey) Wallet {
 	return Wallet{
 		Name:          name,
 		PrivateKeyHex: hex.EncodeToString(crypto.FromECDSA(sk)),
-		Address:       crypto.PubkeyToAddress(*pkECDSA).Hex(),
+		Address:       crypto.PubkeyToAddress(sk.PublicKey).Hex(),
 		Public:        public,
-	}, nil
+	}
+}
+
+// PendingWalletExport holds an encrypted keystore until the export has been confirmed with a webauthn assertion
+type PendingWalletExport struct {
+	Address  string `json:"address"`
+	Keystore string `json:"keystore"`
 }
 
 type Wallets []Wallet
 
 func (w Wallets) FindByAddress(address string) (Wallet, bool) {
-	addr := strings.ToLower(address)
-	index := slices.IndexFunc(w, func(wallet Wallet) bool {
-		return strings.ToLower(wallet.Address) == addr
-	})
+	index := w.IndexByAddress(address)
 	if index == -1 {
 		return Wallet{}, false
 	}
@@ -48,6 +54,14 @@ func (w Wallets) FindByAddress(address string) (Wallet, bool) {
 	return w[index], true
 }
 
+// IndexByAddress returns -1 if no wallet with the address exists
+func (w Wallets) IndexByAddress(address string) int {
+	addr := strings.ToLower(address)
+	return slices.IndexFunc(w, func(wallet Wallet) bool {
+		return strings.ToLower(wallet.Address) == addr
+	})
+}
+
 func (w Wallets) Exists(name string) bool {
 	return slices.ContainsFunc(w, func(wallet Wallet) bool {
 		return wallet.Name == name
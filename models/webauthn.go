@@ -13,6 +13,20 @@ type WebauthnData struct {
 	Credentials         map[string]webauthn.Credential  `json:"credentials"`
 	Sessions            map[string]webauthn.SessionData `json:"sessions"`
 	PendingTransactions map[string]TransactionParams    `json:"pending_transactions"` //Uses  webauthn challenge strings as its keys
+	PendingExports      map[string]PendingWalletExport  `json:"pending_exports"`      //Uses  webauthn challenge strings as its keys
+	PendingSchedules    map[string]PendingSchedule      `json:"pending_schedules"`    //Uses  webauthn challenge strings as its keys
+	PendingRecurring    map[string]RecurringPayment     `json:"pending_recurring"`    //Uses  webauthn challenge strings as its keys
+	PendingSignatures   map[string]PendingSignature     `json:"pending_signatures"`   //Uses  webauthn challenge strings as its keys
+}
+
+// ResetCeremonies removes all ongoing webauthn ceremonies and the operations bound to them
+func (w *WebauthnData) ResetCeremonies() {
+	w.Sessions = make(map[string]webauthn.SessionData)
+	w.PendingTransactions = make(map[string]TransactionParams)
+	w.PendingExports = make(map[string]PendingWalletExport)
+	w.PendingSchedules = make(map[string]PendingSchedule)
+	w.PendingRecurring = make(map[string]RecurringPayment)
+	w.PendingSignatures = make(map[string]PendingSignature)
 }
 
 func (w WebauthnData) WebAuthnID() []byte {
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+)
+
+// KeyAuditLog hashes the unkeyed audit log of older versions with the audit key of signingKey and marks signingKey,
+// so this happens only once. Afterwards an unkeyed log is reported as ErrAuditLogInvalid and left unchanged,
+// because anyone able to write the storage could have forged it. A broken log is kept as evidence.
+func KeyAuditLog(repo common.Repository, signingKey *models.SigningKey) error {
+	key := signingKey.AuditKey()
+	if signingKey.AuditLogKeyed {
+		return repo.RekeyAuditLog(key, key)
+	}
+
+	rekeyErr := repo.RekeyAuditLog(nil, key)
+	if rekeyErr != nil && !errors.Is(rekeyErr, common.ErrAuditLogInvalid) {
+		return rekeyErr
+	}
+
+	signingKey.AuditLogKeyed = true
+	err := repo.SaveSigningKey(*signingKey)
+	if err != nil {
+		return err
+	}
+
+	return rekeyErr
+}
+
+// chainAuditEvent links event to its predecessor and hashes it with key. previous is nil for the first event.
+func chainAuditEvent(event models.AuditEvent, previous *models.AuditEvent, key []byte) models.AuditEvent {
+	event.Sequence = 1
+	event.PrevHash = ""
+	if previous != nil {
+		event.Sequence = previous.Sequence + 1
+		event.PrevHash = previous.Hash
+	}
+	event.Hash = event.CalculateHash(key)
+
+	return event
+}
+
+// rekeyAuditEvents returns the events hashed with key, or nil if they are hashed with key already
+func rekeyAuditEvents(events []models.AuditEvent, previousKey, key []byte) ([]models.AuditEvent, error) {
+	if models.AuditEvents(events).Verify(key, nil) {
+		return nil, nil
+	}
+	if !models.AuditEvents(events).Verify(previousKey, nil) {
+		return nil, common.ErrAuditLogInvalid
+	}
+
+	rekeyed := make([]models.AuditEvent, len(events))
+	for i, event := range events {
+		var previous *models.AuditEvent
+		if i > 0 {
+			previous = &rekeyed[i-1]
+		}
+		rekeyed[i] = chainAuditEvent(event, previous, key)
+	}
+
+	return rekeyed, nil
+}
+
+func paginate[T any](elements []T, offset, limit int) []T {
+	if offset >= len(elements) {
+		return make([]T, 0)
+	}
+
+	end := offset + limit
+	if end > len(elements) {
+		end = len(elements)
+	}
+
+	return elements[offset:end]
+}
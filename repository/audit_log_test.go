@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"testing"
+)
+
+func testAuditRepositories(t *testing.T) map[string]common.Repository {
+	jsonFile, err := NewJsonFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]common.Repository{
+		"memory": NewMemory(),
+		"json":   jsonFile,
+	}
+}
+
+func appendAuditEvents(t *testing.T, repo common.Repository, key []byte, n int) {
+	for i := 0; i < n; i++ {
+		_, err := repo.AppendAuditEvent(models.AuditEvent{Type: models.AuditLogin, Details: map[string]string{}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditLogIsKeyed(t *testing.T) {
+	key := []byte("audit key")
+
+	for name, repo := range testAuditRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			appendAuditEvents(t, repo, key, 3)
+
+			events, _, err := repo.GetAuditEvents(0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !models.AuditEvents(events).Verify(key, nil) {
+				t.Error("the log is invalid")
+			}
+			if models.AuditEvents(events).Verify([]byte("other key"), nil) {
+				t.Error("the log is valid for another key")
+			}
+			if models.AuditEvents(events).Verify(nil, nil) {
+				t.Error("the log is valid without a key")
+			}
+
+			// A page is verified from the event before it, the start of the log has to be the anchor
+			if !models.AuditEvents(events[1:]).Verify(key, &events[0]) {
+				t.Error("the page is invalid")
+			}
+			if models.AuditEvents(events[1:]).Verify(key, nil) {
+				t.Error("a log without its first event is valid")
+			}
+		})
+	}
+}
+
+func TestRekeyAuditLog(t *testing.T) {
+	key := []byte("audit key")
+
+	for name, repo := range testAuditRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			// Older versions hashed the log without a key
+			appendAuditEvents(t, repo, nil, 2)
+
+			if err := repo.RekeyAuditLog(nil, key); err != nil {
+				t.Fatal(err)
+			}
+			// A log hashed with key already is left unchanged
+			if err := repo.RekeyAuditLog(nil, key); err != nil {
+				t.Fatal(err)
+			}
+			appendAuditEvents(t, repo, key, 1)
+
+			events, total, err := repo.GetAuditEvents(0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 3 || !models.AuditEvents(events).Verify(key, nil) {
+				t.Errorf("the rekeyed log with %d events is invalid", total)
+			}
+
+			if err := repo.RekeyAuditLog([]byte("wrong key"), []byte("new key")); !errors.Is(err, common.ErrAuditLogInvalid) {
+				t.Errorf("expected %v, got %v", common.ErrAuditLogInvalid, err)
+			}
+		})
+	}
+}
+
+func TestKeyAuditLogOnce(t *testing.T) {
+	for name, repo := range testAuditRepositories(t) {
+		t.Run(name, func(t *testing.T) {
+			publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signingKey := models.SigningKey{PrivateKey: privateKey, PublicKey: publicKey}
+			if err = repo.SaveSigningKey(signingKey); err != nil {
+				t.Fatal(err)
+			}
+			key := signingKey.AuditKey()
+
+			// Older versions hashed the log without a key
+			appendAuditEvents(t, repo, nil, 2)
+			if err = KeyAuditLog(repo, &signingKey); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := repo.GetSigningKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !signingKey.AuditLogKeyed || !stored.AuditLogKeyed {
+				t.Fatal("the keyed audit log is not marked")
+			}
+			if err = KeyAuditLog(repo, &stored); err != nil {
+				t.Fatalf("the keyed log is invalid: %v", err)
+			}
+
+			// Someone with access to the storage replaces the log with an unkeyed chain
+			if err = repo.RekeyAuditLog(key, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = KeyAuditLog(repo, &stored); !errors.Is(err, common.ErrAuditLogInvalid) {
+				t.Errorf("expected %v, got %v", common.ErrAuditLogInvalid, err)
+			}
+
+			events, _, err := repo.GetAuditEvents(0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if models.AuditEvents(events).Verify(key, nil) || !models.AuditEvents(events).Verify(nil, nil) {
+				t.Error("the forged log has been hashed with the key")
+			}
+		})
+	}
+}
+
+func TestKeyAuditLogMarksBrokenLogs(t *testing.T) {
+	repo := NewMemory()
+	signingKey := models.SigningKey{PrivateKey: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))}
+
+	appendAuditEvents(t, repo, []byte("unknown key"), 1)
+
+	// A broken log is kept as evidence, but it is not accepted as unkeyed on the next start either
+	if err := KeyAuditLog(repo, &signingKey); !errors.Is(err, common.ErrAuditLogInvalid) {
+		t.Errorf("expected %v, got %v", common.ErrAuditLogInvalid, err)
+	}
+
+	stored, err := repo.GetSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.AuditLogKeyed {
+		t.Error("the audit log is not marked as keyed")
+	}
+}
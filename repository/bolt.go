@@ -0,0 +1,458 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	dataBucket         = []byte("data")
+	auditLogBucket     = []byte("audit_log")
+	transactionsBucket = []byte("transactions")
+	scheduledBucket    = []byte("scheduled_transactions")
+)
+
+// Bolt stores all data in an embedded bbolt database. Every write is a single fsynced transaction.
+type Bolt struct {
+	db *bolt.DB
+	kp KeyProvider
+}
+
+// NewBolt opens the database below rootPath.
+// If kp is not nil, all values are encrypted and existing plaintext values are encrypted once.
+func NewBolt(rootPath string, kp KeyProvider) (*Bolt, error) {
+	path := fmt.Sprintf("%s/enclave.db", rootPath)
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dataBucket, auditLogBucket, transactionsBucket, scheduledBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+
+	b := &Bolt{
+		db: db,
+		kp: kp,
+	}
+
+	if kp != nil {
+		err = b.encryptPlaintextValues()
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to encrypt existing values: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *Bolt) GetUser() (models.User, error) {
+	var user models.User
+	err := b.loadData(documentUser, &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to get user data: %w", err)
+	}
+
+	return user, nil
+}
+
+func (b *Bolt) UpsertUser(user models.User) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dataBucket)
+
+		var current models.User
+		err := b.getData(bucket, documentUser, &current)
+		if err != nil && !errors.Is(err, common.ErrNotFound) {
+			return err
+		}
+
+		if current.Version != user.Version {
+			return common.ErrConflict
+		}
+		user.Version++
+
+		return b.putData(bucket, documentUser, &user)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update user data: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) SaveSigningKey(signingKey models.SigningKey) error {
+	err := b.saveData(documentSigningKey, &signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to save signing key: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) GetSigningKey() (models.SigningKey, error) {
+	var signingKey models.SigningKey
+	err := b.loadData(documentSigningKey, &signingKey)
+	if err != nil {
+		return models.SigningKey{}, fmt.Errorf("failed to get signing key: %w", err)
+	}
+
+	return signingKey, nil
+}
+
+// AppendAuditEvent stores every event under its big endian sequence number, so the bucket is ordered by sequence
+func (b *Bolt) AppendAuditEvent(event models.AuditEvent, key []byte) (models.AuditEvent, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditLogBucket)
+
+		var previous *models.AuditEvent
+		if k, v := bucket.Cursor().Last(); k != nil {
+			var last models.AuditEvent
+			if err := b.decodeValue(string(auditLogBucket), v, &last); err != nil {
+				return err
+			}
+			previous = &last
+		}
+
+		event = chainAuditEvent(event, previous, key)
+
+		encoded, err := encodeDocument(documentAuditEvent, &event)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := seal(b.kp, string(auditLogBucket), encoded)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt audit event: %w", err)
+		}
+
+		return bucket.Put(sequenceKey(event.Sequence), sealed)
+	})
+	if err != nil {
+		return models.AuditEvent{}, fmt.Errorf("failed to append audit event: %w", err)
+	}
+
+	return event, nil
+}
+
+// RekeyAuditLog replaces all events within a single transaction
+func (b *Bolt) RekeyAuditLog(previousKey, key []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditLogBucket)
+
+		events := make([]models.AuditEvent, 0)
+		err := bucket.ForEach(func(_, v []byte) error {
+			var event models.AuditEvent
+			if err := b.decodeValue(string(auditLogBucket), v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read audit log: %w", err)
+		}
+
+		rekeyed, err := rekeyAuditEvents(events, previousKey, key)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range rekeyed {
+			encoded, err := encodeDocument(documentAuditEvent, &event)
+			if err != nil {
+				return err
+			}
+
+			sealed, err := seal(b.kp, string(auditLogBucket), encoded)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt audit event: %w", err)
+			}
+
+			if err := bucket.Put(sequenceKey(event.Sequence), sealed); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *Bolt) GetAuditEvents(offset, limit int) ([]models.AuditEvent, int, error) {
+	events := make([]models.AuditEvent, 0)
+	var total int
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditLogBucket)
+		total = bucket.Stats().KeyN
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(sequenceKey(uint64(offset) + 1)); k != nil && len(events) < limit; k, v = c.Next() {
+			var event models.AuditEvent
+			if err := b.decodeValue(string(auditLogBucket), v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get audit events: %w", err)
+	}
+
+	return events, total, nil
+}
+
+// SaveTransaction stores every transaction under its lower case hash
+func (b *Bolt) SaveTransaction(t models.TransactionRecord) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		encoded, err := encodeDocument(documentTransaction, &t)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := seal(b.kp, string(transactionsBucket), encoded)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt transaction: %w", err)
+		}
+
+		return tx.Bucket(transactionsBucket).Put([]byte(transactionKey(t.Hash)), sealed)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) GetTransaction(hash string) (models.TransactionRecord, error) {
+	var t models.TransactionRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(transactionsBucket).Get([]byte(transactionKey(hash)))
+		if data == nil {
+			return common.ErrNotFound
+		}
+
+		return b.decodeValue(string(transactionsBucket), data, &t)
+	})
+	if err != nil {
+		return models.TransactionRecord{}, fmt.Errorf("failed to get transaction: %w", err)
+	}
+
+	return t, nil
+}
+
+func (b *Bolt) GetTransactions(wallet string, offset, limit int) ([]models.TransactionRecord, int, error) {
+	transactions, err := b.loadTransactions()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get transactions: %w", err)
+	}
+
+	filtered := filterTransactions(transactions, wallet)
+	return paginate(filtered, offset, limit), len(filtered), nil
+}
+
+func (b *Bolt) GetUnsettledTransactions() ([]models.TransactionRecord, error) {
+	transactions, err := b.loadTransactions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+
+	return unsettledTransactions(transactions), nil
+}
+
+func (b *Bolt) loadTransactions() ([]models.TransactionRecord, error) {
+	transactions := make([]models.TransactionRecord, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(transactionsBucket).ForEach(func(_, v []byte) error {
+			var t models.TransactionRecord
+			if err := b.decodeValue(string(transactionsBucket), v, &t); err != nil {
+				return err
+			}
+			transactions = append(transactions, t)
+			return nil
+		})
+	})
+
+	return transactions, err
+}
+
+// SaveScheduledTransaction stores every scheduled transaction under its id
+func (b *Bolt) SaveScheduledTransaction(t models.ScheduledTransaction) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		encoded, err := encodeDocument(documentScheduledTransaction, &t)
+		if err != nil {
+			return err
+		}
+
+		sealed, err := seal(b.kp, string(scheduledBucket), encoded)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt scheduled transaction: %w", err)
+		}
+
+		return tx.Bucket(scheduledBucket).Put([]byte(t.ID), sealed)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bolt) GetScheduledTransaction(id string) (models.ScheduledTransaction, error) {
+	var t models.ScheduledTransaction
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(scheduledBucket).Get([]byte(id))
+		if data == nil {
+			return common.ErrNotFound
+		}
+
+		return b.decodeValue(string(scheduledBucket), data, &t)
+	})
+	if err != nil {
+		return models.ScheduledTransaction{}, fmt.Errorf("failed to get scheduled transaction: %w", err)
+	}
+
+	return t, nil
+}
+
+func (b *Bolt) GetScheduledTransactions() ([]models.ScheduledTransaction, error) {
+	scheduled := make([]models.ScheduledTransaction, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).ForEach(func(_, v []byte) error {
+			var t models.ScheduledTransaction
+			if err := b.decodeValue(string(scheduledBucket), v, &t); err != nil {
+				return err
+			}
+			scheduled = append(scheduled, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scheduled transactions: %w", err)
+	}
+
+	return sortScheduledTransactions(scheduled), nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) loadData(key string, output any) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return b.getData(tx.Bucket(dataBucket), key, output)
+	})
+}
+
+func (b *Bolt) getData(bucket *bolt.Bucket, key string, output any) error {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return common.ErrNotFound
+	}
+
+	return b.decodeValue(key, data, output)
+}
+
+// decodeValue decrypts and decodes a value. name is the associated data used for the encryption.
+func (b *Bolt) decodeValue(name string, data []byte, output any) error {
+	data, err := unseal(b.kp, name, data)
+	if err != nil {
+		return err
+	}
+
+	kind := name
+	switch name {
+	case string(auditLogBucket):
+		kind = documentAuditEvent
+	case string(transactionsBucket):
+		kind = documentTransaction
+	case string(scheduledBucket):
+		kind = documentScheduledTransaction
+	}
+
+	return decodeDocument(kind, data, output)
+}
+
+func (b *Bolt) saveData(key string, data any) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.putData(tx.Bucket(dataBucket), key, data)
+	})
+}
+
+func (b *Bolt) putData(bucket *bolt.Bucket, key string, data any) error {
+	encoded, err := encodeDocument(key, data)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := seal(b.kp, key, encoded)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", key, err)
+	}
+
+	return bucket.Put([]byte(key), sealed)
+}
+
+// encryptPlaintextValues encrypts all values that were written before encryption was enabled
+func (b *Bolt) encryptPlaintextValues() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{dataBucket, auditLogBucket, transactionsBucket, scheduledBucket} {
+			bucket := tx.Bucket(name)
+
+			sealedValues := make(map[string][]byte)
+			err := bucket.ForEach(func(k, v []byte) error {
+				if isSealed(v) {
+					return nil
+				}
+
+				// Audit events and transactions share the name of their bucket as associated data
+				associatedData := string(k)
+				if !bytes.Equal(name, dataBucket) {
+					associatedData = string(name)
+				}
+
+				sealed, err := seal(b.kp, associatedData, v)
+				if err != nil {
+					return fmt.Errorf("failed to encrypt %s: %w", k, err)
+				}
+				sealedValues[string(k)] = sealed
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for k, v := range sealedValues {
+				if err := bucket.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+func sequenceKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
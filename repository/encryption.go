@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envelopeAlgorithm = "AES-256-GCM"
+
+var (
+	ErrMissingKeyProvider = errors.New("data is encrypted but no key encryption key is configured")
+	ErrNotEncrypted       = errors.New("data is not encrypted although a key encryption key is configured")
+)
+
+// KeyProvider wraps and unwraps the data keys used to encrypt persisted documents.
+// Implementations backed by sealed storage (e.g. a TPM or KMS) never need to expose the key encryption key itself.
+type KeyProvider interface {
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// StaticKeyProvider wraps data keys with a key encryption key held in memory
+type StaticKeyProvider struct {
+	aead cipher.AEAD
+}
+
+func NewStaticKeyProvider(kek []byte) (*StaticKeyProvider, error) {
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encryption key: %w", err)
+	}
+
+	return &StaticKeyProvider{
+		aead: aead,
+	}, nil
+}
+
+// NewStaticKeyProviderFromBase64 expects a base64 encoded 32 byte key
+func NewStaticKeyProviderFromBase64(encodedKEK string) (*StaticKeyProvider, error) {
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKEK))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key encryption key: %w", err)
+	}
+
+	return NewStaticKeyProvider(kek)
+}
+
+// NewStaticKeyProviderFromFile expects a file containing a base64 encoded 32 byte key
+func NewStaticKeyProviderFromFile(path string) (*StaticKeyProvider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key encryption key file: %w", err)
+	}
+
+	return NewStaticKeyProviderFromBase64(string(content))
+}
+
+func (s *StaticKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return sealAEAD(s.aead, dataKey, nil)
+}
+
+func (s *StaticKeyProvider) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	return openAEAD(s.aead, wrappedKey, nil)
+}
+
+type envelope struct {
+	Algorithm  string `json:"algorithm"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// seal encrypts plaintext with a fresh data key which is wrapped by kp. The name of the document is bound as
+// associated data, so an encrypted document can't be swapped for another one.
+// If kp is nil the plaintext is returned unchanged.
+func seal(kp KeyProvider, name string, plaintext []byte) ([]byte, error) {
+	if kp == nil {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := sealAEAD(aead, plaintext, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := kp.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(envelope{
+		Algorithm:  envelopeAlgorithm,
+		WrappedKey: wrappedKey,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// unseal reverses seal. If kp is nil the data is returned unchanged.
+// Plaintext data is rejected if kp is set, because the repositories encrypt existing plaintext documents when they are opened,
+// so plaintext found later has been put in place of an encrypted document.
+func unseal(kp KeyProvider, name string, data []byte) ([]byte, error) {
+	env, ok := parseEnvelope(data)
+	if !ok {
+		if kp != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", name, ErrNotEncrypted)
+		}
+		return data, nil
+	}
+	if kp == nil {
+		return nil, ErrMissingKeyProvider
+	}
+
+	dataKey, err := kp.UnwrapKey(env.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openAEAD(aead, env.Ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+
+	return plaintext, nil
+}
+
+func isSealed(data []byte) bool {
+	_, ok := parseEnvelope(data)
+	return ok
+}
+
+func parseEnvelope(data []byte) (envelope, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var env envelope
+	if err := decoder.Decode(&env); err != nil {
+		return envelope{}, false
+	}
+
+	return env, env.Algorithm == envelopeAlgorithm
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes long, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealAEAD prepends the random nonce to the ciphertext
+func sealAEAD(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAEAD(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Number of last-known-good versions that are kept next to every file
+const snapshotCount = 3
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it to path afterwards.
+// A crash during the write therefore leaves either the old or the new file behind, but never a partial one.
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf(".%s-*.tmp", filepath.Base(path)))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(0600); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// appendFile appends data to path and syncs the file before returning
+func appendFile(path string, data []byte) error {
+	_, statErr := os.Stat(path)
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if os.IsNotExist(statErr) {
+		return syncDir(filepath.Dir(path))
+	}
+
+	return nil
+}
+
+// syncDir makes a rename within dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// rotateSnapshots shifts the existing snapshots of path by one and stores the current file as the newest snapshot.
+// The current file is only kept if it is valid json, so a corrupt file never replaces a good snapshot.
+func rotateSnapshots(path string) error {
+	current, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !json.Valid(current) {
+		return nil
+	}
+
+	for i := snapshotCount - 1; i > 0; i-- {
+		err := os.Rename(snapshotPath(path, i), snapshotPath(path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeFileAtomic(snapshotPath(path, 1), current)
+}
+
+func snapshotPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
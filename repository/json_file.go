@@ -1,31 +1,72 @@
 package repository
 
 import (
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
 	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/rs/zerolog/log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sync"
 )
 
+const (
+	userDataFile   = "user_data.json"
+	signingKeyFile = "signing_key.json"
+	auditLogFile   = "audit_log.jsonl"
+	// Every line is one transaction. The file is always replaced atomically.
+	transactionsFile = "transactions.jsonl"
+	// Every line is one scheduled transaction. The file is always replaced atomically.
+	scheduledTransactionsFile = "scheduled_transactions.jsonl"
+)
+
+var documentKinds = map[string]string{
+	userDataFile:   documentUser,
+	signingKeyFile: documentSigningKey,
+}
+
 type JsonFile struct {
 	rootPath string
+	kp       KeyProvider
 	mu       sync.Mutex
+	userMu   sync.Mutex // Serializes the version check and write of UpsertUser
+	auditMu  sync.Mutex
+	txMu     sync.Mutex
+	jobMu    sync.Mutex
+	// Cached last event of the audit log, loaded on first use
+	lastAuditEvent *models.AuditEvent
+	auditLoaded    bool
 }
 
-func NewJsonFile() *JsonFile {
-	return &JsonFile{
-		rootPath: "/data",
+// NewJsonFile creates a repository storing every document in its own file below rootPath.
+// If kp is not nil, all files are encrypted and existing plaintext files are encrypted once.
+func NewJsonFile(rootPath string, kp KeyProvider) (*JsonFile, error) {
+	j := &JsonFile{
+		rootPath: rootPath,
+		kp:       kp,
 		mu:       sync.Mutex{},
+		userMu:   sync.Mutex{},
+		auditMu:  sync.Mutex{},
+		txMu:     sync.Mutex{},
+		jobMu:    sync.Mutex{},
+	}
+
+	if kp != nil {
+		err := j.encryptPlaintextFiles()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt existing files: %w", err)
+		}
 	}
+
+	return j, nil
 }
 
 func (j *JsonFile) GetUser() (models.User, error) {
-	path := fmt.Sprintf("%s/user_data.json", j.rootPath)
-
 	var user models.User
-	err := j.loadData(path, &user)
+	err := j.loadData(userDataFile, &user)
 	if err != nil {
 		return models.User{}, fmt.Errorf("failed to get user data: %w", err)
 	}
@@ -34,9 +75,21 @@ func (j *JsonFile) GetUser() (models.User, error) {
 }
 
 func (j *JsonFile) UpsertUser(user models.User) error {
-	path := fmt.Sprintf("%s/user_data.json", j.rootPath)
+	j.userMu.Lock()
+	defer j.userMu.Unlock()
+
+	var current models.User
+	err := j.loadData(userDataFile, &current)
+	if err != nil && !errors.Is(err, common.ErrNotFound) {
+		return fmt.Errorf("failed to get user data: %w", err)
+	}
+
+	if current.Version != user.Version {
+		return common.ErrConflict
+	}
+	user.Version++
 
-	err := j.saveData(path, &user)
+	err = j.saveData(userDataFile, &user)
 	if err != nil {
 		return fmt.Errorf("failed to update user data: %w", err)
 	}
@@ -45,9 +98,7 @@ func (j *JsonFile) UpsertUser(user models.User) error {
 }
 
 func (j *JsonFile) SaveSigningKey(signingKey models.SigningKey) error {
-	path := fmt.Sprintf("%s/signing_key.json", j.rootPath)
-
-	err := j.saveData(path, &signingKey)
+	err := j.saveData(signingKeyFile, &signingKey)
 	if err != nil {
 		return fmt.Errorf("failed to save signing key: %w", err)
 	}
@@ -56,10 +107,8 @@ func (j *JsonFile) SaveSigningKey(signingKey models.SigningKey) error {
 }
 
 func (j *JsonFile) GetSigningKey() (models.SigningKey, error) {
-	path := fmt.Sprintf("%s/signing_key.json", j.rootPath)
-
 	var signingKey models.SigningKey
-	err := j.loadData(path, &signingKey)
+	err := j.loadData(signingKeyFile, &signingKey)
 	if err != nil {
 		return models.SigningKey{}, fmt.Errorf("failed to get signing key: %w", err)
 	}
@@ -67,38 +116,468 @@ func (j *JsonFile) GetSigningKey() (models.SigningKey, error) {
 	return signingKey, nil
 }
 
-func (j *JsonFile) loadData(path string, output any) error {
+// AppendAuditEvent appends one line per event to the audit log file
+func (j *JsonFile) AppendAuditEvent(event models.AuditEvent, key []byte) (models.AuditEvent, error) {
+	j.auditMu.Lock()
+	defer j.auditMu.Unlock()
+
+	if !j.auditLoaded {
+		events, err := j.readAuditLog()
+		if err != nil {
+			return models.AuditEvent{}, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if len(events) > 0 {
+			j.lastAuditEvent = &events[len(events)-1]
+		}
+		j.auditLoaded = true
+	}
+
+	event = chainAuditEvent(event, j.lastAuditEvent, key)
+
+	encoded, err := encodeDocument(documentAuditEvent, &event)
+	if err != nil {
+		return models.AuditEvent{}, err
+	}
+
+	sealed, err := seal(j.kp, auditLogFile, encoded)
+	if err != nil {
+		return models.AuditEvent{}, fmt.Errorf("failed to encrypt audit event: %w", err)
+	}
+
+	err = appendFile(j.path(auditLogFile), sealed)
+	if err != nil {
+		return models.AuditEvent{}, fmt.Errorf("failed to append audit event: %w", err)
+	}
+
+	j.lastAuditEvent = &event
+	return event, nil
+}
+
+// RekeyAuditLog replaces the audit log file atomically
+func (j *JsonFile) RekeyAuditLog(previousKey, key []byte) error {
+	j.auditMu.Lock()
+	defer j.auditMu.Unlock()
+
+	events, err := j.readAuditLog()
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	rekeyed, err := rekeyAuditEvents(events, previousKey, key)
+	if err != nil || rekeyed == nil {
+		return err
+	}
+
+	err = writeDocumentLines(j, auditLogFile, documentAuditEvent, rekeyed)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	// The cached last event is loaded again on the next append
+	j.lastAuditEvent = nil
+	j.auditLoaded = false
+
+	return nil
+}
+
+func (j *JsonFile) GetAuditEvents(offset, limit int) ([]models.AuditEvent, int, error) {
+	j.auditMu.Lock()
+	defer j.auditMu.Unlock()
+
+	events, err := j.readAuditLog()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return paginate(events, offset, limit), len(events), nil
+}
+
+// readAuditLog decodes all complete lines of the audit log.
+// A partial last line left behind by a crash during an append is removed.
+func (j *JsonFile) readAuditLog() ([]models.AuditEvent, error) {
+	path := j.path(auditLogFile)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make([]models.AuditEvent, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		log.Warn().Caller().Msgf("removing partial last line of %s", path)
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return nil, err
+		}
+	}
+
+	events := make([]models.AuditEvent, 0)
+	for _, line := range bytes.SplitAfter(data[:complete], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		line, err = unseal(j.kp, auditLogFile, line)
+		if err != nil {
+			return nil, err
+		}
+
+		var event models.AuditEvent
+		if err := decodeDocument(documentAuditEvent, line, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+func (j *JsonFile) SaveTransaction(t models.TransactionRecord) error {
+	j.txMu.Lock()
+	defer j.txMu.Unlock()
+
+	transactions, err := j.readTransactions()
+	if err != nil {
+		return fmt.Errorf("failed to read transactions: %w", err)
+	}
+
+	key := transactionKey(t.Hash)
+	replaced := false
+	for i := range transactions {
+		if transactionKey(transactions[i].Hash) == key {
+			transactions[i] = t
+			replaced = true
+		}
+	}
+	if !replaced {
+		transactions = append(transactions, t)
+	}
+
+	err = writeDocumentLines(j, transactionsFile, documentTransaction, transactions)
+	if err != nil {
+		return fmt.Errorf("failed to save transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (j *JsonFile) GetTransaction(hash string) (models.TransactionRecord, error) {
+	j.txMu.Lock()
+	defer j.txMu.Unlock()
+
+	transactions, err := j.readTransactions()
+	if err != nil {
+		return models.TransactionRecord{}, fmt.Errorf("failed to read transactions: %w", err)
+	}
+
+	key := transactionKey(hash)
+	for _, t := range transactions {
+		if transactionKey(t.Hash) == key {
+			return t, nil
+		}
+	}
+
+	return models.TransactionRecord{}, fmt.Errorf("failed to get transaction: %w", common.ErrNotFound)
+}
+
+func (j *JsonFile) GetTransactions(wallet string, offset, limit int) ([]models.TransactionRecord, int, error) {
+	j.txMu.Lock()
+	defer j.txMu.Unlock()
+
+	transactions, err := j.readTransactions()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read transactions: %w", err)
+	}
+
+	filtered := filterTransactions(transactions, wallet)
+	return paginate(filtered, offset, limit), len(filtered), nil
+}
+
+func (j *JsonFile) GetUnsettledTransactions() ([]models.TransactionRecord, error) {
+	j.txMu.Lock()
+	defer j.txMu.Unlock()
+
+	transactions, err := j.readTransactions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transactions: %w", err)
+	}
+
+	return unsettledTransactions(transactions), nil
+}
+
+func (j *JsonFile) readTransactions() ([]models.TransactionRecord, error) {
+	return readDocumentLines[models.TransactionRecord](j, transactionsFile, documentTransaction)
+}
+
+func (j *JsonFile) SaveScheduledTransaction(t models.ScheduledTransaction) error {
+	j.jobMu.Lock()
+	defer j.jobMu.Unlock()
+
+	scheduled, err := readDocumentLines[models.ScheduledTransaction](j, scheduledTransactionsFile, documentScheduledTransaction)
+	if err != nil {
+		return fmt.Errorf("failed to read scheduled transactions: %w", err)
+	}
+
+	replaced := false
+	for i := range scheduled {
+		if scheduled[i].ID == t.ID {
+			scheduled[i] = t
+			replaced = true
+		}
+	}
+	if !replaced {
+		scheduled = append(scheduled, t)
+	}
+
+	err = writeDocumentLines(j, scheduledTransactionsFile, documentScheduledTransaction, scheduled)
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (j *JsonFile) GetScheduledTransaction(id string) (models.ScheduledTransaction, error) {
+	j.jobMu.Lock()
+	defer j.jobMu.Unlock()
+
+	scheduled, err := readDocumentLines[models.ScheduledTransaction](j, scheduledTransactionsFile, documentScheduledTransaction)
+	if err != nil {
+		return models.ScheduledTransaction{}, fmt.Errorf("failed to read scheduled transactions: %w", err)
+	}
+
+	for _, t := range scheduled {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+
+	return models.ScheduledTransaction{}, fmt.Errorf("failed to get scheduled transaction: %w", common.ErrNotFound)
+}
+
+func (j *JsonFile) GetScheduledTransactions() ([]models.ScheduledTransaction, error) {
+	j.jobMu.Lock()
+	defer j.jobMu.Unlock()
+
+	scheduled, err := readDocumentLines[models.ScheduledTransaction](j, scheduledTransactionsFile, documentScheduledTransaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled transactions: %w", err)
+	}
+
+	return sortScheduledTransactions(scheduled), nil
+}
+
+// readDocumentLines decodes a file that stores one document of kind per line
+func readDocumentLines[T any](j *JsonFile, name, kind string) ([]T, error) {
+	data, err := os.ReadFile(j.path(name))
+	if os.IsNotExist(err) {
+		return make([]T, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	documents := make([]T, 0)
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		line, err = unseal(j.kp, name, line)
+		if err != nil {
+			return nil, err
+		}
+
+		var document T
+		if err := decodeDocument(kind, line, &document); err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+
+	return documents, nil
+}
+
+// writeDocumentLines atomically replaces a file that stores one document of kind per line
+func writeDocumentLines[T any](j *JsonFile, name, kind string, documents []T) error {
+	var buf bytes.Buffer
+	for i := range documents {
+		encoded, err := encodeDocument(kind, &documents[i])
+		if err != nil {
+			return err
+		}
+
+		sealed, err := seal(j.kp, name, encoded)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", kind, err)
+		}
+		buf.Write(sealed)
+	}
+
+	return writeFileAtomic(j.path(name), buf.Bytes())
+}
+
+func (j *JsonFile) Close() error {
+	return nil
+}
+
+// loadData decodes the file called name. If the file is corrupt, the newest snapshot that can be decoded is used instead.
+func (j *JsonFile) loadData(name string, output any) error {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
-	file, err := os.Open(path)
+	path := j.path(name)
+	err := j.decodeFile(path, name, output)
 	if os.IsNotExist(err) {
 		return common.ErrNotFound
 	}
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrSchemaTooNew) {
+		// Falling back to an older snapshot would silently discard the newer data
+		return err
+	}
+
+	// The failed decode might have filled output partially, so every snapshot is decoded into a zero value of its own
+	target := reflect.ValueOf(output).Elem()
+	for i := 1; i <= snapshotCount; i++ {
+		snapshotPath := snapshotPath(path, i)
+		snapshot := reflect.New(target.Type())
+		if snapshotErr := j.decodeFile(snapshotPath, name, snapshot.Interface()); snapshotErr == nil {
+			log.Warn().Caller().Err(err).Msgf("failed to decode %s, using snapshot %s instead", path, snapshotPath)
+			target.Set(snapshot.Elem())
+			return nil
+		}
+	}
+
+	return err
+}
+
+// saveData atomically replaces the file called name. The previous version is kept as a snapshot.
+func (j *JsonFile) saveData(name string, data any) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	encoded, err := encodeDocument(documentKinds[name], data)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = file.Close()
-	}()
 
-	decoder := json.NewDecoder(file)
-	decoder.DisallowUnknownFields()
+	sealed, err := seal(j.kp, name, encoded)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", name, err)
+	}
+
+	path := j.path(name)
+	if err := rotateSnapshots(path); err != nil {
+		return fmt.Errorf("failed to rotate snapshots: %w", err)
+	}
 
-	return decoder.Decode(output)
+	return writeFileAtomic(path, sealed)
 }
 
-func (j *JsonFile) saveData(path string, data any) error {
+func (j *JsonFile) decodeFile(path, name string, output any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	data, err = unseal(j.kp, name, data)
+	if err != nil {
+		return err
+	}
+
+	return decodeDocument(documentKinds[name], data, output)
+}
+
+// encryptPlaintextFiles encrypts all files and snapshots that were written before encryption was enabled
+func (j *JsonFile) encryptPlaintextFiles() error {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	for _, name := range []string{userDataFile, signingKeyFile} {
+		paths := []string{j.path(name)}
+		for i := 1; i <= snapshotCount; i++ {
+			paths = append(paths, snapshotPath(j.path(name), i))
+		}
+
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if isSealed(data) {
+				continue
+			}
+
+			sealed, err := seal(j.kp, name, data)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", path, err)
+			}
+
+			err = writeFileAtomic(path, sealed)
+			if err != nil {
+				return err
+			}
+
+			log.Info().Caller().Msgf("encrypted plaintext file %s", path)
+		}
+	}
+
+	for _, name := range []string{auditLogFile, transactionsFile, scheduledTransactionsFile} {
+		if err := j.encryptPlaintextLines(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encryptPlaintextLines encrypts every line of a file that stores one document per line
+func (j *JsonFile) encryptPlaintextLines(name string) error {
+	path := j.path(name)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = file.Close()
-	}()
 
-	return json.NewEncoder(file).Encode(data)
+	var buf bytes.Buffer
+	changed := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			// Skips a partial last line left behind by a crash
+			continue
+		}
+
+		if !isSealed(line) {
+			line, err = seal(j.kp, name, line)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", path, err)
+			}
+			changed = true
+		}
+		buf.Write(line)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	log.Info().Caller().Msgf("encrypted plaintext file %s", path)
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+func (j *JsonFile) path(name string) string {
+	return filepath.Join(j.rootPath, name)
 }
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"golang.org/x/exp/maps"
+	"sync"
+)
+
+// Memory keeps all data in memory. Nothing survives a restart, so it is only suitable for tests and development.
+// Data is stored json encoded to prevent callers from sharing maps with the stored state.
+type Memory struct {
+	data     map[string][]byte
+	auditLog []models.AuditEvent
+	// Transactions by lower case hash, json encoded like data
+	transactions map[string][]byte
+	// Scheduled transactions by id, json encoded like data
+	scheduled map[string][]byte
+	mu        sync.Mutex
+	userMu    sync.Mutex // Serializes the version check and write of UpsertUser
+	auditMu   sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		data:         make(map[string][]byte),
+		auditLog:     make([]models.AuditEvent, 0),
+		transactions: make(map[string][]byte),
+		scheduled:    make(map[string][]byte),
+		mu:           sync.Mutex{},
+		userMu:       sync.Mutex{},
+		auditMu:      sync.Mutex{},
+	}
+}
+
+func (m *Memory) GetUser() (models.User, error) {
+	var user models.User
+	err := m.loadData("user", &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to get user data: %w", err)
+	}
+
+	return user, nil
+}
+
+func (m *Memory) UpsertUser(user models.User) error {
+	m.userMu.Lock()
+	defer m.userMu.Unlock()
+
+	var current models.User
+	err := m.loadData("user", &current)
+	if err != nil && !errors.Is(err, common.ErrNotFound) {
+		return fmt.Errorf("failed to get user data: %w", err)
+	}
+
+	if current.Version != user.Version {
+		return common.ErrConflict
+	}
+	user.Version++
+
+	err = m.saveData("user", &user)
+	if err != nil {
+		return fmt.Errorf("failed to update user data: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Memory) SaveSigningKey(signingKey models.SigningKey) error {
+	err := m.saveData("signing_key", &signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to save signing key: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Memory) GetSigningKey() (models.SigningKey, error) {
+	var signingKey models.SigningKey
+	err := m.loadData("signing_key", &signingKey)
+	if err != nil {
+		return models.SigningKey{}, fmt.Errorf("failed to get signing key: %w", err)
+	}
+
+	return signingKey, nil
+}
+
+func (m *Memory) AppendAuditEvent(event models.AuditEvent, key []byte) (models.AuditEvent, error) {
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+
+	var previous *models.AuditEvent
+	if len(m.auditLog) > 0 {
+		previous = &m.auditLog[len(m.auditLog)-1]
+	}
+
+	event.Details = maps.Clone(event.Details)
+	event = chainAuditEvent(event, previous, key)
+	m.auditLog = append(m.auditLog, event)
+
+	return event, nil
+}
+
+func (m *Memory) RekeyAuditLog(previousKey, key []byte) error {
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+
+	rekeyed, err := rekeyAuditEvents(m.auditLog, previousKey, key)
+	if err != nil {
+		return err
+	}
+	if rekeyed != nil {
+		m.auditLog = rekeyed
+	}
+
+	return nil
+}
+
+func (m *Memory) GetAuditEvents(offset, limit int) ([]models.AuditEvent, int, error) {
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+
+	page := paginate(m.auditLog, offset, limit)
+	events := make([]models.AuditEvent, len(page))
+	for i, event := range page {
+		event.Details = maps.Clone(event.Details)
+		events[i] = event
+	}
+
+	return events, len(m.auditLog), nil
+}
+
+func (m *Memory) SaveTransaction(t models.TransactionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	encoded, err := json.Marshal(&t)
+	if err != nil {
+		return fmt.Errorf("failed to save transaction: %w", err)
+	}
+
+	m.transactions[transactionKey(t.Hash)] = encoded
+	return nil
+}
+
+func (m *Memory) GetTransaction(hash string) (models.TransactionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.transactions[transactionKey(hash)]
+	if !ok {
+		return models.TransactionRecord{}, fmt.Errorf("failed to get transaction: %w", common.ErrNotFound)
+	}
+
+	var t models.TransactionRecord
+	if err := json.Unmarshal(data, &t); err != nil {
+		return models.TransactionRecord{}, fmt.Errorf("failed to get transaction: %w", err)
+	}
+
+	return t, nil
+}
+
+func (m *Memory) GetTransactions(wallet string, offset, limit int) ([]models.TransactionRecord, int, error) {
+	transactions, err := m.loadTransactions()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get transactions: %w", err)
+	}
+
+	filtered := filterTransactions(transactions, wallet)
+	return paginate(filtered, offset, limit), len(filtered), nil
+}
+
+func (m *Memory) GetUnsettledTransactions() ([]models.TransactionRecord, error) {
+	transactions, err := m.loadTransactions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+
+	return unsettledTransactions(transactions), nil
+}
+
+func (m *Memory) loadTransactions() ([]models.TransactionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transactions := make([]models.TransactionRecord, 0, len(m.transactions))
+	for _, data := range m.transactions {
+		var t models.TransactionRecord
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+
+	return transactions, nil
+}
+
+func (m *Memory) SaveScheduledTransaction(t models.ScheduledTransaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	encoded, err := json.Marshal(&t)
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled transaction: %w", err)
+	}
+
+	m.scheduled[t.ID] = encoded
+	return nil
+}
+
+func (m *Memory) GetScheduledTransaction(id string) (models.ScheduledTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.scheduled[id]
+	if !ok {
+		return models.ScheduledTransaction{}, fmt.Errorf("failed to get scheduled transaction: %w", common.ErrNotFound)
+	}
+
+	var t models.ScheduledTransaction
+	if err := json.Unmarshal(data, &t); err != nil {
+		return models.ScheduledTransaction{}, fmt.Errorf("failed to get scheduled transaction: %w", err)
+	}
+
+	return t, nil
+}
+
+func (m *Memory) GetScheduledTransactions() ([]models.ScheduledTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	scheduled := make([]models.ScheduledTransaction, 0, len(m.scheduled))
+	for _, data := range m.scheduled {
+		var t models.ScheduledTransaction
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, fmt.Errorf("failed to get scheduled transactions: %w", err)
+		}
+		scheduled = append(scheduled, t)
+	}
+
+	return sortScheduledTransactions(scheduled), nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) loadData(key string, output any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.data[key]
+	if !ok {
+		return common.ErrNotFound
+	}
+
+	return json.Unmarshal(data, output)
+}
+
+func (m *Memory) saveData(key string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.data[key] = encoded
+	return nil
+}
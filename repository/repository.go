@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/Leantar/elonwallet-function/config"
+	"github.com/Leantar/elonwallet-function/server/common"
+)
+
+const (
+	BackendJsonFile = "json"
+	BackendBolt     = "bolt"
+	BackendMemory   = "memory"
+
+	defaultDataPath = "/data"
+)
+
+// New creates the storage backend selected by cfg.StorageBackend. The json file backend is used if none is set.
+func New(cfg config.Config) (common.Repository, error) {
+	dataPath := cfg.DataPath
+	if dataPath == "" {
+		dataPath = defaultDataPath
+	}
+
+	kp, err := newKeyProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.StorageBackend {
+	case "", BackendJsonFile:
+		return NewJsonFile(dataPath, kp)
+	case BackendBolt:
+		return NewBolt(dataPath, kp)
+	case BackendMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+// newKeyProvider returns nil if encryption at rest is not configured
+func newKeyProvider(cfg config.Config) (KeyProvider, error) {
+	switch {
+	case cfg.EncryptionKey != "":
+		return NewStaticKeyProviderFromBase64(cfg.EncryptionKey)
+	case cfg.EncryptionKeyFile != "":
+		return NewStaticKeyProviderFromFile(cfg.EncryptionKeyFile)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,15 @@
+package repository
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"golang.org/x/exp/slices"
+)
+
+// sortScheduledTransactions orders scheduled transactions by their execution time, the earliest first
+func sortScheduledTransactions(scheduled []models.ScheduledTransaction) []models.ScheduledTransaction {
+	slices.SortStableFunc(scheduled, func(a, b models.ScheduledTransaction) bool {
+		return a.ExecuteAt < b.ExecuteAt
+	})
+
+	return scheduled
+}
@@ -0,0 +1,334 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+)
+
+const (
+	documentUser                 = "user"
+	documentSigningKey           = "signing_key"
+	documentAuditEvent           = "audit_event"
+	documentTransaction          = "transaction"
+	documentScheduledTransaction = "scheduled_transaction"
+)
+
+var ErrSchemaTooNew = errors.New("document was written by a newer version of the enclave")
+
+// migration upgrades a generic json document by exactly one schema version
+type migration func(doc map[string]any) error
+
+type schema struct {
+	// migrations[i] upgrades a document from version i+1 to version i+2.
+	// Documents written before schema versioning was introduced are version 1.
+	migrations []migration
+}
+
+func (s schema) version() int {
+	return len(s.migrations) + 1
+}
+
+// Every change to a persisted model must append a migration to its schema, even if it only adds a field.
+var schemas = map[string]schema{
+	documentUser: {
+		migrations: []migration{
+			// 1 -> 2: version counter for optimistic concurrency control
+			func(doc map[string]any) error {
+				setDefault(doc, "version", 0)
+				return nil
+			},
+			// 2 -> 3: HD seed, the existing wallets keep their independent keys
+			func(doc map[string]any) error {
+				setDefault(doc, "hd_seed", nil)
+				return nil
+			},
+			// 3 -> 4: pending wallet exports
+			func(doc map[string]any) error {
+				return setNestedDefault(doc, "webauthn_data", "pending_exports", map[string]any{})
+			},
+			// 4 -> 5: archived wallets
+			func(doc map[string]any) error {
+				return forEachObject(doc, "wallets", func(wallet map[string]any) {
+					setDefault(wallet, "archived", false)
+				})
+			},
+			// 5 -> 6: nonce reservations
+			func(doc map[string]any) error {
+				setDefault(doc, "nonce_reservations", []any{})
+				return nil
+			},
+			// 6 -> 7: user uploaded contract abis
+			func(doc map[string]any) error {
+				setDefault(doc, "contract_abis", map[string]any{})
+				return nil
+			},
+			// 7 -> 8: transaction policy and the amounts spent under it
+			func(doc map[string]any) error {
+				setDefault(doc, "policy", map[string]any{
+					"spend_limits":              []any{},
+					"allowlist":                 []any{},
+					"denylist":                  []any{},
+					"contract_rules":            []any{},
+					"only_allowed_contracts":    false,
+					"block_unlimited_approvals": false,
+				})
+				setDefault(doc, "spend_ledger", []any{})
+				return nil
+			},
+			// 8 -> 9: quorum rules and the approvals collected for them
+			func(doc map[string]any) error {
+				setDefault(doc, "pending_approvals", map[string]any{})
+				return setNestedDefault(doc, "policy", "quorum_rules", []any{})
+			},
+			// 9 -> 10: delay rules and scheduled transactions
+			func(doc map[string]any) error {
+				if err := setNestedDefault(doc, "policy", "delay_rules", []any{}); err != nil {
+					return err
+				}
+				if err := setNestedDefault(doc, "webauthn_data", "pending_schedules", map[string]any{}); err != nil {
+					return err
+				}
+
+				return forEachValue(doc, "pending_approvals", func(approval map[string]any) {
+					if transaction, ok := approval["transaction"].(map[string]any); ok {
+						setDefault(transaction, "execute_at", 0)
+					}
+				})
+			},
+			// 10 -> 11: recurring payments
+			func(doc map[string]any) error {
+				setDefault(doc, "recurring_payments", map[string]any{})
+				return setNestedDefault(doc, "webauthn_data", "pending_recurring", map[string]any{})
+			},
+			// 11 -> 12: trusted Sign-In with Ethereum domains
+			func(doc map[string]any) error {
+				return setNestedDefault(doc, "policy", "sign_in_domains", []any{})
+			},
+			// 12 -> 13: webauthn ceremonies for signing messages
+			func(doc map[string]any) error {
+				if err := setNestedDefault(doc, "policy", "signature_exemptions", []any{}); err != nil {
+					return err
+				}
+
+				return setNestedDefault(doc, "webauthn_data", "pending_signatures", map[string]any{})
+			},
+			// 13 -> 14: eth_sign and the versions of eth_signTypedData. Pending typed data has been v4.
+			func(doc map[string]any) error {
+				if err := setNestedDefault(doc, "policy", "allow_eth_sign", false); err != nil {
+					return err
+				}
+
+				webauthnData, ok := doc["webauthn_data"].(map[string]any)
+				if !ok {
+					return errors.New("webauthn_data is not an object")
+				}
+
+				return forEachValue(webauthnData, "pending_signatures", func(signature map[string]any) {
+					version := ""
+					if signature["type"] == "typed_data" {
+						version = "v4"
+					}
+					setDefault(signature, "version", version)
+				})
+			},
+		},
+	},
+	documentSigningKey: {
+		migrations: []migration{
+			// 1 -> 2: marker of the one time keying of the audit log
+			func(doc map[string]any) error {
+				setDefault(doc, "audit_log_keyed", false)
+				return nil
+			},
+		},
+	},
+	documentAuditEvent: {},
+	documentTransaction: {
+		migrations: []migration{
+			// 1 -> 2: fees of the signed transaction and replacements. The fees of older transactions are unknown.
+			func(doc map[string]any) error {
+				setDefault(doc, "type", "")
+				setDefault(doc, "gas", 0)
+				setDefault(doc, "gas_price", "")
+				setDefault(doc, "max_fee_per_gas", "")
+				setDefault(doc, "max_priority_fee_per_gas", "")
+				setDefault(doc, "replaces", "")
+				setDefault(doc, "replaced_by", "")
+				return nil
+			},
+		},
+	},
+	documentScheduledTransaction: {
+		migrations: []migration{
+			// 1 -> 2: runs of recurring payments
+			func(doc map[string]any) error {
+				setDefault(doc, "recurring", "")
+				return nil
+			},
+		},
+	},
+}
+
+type versionedDocument struct {
+	SchemaVersion int             `json:"schema_version"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// encodeDocument stamps data with the current schema version of kind
+func encodeDocument(kind string, data any) ([]byte, error) {
+	s, ok := schemas[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown document kind: %s", kind)
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(versionedDocument{
+		SchemaVersion: s.version(),
+		Data:          encoded,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeDocument upgrades data to the current schema version of kind and decodes it into output
+func decodeDocument(kind string, data []byte, output any) error {
+	s, ok := schemas[kind]
+	if !ok {
+		return fmt.Errorf("unknown document kind: %s", kind)
+	}
+
+	version, payload := parseDocument(data)
+	if version > s.version() {
+		return fmt.Errorf("%w: %s has schema version %d, supported is %d", ErrSchemaTooNew, kind, version, s.version())
+	}
+
+	if version < s.version() {
+		var err error
+		payload, err = migrate(s, version, payload)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s from schema version %d: %w", kind, version, err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(output)
+}
+
+// EncodeUser encodes user as a document of the current schema version, so it can be decoded by later versions of the enclave
+func EncodeUser(user models.User) ([]byte, error) {
+	return encodeDocument(documentUser, user)
+}
+
+// DecodeUser upgrades a user document of any known schema version and decodes it
+func DecodeUser(data []byte) (models.User, error) {
+	var user models.User
+	err := decodeDocument(documentUser, data, &user)
+	return user, err
+}
+
+// parseDocument returns the schema version and the payload of data.
+// Documents without a schema version are returned unchanged as version 1.
+func parseDocument(data []byte) (int, []byte) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var doc versionedDocument
+	if err := decoder.Decode(&doc); err != nil || doc.SchemaVersion == 0 || doc.Data == nil {
+		return 1, data
+	}
+
+	return doc.SchemaVersion, doc.Data
+}
+
+func migrate(s schema, version int, payload []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	// Prevents large integers like sign counts or timestamps from being converted to float64
+	decoder.UseNumber()
+
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	for v := version; v < s.version(); v++ {
+		if err := s.migrations[v-1](doc); err != nil {
+			return nil, fmt.Errorf("migration to schema version %d failed: %w", v+1, err)
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+func setDefault(doc map[string]any, key string, value any) {
+	if _, ok := doc[key]; !ok {
+		doc[key] = value
+	}
+}
+
+// forEachObject calls fn for every object in the array stored at key. A missing or null array is skipped.
+func forEachObject(doc map[string]any, key string, fn func(map[string]any)) error {
+	if doc[key] == nil {
+		return nil
+	}
+
+	elements, ok := doc[key].([]any)
+	if !ok {
+		return fmt.Errorf("%s is not an array", key)
+	}
+
+	for _, element := range elements {
+		object, ok := element.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s contains an element that is not an object", key)
+		}
+		fn(object)
+	}
+
+	return nil
+}
+
+// forEachValue calls fn for every object in the object stored at key. A missing or null object is skipped.
+func forEachValue(doc map[string]any, key string, fn func(map[string]any)) error {
+	if doc[key] == nil {
+		return nil
+	}
+
+	values, ok := doc[key].(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s is not an object", key)
+	}
+
+	for _, value := range values {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s contains a value that is not an object", key)
+		}
+		fn(object)
+	}
+
+	return nil
+}
+
+// setNestedDefault sets a default within the object stored at parent
+func setNestedDefault(doc map[string]any, parent, key string, value any) error {
+	nested, ok := doc[parent].(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s is not an object", parent)
+	}
+
+	setDefault(nested, key, value)
+	return nil
+}
@@ -0,0 +1,347 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"testing"
+)
+
+// userFixtureV1 is a user as it was stored before schema versioning was introduced
+const userFixtureV1 = `{
+	"webauthn_data": {"id": "id", "name": "user@example.com", "display_name": "User", "credentials": {}, "sessions": {}, "pending_transactions": {}},
+	"wallets": [{"name": "Main", "private_key_hex": "4af1bceebf7f3634ec3cff8a2c38e51178d5d4ce585c52d6043e5e2cc3418bb0", "address": "0x1111111111111111111111111111111111111111", "public": true}],
+	"email": "user@example.com",
+	"networks": [],
+	"emergency_access_contacts": {},
+	"emergency_access_grants": {}
+}`
+
+// userFixtureChanges adds the fields of every later schema version of the user, the first entry creates version 2.
+// The values differ from the defaults of the migrations, so they must be preserved by the migrations that follow.
+var userFixtureChanges = []func(doc map[string]any){
+	func(doc map[string]any) {
+		doc["version"] = 7
+	},
+	func(doc map[string]any) {
+		doc["hd_seed"] = map[string]any{"mnemonic": "test", "next_index": 2, "revealed": true}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "webauthn_data")["pending_exports"] = map[string]any{
+			"export": map[string]any{"address": "0x1111111111111111111111111111111111111111", "keystore": "{}"},
+		}
+	},
+	func(doc map[string]any) {
+		doc["wallets"].([]any)[0].(map[string]any)["archived"] = true
+	},
+	func(doc map[string]any) {
+		doc["nonce_reservations"] = []any{
+			map[string]any{"chain_id": "0x1", "address": "0x1111111111111111111111111111111111111111", "nonce": 3, "challenge": "challenge", "expires_at": 1},
+		}
+	},
+	func(doc map[string]any) {
+		doc["contract_abis"] = map[string]any{
+			"0x1:0x2222222222222222222222222222222222222222": map[string]any{"name": "Token", "chain_id": "0x1", "address": "0x2222222222222222222222222222222222222222", "abi": []any{}},
+		}
+	},
+	func(doc map[string]any) {
+		doc["policy"] = map[string]any{
+			"spend_limits":              []any{},
+			"allowlist":                 []any{},
+			"denylist":                  []any{"0x3333333333333333333333333333333333333333"},
+			"contract_rules":            []any{},
+			"only_allowed_contracts":    false,
+			"block_unlimited_approvals": true,
+		}
+		doc["spend_ledger"] = []any{}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "policy")["quorum_rules"] = []any{}
+		doc["pending_approvals"] = map[string]any{
+			"approval": map[string]any{
+				"id":          "approval",
+				"operation":   "transaction",
+				"subject":     "0x1111111111111111111111111111111111111111",
+				"required":    2,
+				"approvals":   []any{},
+				"created_at":  1,
+				"expires_at":  2,
+				"transaction": map[string]any{"action": "send", "params": map[string]any{}, "replaces": ""},
+			},
+		}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "policy")["delay_rules"] = []any{}
+		fixtureObject(doc, "webauthn_data")["pending_schedules"] = map[string]any{}
+		fixtureObject(fixtureObject(fixtureObject(doc, "pending_approvals"), "approval"), "transaction")["execute_at"] = 5
+	},
+	func(doc map[string]any) {
+		doc["recurring_payments"] = map[string]any{}
+		fixtureObject(doc, "webauthn_data")["pending_recurring"] = map[string]any{}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "policy")["sign_in_domains"] = []any{"example.com"}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "policy")["signature_exemptions"] = []any{}
+		fixtureObject(doc, "webauthn_data")["pending_signatures"] = map[string]any{
+			"typed":    map[string]any{"type": "typed_data", "from": "0x1111111111111111111111111111111111111111", "message": "", "typed_data": map[string]any{}, "origin": "https://example.com"},
+			"personal": map[string]any{"type": "personal_sign", "from": "0x1111111111111111111111111111111111111111", "message": "0x00", "typed_data": nil, "origin": "https://example.com"},
+		}
+	},
+	func(doc map[string]any) {
+		fixtureObject(doc, "policy")["allow_eth_sign"] = true
+		signatures := fixtureObject(fixtureObject(doc, "webauthn_data"), "pending_signatures")
+		fixtureObject(signatures, "typed")["version"] = "v3"
+		fixtureObject(signatures, "personal")["version"] = ""
+	},
+}
+
+func fixtureObject(doc map[string]any, key string) map[string]any {
+	return doc[key].(map[string]any)
+}
+
+// userFixture returns a user document of version as the enclave stored it at that version
+func userFixture(t *testing.T, version int) []byte {
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(userFixtureV1), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range userFixtureChanges[:version-1] {
+		change(doc)
+	}
+
+	return versionedFixture(t, version, doc)
+}
+
+// versionedFixture wraps data like encodeDocument did at version. Documents of version 1 have no schema version.
+func versionedFixture(t *testing.T, version int, data any) []byte {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == 1 {
+		return encoded
+	}
+
+	encoded, err = json.Marshal(versionedDocument{SchemaVersion: version, Data: encoded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func TestUserFixturesCoverSchema(t *testing.T) {
+	if got, want := len(userFixtureChanges)+1, schemas[documentUser].version(); got != want {
+		t.Fatalf("the user fixtures end at schema version %d, the schema is at %d", got, want)
+	}
+}
+
+func TestDecodeUserVersions(t *testing.T) {
+	for version := 1; version <= len(userFixtureChanges)+1; version++ {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			user, err := DecodeUser(userFixture(t, version))
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			if user.Email != "user@example.com" || user.WebauthnData.ID != "id" || len(user.Wallets) != 1 || !user.Wallets[0].Public {
+				t.Errorf("the fields of version 1 have changed: %+v", user)
+			}
+
+			// Fields added after the version of the document have their defaults
+			webauthnData := user.WebauthnData
+			if webauthnData.PendingExports == nil || webauthnData.PendingSchedules == nil || webauthnData.PendingRecurring == nil || webauthnData.PendingSignatures == nil {
+				t.Error("the ceremonies added later are missing")
+			}
+			if user.NonceReservations == nil || user.ContractABIs == nil || user.SpendLedger == nil || user.PendingApprovals == nil || user.RecurringPayments == nil {
+				t.Error("the fields added later are missing")
+			}
+			policy := user.Policy
+			if policy.SpendLimits == nil || policy.QuorumRules == nil || policy.DelayRules == nil || policy.SignInDomains == nil || policy.SignatureExemptions == nil {
+				t.Error("the policy fields added later are missing")
+			}
+
+			// Fields present in the document keep their values
+			checks := []struct {
+				since int
+				name  string
+				ok    bool
+			}{
+				{2, "version", user.Version == 7},
+				{3, "hd seed", user.HDSeed != nil && user.HDSeed.NextIndex == 2 && user.HDSeed.Revealed},
+				{4, "pending exports", len(webauthnData.PendingExports) == 1},
+				{5, "archived wallets", user.Wallets[0].Archived},
+				{6, "nonce reservations", len(user.NonceReservations) == 1 && user.NonceReservations[0].Nonce == 3},
+				{7, "contract abis", len(user.ContractABIs) == 1},
+				{8, "policy", policy.BlockUnlimitedApprovals && len(policy.Denylist) == 1},
+				{9, "pending approvals", user.PendingApprovals["approval"].Required == 2},
+				{10, "execution time of approvals", user.PendingApprovals["approval"].Transaction != nil && user.PendingApprovals["approval"].Transaction.ExecuteAt == 5},
+				{12, "sign in domains", len(policy.SignInDomains) == 1},
+				{13, "pending signatures", len(webauthnData.PendingSignatures) == 2},
+				{14, "eth_sign", policy.AllowEthSign},
+			}
+			for _, check := range checks {
+				if version >= check.since && !check.ok {
+					t.Errorf("the %s of version %d have changed", check.name, check.since)
+				}
+			}
+
+			// Pending typed data has been v4 before its version was stored
+			if version >= 13 {
+				typedVersion := "v3"
+				if version == 13 {
+					typedVersion = "v4"
+				}
+				if got := webauthnData.PendingSignatures["typed"].Version; got != typedVersion {
+					t.Errorf("expected typed data version %s, got %s", typedVersion, got)
+				}
+				if got := webauthnData.PendingSignatures["personal"].Version; got != "" {
+					t.Errorf("expected no version for personal_sign, got %s", got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeUserRejectsNewerVersions(t *testing.T) {
+	version := schemas[documentUser].version()
+
+	var doc map[string]any
+	if err := json.Unmarshal(userFixture(t, version), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := DecodeUser(versionedFixture(t, version+1, doc["data"]))
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected %v, got %v", ErrSchemaTooNew, err)
+	}
+}
+
+func TestDecodeTransactionVersions(t *testing.T) {
+	v1 := map[string]any{
+		"hash":                "0xabc",
+		"chain_id":            "0x1",
+		"from":                "0x1111111111111111111111111111111111111111",
+		"to":                  "0x2222222222222222222222222222222222222222",
+		"nonce":               4,
+		"params":              map[string]any{},
+		"credential":          "laptop",
+		"status":              "confirmed",
+		"sent_at":             1,
+		"updated_at":          2,
+		"block_number":        3,
+		"block_hash":          "0xdef",
+		"gas_used":            21000,
+		"effective_gas_price": "1",
+		"confirmations":       12,
+	}
+	v2 := make(map[string]any, len(v1))
+	for key, value := range v1 {
+		v2[key] = value
+	}
+	v2["type"] = "0x2"
+	v2["gas"] = 21000
+	v2["gas_price"] = ""
+	v2["max_fee_per_gas"] = "2"
+	v2["max_priority_fee_per_gas"] = "1"
+	v2["replaces"] = "0x123"
+	v2["replaced_by"] = ""
+
+	fixtures := []map[string]any{v1, v2}
+	if len(fixtures) != schemas[documentTransaction].version() {
+		t.Fatalf("expected a fixture of each of the %d schema versions", schemas[documentTransaction].version())
+	}
+
+	for i, fixture := range fixtures {
+		version := i + 1
+		var record models.TransactionRecord
+		if err := decodeDocument(documentTransaction, versionedFixture(t, version, fixture), &record); err != nil {
+			t.Fatalf("failed to decode version %d: %v", version, err)
+		}
+
+		if record.Hash != "0xabc" || record.Nonce != 4 || record.Confirmations != 12 || record.Credential != "laptop" {
+			t.Errorf("the fields of version 1 have changed: %+v", record)
+		}
+		if version >= 2 && (record.Type != "0x2" || record.Gas != 21000 || record.MaxFeePerGas != "2" || record.Replaces != "0x123") {
+			t.Errorf("the fields of version 2 have changed: %+v", record)
+		}
+		if version == 1 && (record.Type != "" || record.Gas != 0 || record.Replaces != "") {
+			t.Errorf("the fees of a version 1 transaction are not unknown: %+v", record)
+		}
+	}
+}
+
+func TestDecodeScheduledTransactionVersions(t *testing.T) {
+	v1 := map[string]any{
+		"id":              "id",
+		"kind":            "scheduled",
+		"params":          map[string]any{"from": "0x1111111111111111111111111111111111111111"},
+		"credential":      "laptop",
+		"status":          "scheduled",
+		"execute_at":      1,
+		"created_at":      2,
+		"updated_at":      3,
+		"attempts":        1,
+		"raw_transaction": "",
+		"hash":            "",
+		"error":           "",
+	}
+	v2 := make(map[string]any, len(v1))
+	for key, value := range v1 {
+		v2[key] = value
+	}
+	v2["kind"] = "recurring"
+	v2["recurring"] = "payment"
+
+	fixtures := []map[string]any{v1, v2}
+	if len(fixtures) != schemas[documentScheduledTransaction].version() {
+		t.Fatalf("expected a fixture of each of the %d schema versions", schemas[documentScheduledTransaction].version())
+	}
+
+	for i, fixture := range fixtures {
+		version := i + 1
+		var scheduled models.ScheduledTransaction
+		if err := decodeDocument(documentScheduledTransaction, versionedFixture(t, version, fixture), &scheduled); err != nil {
+			t.Fatalf("failed to decode version %d: %v", version, err)
+		}
+
+		if scheduled.ID != "id" || scheduled.Params.From == "" || scheduled.ExecuteAt != 1 || scheduled.Attempts != 1 {
+			t.Errorf("the fields of version 1 have changed: %+v", scheduled)
+		}
+		recurring, _ := fixture["recurring"].(string)
+		if scheduled.Recurring != recurring {
+			t.Errorf("expected recurring payment %q in version %d, got %q", recurring, version, scheduled.Recurring)
+		}
+	}
+}
+
+func TestDecodeUnversionedDocuments(t *testing.T) {
+	var key models.SigningKey
+	fixture := `{"private_key": "AQ==", "public_key": "Ag=="}`
+	if err := decodeDocument(documentSigningKey, []byte(fixture), &key); err != nil {
+		t.Fatal(err)
+	}
+	if len(key.PrivateKey) != 1 || len(key.PublicKey) != 1 || key.AuditLogKeyed {
+		t.Errorf("unexpected signing key %+v", key)
+	}
+
+	fixture = `{"private_key": "AQ==", "public_key": "Ag==", "audit_log_keyed": true}`
+	if err := decodeDocument(documentSigningKey, versionedFixture(t, 2, json.RawMessage(fixture)), &key); err != nil {
+		t.Fatal(err)
+	}
+	if !key.AuditLogKeyed {
+		t.Error("the keyed audit log is no longer marked")
+	}
+
+	var event models.AuditEvent
+	fixture = `{"sequence": 2, "timestamp": 1, "type": "login", "credential": "laptop", "details": {"origin": "example.com"}, "prev_hash": "a", "hash": "b"}`
+	if err := decodeDocument(documentAuditEvent, versionedFixture(t, 1, json.RawMessage(fixture)), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Sequence != 2 || event.Details["origin"] != "example.com" || event.PrevHash != "a" {
+		t.Errorf("unexpected audit event %+v", event)
+	}
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"golang.org/x/exp/slices"
+	"strings"
+)
+
+func transactionKey(hash string) string {
+	return strings.ToLower(hash)
+}
+
+// filterTransactions returns the transactions sent from wallet, newest first. All transactions are returned if wallet is empty.
+func filterTransactions(transactions []models.TransactionRecord, wallet string) []models.TransactionRecord {
+	filtered := make([]models.TransactionRecord, 0, len(transactions))
+	for _, t := range transactions {
+		if wallet == "" || strings.EqualFold(t.From, wallet) {
+			filtered = append(filtered, t)
+		}
+	}
+
+	slices.SortStableFunc(filtered, func(a, b models.TransactionRecord) bool {
+		if a.SentAt != b.SentAt {
+			return a.SentAt > b.SentAt
+		}
+		return a.Nonce > b.Nonce
+	})
+
+	return filtered
+}
+
+func unsettledTransactions(transactions []models.TransactionRecord) []models.TransactionRecord {
+	unsettled := make([]models.TransactionRecord, 0)
+	for _, t := range transactions {
+		if !t.Settled() {
+			unsettled = append(unsettled, t)
+		}
+	}
+
+	return unsettled
+}
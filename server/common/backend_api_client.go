@@ -66,6 +66,12 @@ func (b *BackendApiClient) PublishWalletFinalize(wallet models.Wallet, signature
 	return doPostRequestWithBearer(backendURL, p, nil, b.jwt)
 }
 
+func (b *BackendApiClient) UnpublishWallet(wallet models.Wallet) error {
+	backendURL := fmt.Sprintf("%s/users/my/wallets/%s", b.url, wallet.Address)
+
+	return doDeleteRequestWithBearer(backendURL, b.jwt)
+}
+
 func (b *BackendApiClient) GetEnclaveURL(email string) (string, error) {
 	escapedEmail := url.QueryEscape(email)
 	res, err := http.Get(fmt.Sprintf("%s/users/%s/enclave-url?questioner=enclave", b.url, escapedEmail))
@@ -41,3 +41,25 @@ func doPostRequestWithBearer(url string, payload any, out any, bearer string) er
 
 	return nil
 }
+
+func doDeleteRequestWithBearer(url string, bearer string) error {
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to instantiate request: %w", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", bearer))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("received error status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -16,6 +16,9 @@ const (
 	ScopeCreateCredential = "create-credential"
 )
 
+// Sensitive resources can only be accessed by sessions younger than this
+const StrictSessionMaxAge = 15 * time.Minute
+
 type BackendClaims struct {
 	Scope string `json:"scope"`
 	jwt.RegisteredClaims
@@ -86,3 +89,16 @@ func ValidateJWT(tokenString string, keyFunc jwt.Keyfunc) (EnclaveClaims, error)
 
 	return claims, nil
 }
+
+// IsRecentSession reports whether the session has been issued within StrictSessionMaxAge
+func IsRecentSession(claims EnclaveClaims) (bool, error) {
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return false, err
+	}
+	if iat == nil {
+		return false, errors.New("issued at is missing")
+	}
+
+	return time.Now().Before(iat.Add(StrictSessionMaxAge)), nil
+}
@@ -0,0 +1,13 @@
+package common
+
+import "fmt"
+
+// PolicyViolation is returned if the policy of the user rejects a transaction
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (p *PolicyViolation) Error() string {
+	return fmt.Sprintf("policy violation %s: %s", p.Rule, p.Message)
+}
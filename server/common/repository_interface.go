@@ -7,9 +7,41 @@ import (
 
 var (
 	ErrNotFound = errors.New("element does not exist")
+	ErrConflict = errors.New("element has been modified concurrently")
+	// ErrAuditLogInvalid is returned if the audit log can not be hashed again, because its chain is broken
+	ErrAuditLogInvalid = errors.New("audit log has been modified or is hashed with an unknown key")
 )
 
+// Repository is implemented by every storage backend.
+// Sessions, pending transactions, the OTP and the emergency access state are part of models.User
+// and are therefore persisted together with the user.
 type Repository interface {
 	GetUser() (models.User, error)
+	// UpsertUser only succeeds if u.Version matches the stored version and returns ErrConflict otherwise.
+	// The stored version is incremented on success.
 	UpsertUser(u models.User) error
+	GetSigningKey() (models.SigningKey, error)
+	SaveSigningKey(sk models.SigningKey) error
+	// AppendAuditEvent assigns the sequence number and the hashes keyed with key to e and appends it to the audit log
+	AppendAuditEvent(e models.AuditEvent, key []byte) (models.AuditEvent, error)
+	// RekeyAuditLog hashes all events again with key. The log must be a valid chain for previousKey and ErrAuditLogInvalid
+	// is returned otherwise. A nil previousKey stands for the unkeyed hashes of older versions. A log already hashed with
+	// key is left unchanged.
+	RekeyAuditLog(previousKey, key []byte) error
+	// GetAuditEvents returns up to limit events starting at offset, oldest first, and the total number of events
+	GetAuditEvents(offset, limit int) ([]models.AuditEvent, int, error)
+	// SaveTransaction inserts t or replaces the transaction with the same hash
+	SaveTransaction(t models.TransactionRecord) error
+	GetTransaction(hash string) (models.TransactionRecord, error)
+	// GetTransactions returns up to limit transactions sent from wallet starting at offset, newest first,
+	// and the total number of matching transactions. Transactions of all wallets are returned if wallet is empty.
+	GetTransactions(wallet string, offset, limit int) ([]models.TransactionRecord, int, error)
+	// GetUnsettledTransactions returns all transactions whose status can still change
+	GetUnsettledTransactions() ([]models.TransactionRecord, error)
+	// SaveScheduledTransaction inserts t or replaces the scheduled transaction with the same id
+	SaveScheduledTransaction(t models.ScheduledTransaction) error
+	GetScheduledTransaction(id string) (models.ScheduledTransaction, error)
+	// GetScheduledTransactions returns all scheduled transactions in the order of their execution time
+	GetScheduledTransactions() ([]models.ScheduledTransaction, error)
+	Close() error
 }
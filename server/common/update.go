@@ -0,0 +1,38 @@
+package common
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+)
+
+const maxUpdateAttempts = 5
+
+// UpdateUser loads the latest user, applies mutate and stores the result.
+// If the user has been modified concurrently, the whole sequence is retried on the fresh state,
+// so mutate must not have side effects besides changing the user.
+func UpdateUser(repo Repository, mutate func(user *models.User) error) (models.User, error) {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		user, err := repo.GetUser()
+		if err != nil {
+			return models.User{}, err
+		}
+
+		err = mutate(&user)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		err = repo.UpsertUser(user)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return models.User{}, err
+		}
+
+		user.Version++
+		return user, nil
+	}
+
+	return models.User{}, ErrConflict
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// errorHandler translates repository errors that the client can react to before using the default echo error handler
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		var violation *common.PolicyViolation
+		if errors.Is(err, common.ErrConflict) {
+			err = echo.NewHTTPError(http.StatusConflict, "Your data has been modified concurrently. Please try again").SetInternal(err)
+		} else if errors.As(err, &violation) {
+			err = echo.NewHTTPError(http.StatusForbidden, violation).SetInternal(err)
+		}
+
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+}
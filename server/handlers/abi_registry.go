@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+// Calls nested by multicalls are decoded up to this depth
+const maxNestedCallDepth = 3
+
+var permit2Address = common.HexToAddress("0x000000000022D473030F116dDEE9F6B43aC78BA3")
+
+var errUnknownMethod = errors.New("method is unknown")
+
+//go:embed abis/*.json
+var bundledABIFiles embed.FS
+
+type namedABI struct {
+	Name string
+	ABI  abi.ABI
+}
+
+// bundledABIs are tried in order if no ABI has been uploaded for a contract.
+// Standards sharing a selector, like transferFrom of ERC-20 and ERC-721, are decoded by the first one.
+var bundledABIs = mustLoadBundledABIs([][2]string{
+	{"ERC-20", "abis/erc20.json"},
+	{"ERC-721", "abis/erc721.json"},
+	{"ERC-1155", "abis/erc1155.json"},
+	{"Permit2", "abis/permit2.json"},
+	{"Multicall", "abis/multicall.json"},
+})
+
+type decodedArgument struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value any    `json:"value"` //Tuples and structs are nested lists of decodedArgument
+}
+
+type decodedCall struct {
+	ABI       string            `json:"abi"` //Name of the ABI that decoded the call
+	Contract  string            `json:"contract,omitempty"`
+	Method    string            `json:"method"`
+	Signature string            `json:"signature"`
+	Arguments []decodedArgument `json:"arguments"`
+	Calls     []decodedCall     `json:"calls,omitempty"` //Calls made by multicalls
+}
+
+// mustLoadBundledABIs parses the embedded files given as pairs of name and file
+func mustLoadBundledABIs(files [][2]string) []namedABI {
+	abis := make([]namedABI, len(files))
+	for i, file := range files {
+		name, path := file[0], file[1]
+		data, err := bundledABIFiles.ReadFile(path)
+		if err != nil {
+			panic(fmt.Sprintf("failed to read bundled abi %s: %s", path, err))
+		}
+
+		parsed, err := abi.JSON(bytes.NewReader(data))
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse bundled abi %s: %s", path, err))
+		}
+
+		abis[i] = namedABI{Name: name, ABI: parsed}
+	}
+
+	return abis
+}
+
+// findBundledABI returns the bundled ABI with name. It panics for unknown names, which are programming errors.
+func findBundledABI(name string) *abi.ABI {
+	for i := range bundledABIs {
+		if bundledABIs[i].Name == name {
+			return &bundledABIs[i].ABI
+		}
+	}
+
+	panic(fmt.Sprintf("bundled abi %s does not exist", name))
+}
+
+// decodeCalldata decodes a call to the contract to on chainID.
+// An ABI uploaded by the user for the contract takes precedence over the bundled ABIs.
+func decodeCalldata(user models.User, chainID, to string, data []byte) (*decodedCall, error) {
+	return decodeCalldataAtDepth(user, chainID, to, data, 0)
+}
+
+func decodeCalldataAtDepth(user models.User, chainID, to string, data []byte, depth int) (*decodedCall, error) {
+	if len(data) < 4 {
+		return nil, errUnknownMethod
+	}
+
+	candidates := make([]namedABI, 0, len(bundledABIs)+1)
+	if contract, ok := user.ContractABIs[models.ContractABIKey(chainID, to)]; ok {
+		parsed, err := abi.JSON(bytes.NewReader(contract.ABI))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse abi of %s: %w", to, err)
+		}
+		candidates = append(candidates, namedABI{Name: contract.Name, ABI: parsed})
+	}
+	candidates = append(candidates, bundledABIs...)
+
+	for _, candidate := range candidates {
+		method, err := candidate.ABI.MethodById(data[:4])
+		if err != nil {
+			continue
+		}
+
+		call, ok := decodeMethod(candidate.Name, method, data[4:])
+		if !ok {
+			continue
+		}
+		call.Contract = common.HexToAddress(to).Hex()
+
+		if candidate.Name == "Multicall" && depth < maxNestedCallDepth {
+			call.Calls = decodeNestedCalls(user, chainID, to, call.Arguments, depth+1)
+		}
+
+		return call, nil
+	}
+
+	return nil, errUnknownMethod
+}
+
+// bundledMethodName returns the name of the bundled method data calls, or an empty string if no bundled ABI knows it.
+// Uploaded ABIs are ignored, because they could give a denied method another name.
+func bundledMethodName(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+
+	for _, candidate := range bundledABIs {
+		method, err := candidate.ABI.MethodById(data[:4])
+		if err != nil {
+			continue
+		}
+
+		if _, ok := decodeMethod(candidate.Name, method, data[4:]); ok {
+			return method.RawName
+		}
+	}
+
+	return ""
+}
+
+// decodeMethod only accepts calldata that is encoded exactly like the method would encode the arguments,
+// which rejects most selector collisions
+func decodeMethod(abiName string, method *abi.Method, data []byte) (*decodedCall, bool) {
+	values, err := method.Inputs.Unpack(data)
+	if err != nil {
+		return nil, false
+	}
+
+	packed, err := method.Inputs.Pack(values...)
+	if err != nil || !bytes.Equal(packed, data) {
+		return nil, false
+	}
+
+	arguments := make([]decodedArgument, len(method.Inputs))
+	for i, input := range method.Inputs {
+		arguments[i] = decodedArgument{
+			Name:  input.Name,
+			Type:  input.Type.String(),
+			Value: formatABIValue(input.Type, reflect.ValueOf(values[i])),
+		}
+	}
+
+	return &decodedCall{
+		ABI:       abiName,
+		Method:    method.RawName,
+		Signature: method.Sig,
+		Arguments: arguments,
+	}, true
+}
+
+// describeCalldata decodes the calldata of params for display. Unknown calls are not an error.
+func describeCalldata(user models.User, params *transactionParams) *decodedCall {
+	data, err := parseData(params.Input)
+	if err != nil {
+		return nil
+	}
+
+	call, err := decodeCalldata(user, params.ChainID, params.To, data)
+	if err != nil {
+		return nil
+	}
+
+	return call
+}
+
+// decodeNestedCalls decodes the (target, callData) tuples of Multicall3 and the bytes[] of self multicalls
+func decodeNestedCalls(user models.User, chainID, to string, arguments []decodedArgument, depth int) []decodedCall {
+	calls := make([]decodedCall, 0)
+	for _, argument := range arguments {
+		elements, ok := argument.Value.([]any)
+		if !ok {
+			continue
+		}
+
+		for _, element := range elements {
+			target, data := to, ""
+			switch value := element.(type) {
+			case string:
+				data = value
+			case []decodedArgument:
+				for _, field := range value {
+					switch field.Name {
+					case "target":
+						target, _ = field.Value.(string)
+					case "callData":
+						data, _ = field.Value.(string)
+					}
+				}
+			}
+
+			decoded, err := hexutil.Decode(data)
+			if err != nil {
+				continue
+			}
+
+			call, err := decodeCalldataAtDepth(user, chainID, target, decoded, depth)
+			if err != nil {
+				// Unknown calls are still listed, so the number of calls is shown correctly
+				calls = append(calls, decodedCall{Contract: common.HexToAddress(target).Hex(), Arguments: make([]decodedArgument, 0)})
+				continue
+			}
+			calls = append(calls, *call)
+		}
+	}
+
+	return calls
+}
+
+// formatABIValue converts unpacked values into json friendly values. Numbers are formatted as decimal strings.
+func formatABIValue(t abi.Type, v reflect.Value) any {
+	switch t.T {
+	case abi.TupleTy:
+		fields := make([]decodedArgument, len(t.TupleElems))
+		for i, elem := range t.TupleElems {
+			fields[i] = decodedArgument{
+				Name:  t.TupleRawNames[i],
+				Type:  elem.String(),
+				Value: formatABIValue(*elem, v.Field(i)),
+			}
+		}
+		return fields
+	case abi.SliceTy, abi.ArrayTy:
+		elements := make([]any, v.Len())
+		for i := range elements {
+			elements[i] = formatABIValue(*t.Elem, v.Index(i))
+		}
+		return elements
+	case abi.AddressTy:
+		return v.Interface().(common.Address).Hex()
+	case abi.BytesTy:
+		return hexutil.Encode(v.Bytes())
+	case abi.FixedBytesTy:
+		b := make([]byte, v.Len())
+		reflect.Copy(reflect.ValueOf(b), v)
+		return hexutil.Encode(b)
+	case abi.IntTy, abi.UintTy:
+		if n, ok := v.Interface().(*big.Int); ok {
+			return n.String()
+		}
+		return fmt.Sprint(v.Interface())
+	default:
+		return v.Interface()
+	}
+}
+
+// decodeTypedData describes the primary type of a typed data message like a method call
+func decodeTypedData(user models.User, data apitypes.TypedData) *decodedCall {
+	abiName := data.Domain.Name
+	verifyingContract := ""
+	if common.IsHexAddress(data.Domain.VerifyingContract) {
+		verifyingContract = common.HexToAddress(data.Domain.VerifyingContract).Hex()
+	}
+
+	chainID := ""
+	if data.Domain.ChainId != nil {
+		chainID = fmt.Sprintf("0x%x", (*big.Int)(data.Domain.ChainId))
+	}
+
+	if contract, ok := user.ContractABIs[models.ContractABIKey(chainID, verifyingContract)]; ok {
+		abiName = contract.Name
+	} else if verifyingContract != "" && common.HexToAddress(verifyingContract) == permit2Address {
+		abiName = "Permit2"
+	} else if data.PrimaryType == "Permit" {
+		abiName = "ERC-2612"
+	}
+
+	return &decodedCall{
+		ABI:       abiName,
+		Contract:  verifyingContract,
+		Method:    data.PrimaryType,
+		Signature: string(data.EncodeType(data.PrimaryType)),
+		Arguments: formatTypedDataStruct(data.Types, data.PrimaryType, data.Message, 0),
+	}
+}
+
+func formatTypedDataStruct(types apitypes.Types, typeName string, message map[string]any, depth int) []decodedArgument {
+	fields := make([]decodedArgument, 0, len(types[typeName]))
+	for _, field := range types[typeName] {
+		fields = append(fields, decodedArgument{
+			Name:  field.Name,
+			Type:  field.Type,
+			Value: formatTypedDataValue(types, field.Type, message[field.Name], depth+1),
+		})
+	}
+
+	return fields
+}
+
+func formatTypedDataValue(types apitypes.Types, typeName string, value any, depth int) any {
+	// Recursive types are limited by the depth of the message itself, the limit only guards against malicious input
+	if depth > 16 {
+		return value
+	}
+
+	if strings.HasSuffix(typeName, "]") {
+		elements, ok := value.([]any)
+		if !ok {
+			return value
+		}
+
+		elemType := typeName[:strings.LastIndex(typeName, "[")]
+		formatted := make([]any, len(elements))
+		for i, element := range elements {
+			formatted[i] = formatTypedDataValue(types, elemType, element, depth+1)
+		}
+		return formatted
+	}
+
+	if _, ok := types[typeName]; ok {
+		nested, ok := value.(map[string]any)
+		if !ok {
+			return value
+		}
+		return formatTypedDataStruct(types, typeName, nested, depth)
+	}
+
+	return value
+}
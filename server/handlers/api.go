@@ -7,6 +7,7 @@ import (
 	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"sync"
 )
 
 const (
@@ -15,6 +16,17 @@ const (
 	SignTransactionKey = "sign_transaction"
 	SendTransactionKey = "send_transaction"
 	AddCredentialKey   = "add_credential"
+	RevealMnemonicKey  = "reveal_mnemonic"
+	ExportWalletKey    = "export_wallet"
+	DeleteWalletKey    = "delete_wallet"
+	SpeedUpKey         = "speed_up_transaction"
+	CancelKey          = "cancel_transaction"
+	ApproveKey         = "approve_operation"
+	ScheduleKey        = "schedule_transaction"
+	RecurringKey       = "recurring_payment"
+	SignMessageKey     = "sign_message"
+	SignTypedDataKey   = "sign_typed_data"
+	EthSignKey         = "eth_sign"
 )
 
 type Api struct {
@@ -22,6 +34,9 @@ type Api struct {
 	repo       common.Repository
 	signingKey models.SigningKey
 	cfg        config.Config
+	scheduleMu sync.Mutex //Serializes the scheduler and cancellations of scheduled transactions
+	auditKey   []byte     //Keys the hash chain of the audit log, replaced by restoring a backup
+	auditMu    sync.Mutex //Serializes appending audit events and replacing the audit key
 }
 
 func NewApi(cfg config.Config, repo common.Repository, signingKey models.SigningKey) (*Api, error) {
@@ -42,5 +57,6 @@ func NewApi(cfg config.Config, repo common.Repository, signingKey models.Signing
 		repo:       repo,
 		signingKey: signingKey,
 		cfg:        cfg,
+		auditKey:   signingKey.AuditKey(),
 	}, nil
 }
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Approvals are usually given from other devices, so they are kept much longer than a single ceremony
+	approvalTTL         = 30 * time.Minute
+	maxPendingApprovals = 20
+)
+
+type approvalOutput struct {
+	ID          string                             `json:"id"`
+	Operation   string                             `json:"operation"`
+	Subject     string                             `json:"subject"`
+	Required    int                                `json:"required"`
+	Approvals   []string                           `json:"approvals"`
+	CreatedAt   int64                              `json:"created_at"`
+	ExpiresAt   int64                              `json:"expires_at"`
+	Transaction *models.PendingTransactionApproval `json:"transaction,omitempty"`
+	Policy      *models.Policy                     `json:"policy,omitempty"`
+}
+
+// newApprovalOutput leaves out the keystore of wallet exports
+func newApprovalOutput(approval models.PendingApproval) approvalOutput {
+	return approvalOutput{
+		ID:          approval.ID,
+		Operation:   approval.Operation,
+		Subject:     approval.Subject,
+		Required:    approval.Required,
+		Approvals:   approval.Credentials(),
+		CreatedAt:   approval.CreatedAt,
+		ExpiresAt:   approval.ExpiresAt,
+		Transaction: approval.Transaction,
+		Policy:      approval.Policy,
+	}
+}
+
+// requiredApprovals returns the number of distinct credentials that have to approve operation, 1 if no quorum rule applies
+func requiredApprovals(policy models.Policy, operation string) int {
+	required := 1
+	for _, rule := range policy.QuorumRules {
+		if rule.Operation == operation && rule.Credentials > required {
+			required = rule.Credentials
+		}
+	}
+
+	return required
+}
+
+// requiredTransactionApprovals only applies the quorum rules whose threshold the transaction exceeds
+func requiredTransactionApprovals(user models.User, params *transactionParams) (int, error) {
+	effects, err := analyzeTransaction(params)
+	if err != nil {
+		return 0, err
+	}
+
+	required := 1
+	for _, rule := range user.Policy.QuorumRules {
+		if rule.Operation == models.OperationTransaction && rule.Credentials > required && rule.AppliesTo(params.ChainID, effects.spent) {
+			required = rule.Credentials
+		}
+	}
+
+	return required, nil
+}
+
+// newPendingApproval creates an approval for operation. credential is the credential that approved it already, if any.
+func newPendingApproval(operation, subject string, required int, credential string) (models.PendingApproval, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return models.PendingApproval{}, fmt.Errorf("failed to generate approval id: %w", err)
+	}
+
+	now := time.Now()
+	approval := models.PendingApproval{
+		ID:        id.String(),
+		Operation: operation,
+		Subject:   subject,
+		Required:  required,
+		Approvals: make([]models.Approval, 0, required),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(approvalTTL).Unix(),
+	}
+
+	if credential != "" {
+		approval.Approvals = append(approval.Approvals, models.Approval{
+			Credential: credential,
+			Timestamp:  now.Unix(),
+		})
+	}
+
+	return approval, nil
+}
+
+// requestApproval stores the user together with approval and responds with the state of the approval.
+// The operation is executed once enough credentials approved it.
+func (a *Api) requestApproval(c echo.Context, user models.User, approval models.PendingApproval) error {
+	releaseExpiredApprovals(&user, time.Now())
+	if len(user.PendingApprovals) >= maxPendingApprovals {
+		return echo.NewHTTPError(http.StatusBadRequest, "Too many operations are waiting for approval")
+	}
+
+	user.PendingApprovals[approval.ID] = approval
+
+	err := a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = a.recordAuditEvent(c, models.AuditApprovalRequested, map[string]string{
+		"id":        approval.ID,
+		"operation": approval.Operation,
+		"subject":   approval.Subject,
+		"required":  strconv.Itoa(approval.Required),
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, newApprovalOutput(approval))
+}
+
+// requestTransactionApproval keeps the nonce of the transaction reserved until the approval expires
+func (a *Api) requestTransactionApproval(c echo.Context, user models.User, params *transactionParams, credential string, required int, action, replaces string) error {
+	nonce, err := parseReservedNonce(params)
+	if err != nil {
+		return err
+	}
+
+	approval, err := newPendingApproval(models.OperationTransaction, params.From, required, credential)
+	if err != nil {
+		return err
+	}
+	approval.Transaction = &models.PendingTransactionApproval{
+		Action:   action,
+		Params:   models.TransactionParams(*params),
+		Replaces: replaces,
+	}
+
+	user.ExtendNonce(params.ChainID, params.From, nonce, approval.ExpiresAt)
+
+	return a.requestApproval(c, user, approval)
+}
+
+// executeApproval executes the operation of a complete approval. The user is stored by the operation.
+func (a *Api) executeApproval(c echo.Context, user models.User, approval models.PendingApproval) error {
+	switch approval.Operation {
+	case models.OperationTransaction:
+		params := transactionParams(approval.Transaction.Params)
+		credential := strings.Join(approval.Credentials(), ",")
+
+		// Scheduled transactions are evaluated when they are sent
+		if approval.Transaction.Action != models.TransactionActionSchedule {
+			err := a.reevaluateApproval(&user, approval, &params)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch approval.Transaction.Action {
+		case models.TransactionActionSend:
+			return a.sendTransaction(c, user, &params, credential)
+		case models.TransactionActionSign:
+			return a.signPendingTransaction(c, user, &params)
+		case models.TransactionActionSpeedUp, models.TransactionActionCancel:
+			return a.sendReplacement(c, user, &params, approval.Transaction.Replaces, credential, approval.Transaction.Action)
+		case models.TransactionActionSchedule:
+			return a.scheduleTransaction(c, user, &params, credential, models.ScheduleKindScheduled, time.Unix(approval.Transaction.ExecuteAt, 0))
+		}
+	case models.OperationWalletExport:
+		return a.completeWalletExport(c, user, *approval.Export)
+	case models.OperationCredentialRemoval:
+		return a.removeCredential(c, user, approval.Subject)
+	case models.OperationEmergencyContactRemoval:
+		return a.removeEmergencyContact(c, user, a.approvedUser(user), approval.Subject)
+	case models.OperationPolicyLoosening:
+		return a.updatePolicy(c, a.approvedUser(user), *approval.Policy, true)
+	}
+
+	return fmt.Errorf("approval %s has an unknown operation %s", approval.ID, approval.Operation)
+}
+
+// userUpdate stores a change of the user and returns the stored user
+type userUpdate func(mutate func(user *models.User) error) (models.User, error)
+
+// latestUser applies mutate to the latest state of the user, see common.UpdateUser
+func (a *Api) latestUser(mutate func(user *models.User) error) (models.User, error) {
+	return common.UpdateUser(a.repo, mutate)
+}
+
+// approvedUser applies changes to user, which holds the completed approval and the finished ceremony.
+// Those can not be applied to a newer state again, so a concurrent modification fails with common.ErrConflict.
+func (a *Api) approvedUser(user models.User) userUpdate {
+	return func(mutate func(user *models.User) error) (models.User, error) {
+		err := mutate(&user)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return models.User{}, err
+		}
+
+		user.Version++
+		return user, nil
+	}
+}
+
+// reevaluateApproval evaluates the policy again, because it might have changed while the transaction was waiting for approval.
+// A rejected transaction is discarded together with its approval.
+func (a *Api) reevaluateApproval(user *models.User, approval models.PendingApproval, params *transactionParams) error {
+	nonce, err := parseReservedNonce(params)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	spent, err := evaluatePolicy(user, params, nonce, now)
+	if err != nil {
+		releaseApproval(user, approval)
+		if upsertErr := a.repo.UpsertUser(*user); upsertErr != nil {
+			return upsertErr
+		}
+
+		return err
+	}
+
+	user.RecordSpend(params.From, params.ChainID, nonce, spent, now.Unix())
+
+	return nil
+}
+
+// releaseExpiredApprovals removes expired approvals and gives back what their transactions reserved
+func releaseExpiredApprovals(user *models.User, now time.Time) {
+	for _, approval := range user.PruneApprovals(now.Unix()) {
+		releaseApproval(user, approval)
+	}
+}
+
+// releaseApproval gives back the nonce and the spent amounts of a transaction that will not be executed.
+// Replacements keep both, because they belong to the replaced transaction as well.
+func releaseApproval(user *models.User, approval models.PendingApproval) {
+	if approval.Transaction == nil || approval.Transaction.Replaces != "" {
+		return
+	}
+
+	params := transactionParams(approval.Transaction.Params)
+	nonce, err := parseReservedNonce(&params)
+	if err != nil {
+		return
+	}
+
+	user.ReleaseNonce(params.ChainID, params.From, nonce)
+	user.RemoveSpend(params.From, params.ChainID, nonce)
+}
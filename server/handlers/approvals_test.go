@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/repository"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApprovalSchedulesTransaction(t *testing.T) {
+	repo := repository.NewMemory()
+	a := &Api{repo: repo}
+
+	params := transactionParams{
+		Type:     "0x0",
+		From:     "0x1111111111111111111111111111111111111111",
+		To:       "0x2222222222222222222222222222222222222222",
+		Value:    "0x1",
+		Gas:      "0x5208",
+		GasPrice: "0x1",
+		ChainID:  "0x1",
+	}
+	executeAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	approval, err := newPendingApproval(models.OperationTransaction, params.From, 2, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval.Transaction = &models.PendingTransactionApproval{
+		Action:    models.TransactionActionSchedule,
+		Params:    models.TransactionParams(params),
+		ExecuteAt: executeAt.Unix(),
+	}
+
+	user := models.NewUser("user@example.com", "User")
+	user.PendingApprovals[approval.ID] = approval
+	if err = repo.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	user, err = repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+	if err = a.addApproval(c, user, approval.ID, "laptop"); err != nil {
+		t.Fatalf("failed to approve: %v", err)
+	}
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rec.Code)
+	}
+
+	scheduled, err := repo.GetScheduledTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 1 {
+		t.Fatalf("expected one scheduled transaction, got %d", len(scheduled))
+	}
+	s := scheduled[0]
+	if s.Kind != models.ScheduleKindScheduled || s.Status != models.ScheduledWaiting {
+		t.Errorf("unexpected kind %s and status %s", s.Kind, s.Status)
+	}
+	if s.ExecuteAt != executeAt.Unix() {
+		t.Errorf("expected execution at %d, got %d", executeAt.Unix(), s.ExecuteAt)
+	}
+	if s.Params.To != params.To || s.Credential != "phone,laptop" {
+		t.Errorf("unexpected transaction %+v", s)
+	}
+
+	user, err = repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := user.PendingApprovals[approval.ID]; ok {
+		t.Error("the complete approval is still pending")
+	}
+}
+
+func TestApprovalWaitsForQuorum(t *testing.T) {
+	repo := repository.NewMemory()
+	a := &Api{repo: repo}
+
+	approval, err := newPendingApproval(models.OperationTransaction, "0x1111111111111111111111111111111111111111", 3, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval.Transaction = &models.PendingTransactionApproval{
+		Action:    models.TransactionActionSchedule,
+		ExecuteAt: time.Now().Add(time.Hour).Unix(),
+	}
+
+	user := models.NewUser("user@example.com", "User")
+	user.PendingApprovals[approval.ID] = approval
+	if err = repo.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	user, err = repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+	if err = a.addApproval(c, user, approval.ID, "phone"); err == nil {
+		t.Fatal("a credential approved twice")
+	}
+	if err = a.addApproval(c, user, approval.ID, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := repo.GetScheduledTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduled) != 0 {
+		t.Fatalf("scheduled before the quorum was reached")
+	}
+
+	user, err = repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(user.PendingApprovals[approval.ID].Approvals); got != 2 {
+		t.Errorf("expected 2 approvals, got %d", got)
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// recordAuditEvent appends a security relevant event to the audit log.
+// The credential of the current session is recorded if the request is authenticated by the frontend.
+func (a *Api) recordAuditEvent(c echo.Context, eventType string, details map[string]string) error {
+	var credential string
+	if claims, ok := c.Get("claims").(common.EnclaveClaims); ok && claims.Scope == common.ScopeUser {
+		credential = claims.Credential
+	}
+
+	return a.recordAuditEventWithCredential(eventType, credential, details)
+}
+
+// recordCompletedAuditEvent records an event of an action that can not be undone, like a broadcast or a signature.
+// A failure is only logged, because the caller would lose the result of the action otherwise.
+func (a *Api) recordCompletedAuditEvent(c echo.Context, eventType string, details map[string]string) {
+	err := a.recordAuditEvent(c, eventType, details)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to record %s audit event", eventType)
+	}
+}
+
+func (a *Api) recordAuditEventWithCredential(eventType, credential string, details map[string]string) error {
+	if details == nil {
+		details = make(map[string]string)
+	}
+
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+
+	_, err := a.repo.AppendAuditEvent(models.AuditEvent{
+		Timestamp:  time.Now().Unix(),
+		Type:       eventType,
+		Credential: credential,
+		Details:    details,
+	}, a.auditKey)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+
+	return nil
+}
+
+func credentialName(user models.User, credential *webauthn.Credential) string {
+	for name, cred := range user.WebauthnData.Credentials {
+		if bytes.Equal(cred.ID, credential.ID) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// rekeyAuditLog hashes the audit log with the audit key of signingKey and uses it for all further events
+func (a *Api) rekeyAuditLog(signingKey models.SigningKey) error {
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+
+	key := signingKey.AuditKey()
+	err := a.repo.RekeyAuditLog(a.auditKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to rekey audit log: %w", err)
+	}
+	a.auditKey = key
+
+	return nil
+}
+
+// verifyAuditEvents checks that events form a valid chain that continues previous, or starts the log if previous is nil
+func (a *Api) verifyAuditEvents(events []models.AuditEvent, previous *models.AuditEvent) bool {
+	a.auditMu.Lock()
+	defer a.auditMu.Unlock()
+
+	return models.AuditEvents(events).Verify(a.auditKey, previous)
+}
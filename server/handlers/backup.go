@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/repository"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"strings"
+)
+
+const (
+	// Version 2 stores the user as a versioned document, version 1 stored the user of the exporting enclave as is
+	backupArchiveVersion = 2
+	backupKDFScrypt      = "scrypt"
+	backupKDFPasskey     = "passkey-prf"
+
+	backupScryptN = 1 << 15
+	backupScryptR = 8
+	backupScryptP = 1
+
+	// Upper bounds for imported archives, prevents excessive memory usage during key derivation
+	maxBackupScryptN = 1 << 18
+	maxBackupScryptR = 16
+	maxBackupScryptP = 4
+)
+
+var errInvalidBackup = errors.New("backup is invalid or the secret is wrong")
+
+// backupArchive is the encrypted export of an enclave.
+// All fields except the ciphertext are authenticated as associated data.
+type backupArchive struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n,omitempty"`
+	R          int    `json:"r,omitempty"`
+	P          int    `json:"p,omitempty"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type backupContent struct {
+	User       models.User
+	SigningKey models.SigningKey
+	CreatedAt  int64
+}
+
+// backupPayload is the encrypted part of an archive. The user is migrated like a stored document when it is restored,
+// so backups of older versions of the enclave are complete.
+type backupPayload struct {
+	User       json.RawMessage   `json:"user"`
+	SigningKey models.SigningKey `json:"signing_key"`
+	CreatedAt  int64             `json:"created_at"`
+}
+
+// sealBackup encrypts content with a key derived from secret.
+// The secret is either a passphrase or the output of the WebAuthn PRF extension of a passkey.
+func sealBackup(content backupContent, kdf string, secret []byte) (backupArchive, error) {
+	archive := backupArchive{
+		Version: backupArchiveVersion,
+		KDF:     kdf,
+		Salt:    make([]byte, 32),
+	}
+	if kdf == backupKDFScrypt {
+		archive.N = backupScryptN
+		archive.R = backupScryptR
+		archive.P = backupScryptP
+	}
+
+	if _, err := rand.Read(archive.Salt); err != nil {
+		return backupArchive{}, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	aead, err := archive.aead(secret)
+	if err != nil {
+		return backupArchive{}, err
+	}
+
+	user, err := repository.EncodeUser(content.User)
+	if err != nil {
+		return backupArchive{}, fmt.Errorf("failed to encode user: %w", err)
+	}
+
+	plaintext, err := json.Marshal(backupPayload{
+		User:       user,
+		SigningKey: content.SigningKey,
+		CreatedAt:  content.CreatedAt,
+	})
+	if err != nil {
+		return backupArchive{}, fmt.Errorf("failed to marshal backup: %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return backupArchive{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	archive.Ciphertext = aead.Seal(nonce, nonce, plaintext, archive.associatedData())
+	return archive, nil
+}
+
+// openBackup decrypts the archive and verifies that the keys it contains are consistent
+func openBackup(archive backupArchive, secret []byte) (backupContent, error) {
+	if archive.Version < 1 || archive.Version > backupArchiveVersion {
+		return backupContent{}, fmt.Errorf("unsupported backup version: %d", archive.Version)
+	}
+
+	aead, err := archive.aead(secret)
+	if err != nil {
+		return backupContent{}, err
+	}
+
+	if len(archive.Ciphertext) < aead.NonceSize() {
+		return backupContent{}, errInvalidBackup
+	}
+	nonce, ciphertext := archive.Ciphertext[:aead.NonceSize()], archive.Ciphertext[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, archive.associatedData())
+	if err != nil {
+		return backupContent{}, errInvalidBackup
+	}
+
+	var payload backupPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return backupContent{}, fmt.Errorf("failed to decode backup: %w", err)
+	}
+
+	// The user of a version 1 archive has no schema version, so it is upgraded from the first one.
+	// The migrations only add what is missing, which keeps newer users intact.
+	user, err := repository.DecodeUser(payload.User)
+	if err != nil {
+		return backupContent{}, fmt.Errorf("failed to decode user of backup: %w", err)
+	}
+
+	content := backupContent{
+		User:       user,
+		SigningKey: payload.SigningKey,
+		CreatedAt:  payload.CreatedAt,
+	}
+
+	if err := verifyBackupContent(content); err != nil {
+		return backupContent{}, err
+	}
+
+	return content, nil
+}
+
+func verifyBackupContent(content backupContent) error {
+	if len(content.SigningKey.PrivateKey) != ed25519.PrivateKeySize {
+		return errors.New("backup contains an invalid signing key")
+	}
+	pk := content.SigningKey.PrivateKey.Public().(ed25519.PublicKey)
+	if !pk.Equal(content.SigningKey.PublicKey) {
+		return errors.New("backup contains a signing key that does not match its public key")
+	}
+
+	for _, wallet := range content.User.Wallets {
+		privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+		if err != nil {
+			return fmt.Errorf("backup contains an invalid private key for wallet %s", wallet.Name)
+		}
+
+		if !strings.EqualFold(crypto.PubkeyToAddress(privateKey.PublicKey).Hex(), wallet.Address) {
+			return fmt.Errorf("backup contains a private key that does not match the address of wallet %s", wallet.Name)
+		}
+	}
+
+	return nil
+}
+
+func (b backupArchive) aead(secret []byte) (cipher.AEAD, error) {
+	var key []byte
+	switch b.KDF {
+	case backupKDFScrypt:
+		if b.N > maxBackupScryptN || b.R > maxBackupScryptR || b.P > maxBackupScryptP {
+			return nil, errors.New("scrypt parameters exceed the supported maximum")
+		}
+
+		var err error
+		key, err = scrypt.Key(secret, b.Salt, b.N, b.R, b.P, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+	case backupKDFPasskey:
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, b.Salt, []byte("elonwallet-backup")), key); err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function: %s", b.KDF)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (b backupArchive) associatedData() []byte {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "%d|%s|%d|%d|%d|", b.Version, b.KDF, b.N, b.R, b.P)
+	buf.Write(b.Salt)
+	return buf.Bytes()
+}
+
+// backupSecret selects the key derivation function matching the provided secret
+func backupSecret(passphrase string, passkeySecret []byte) (string, []byte) {
+	if len(passkeySecret) > 0 {
+		return backupKDFPasskey, passkeySecret
+	}
+
+	return backupKDFScrypt, []byte(passphrase)
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/repository"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testSigningKey(t *testing.T) models.SigningKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return models.SigningKey{PrivateKey: privateKey, PublicKey: publicKey}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	user := models.NewUser("user@example.com", "User")
+	user.Policy.AllowEthSign = true
+	secret := make([]byte, 32)
+
+	archive, err := sealBackup(backupContent{User: user, SigningKey: testSigningKey(t), CreatedAt: 1}, backupKDFPasskey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := openBackup(archive, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.User.Email != user.Email || !content.User.Policy.AllowEthSign || content.CreatedAt != 1 {
+		t.Errorf("unexpected content %+v", content)
+	}
+}
+
+// Version 1 archives contain the user as the exporting enclave stored it, which lacks everything added later
+func TestOpenBackupMigratesUser(t *testing.T) {
+	secret := make([]byte, 32)
+	archive := backupArchive{Version: 1, KDF: backupKDFPasskey, Salt: make([]byte, 32)}
+
+	plaintext, err := json.Marshal(map[string]any{
+		"user": json.RawMessage(`{
+			"webauthn_data": {"id": "id", "name": "user@example.com", "display_name": "User", "credentials": {}, "sessions": {}, "pending_transactions": {}},
+			"wallets": [],
+			"email": "user@example.com",
+			"networks": [],
+			"emergency_access_contacts": {},
+			"emergency_access_grants": {}
+		}`),
+		"signing_key": testSigningKey(t),
+		"created_at":  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aead, err := archive.aead(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	archive.Ciphertext = aead.Seal(nonce, nonce, plaintext, archive.associatedData())
+
+	content, err := openBackup(archive, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := content.User
+	if restored.Email != "user@example.com" || restored.WebauthnData.ID != "id" {
+		t.Errorf("unexpected user %+v", restored)
+	}
+	if restored.PendingApprovals == nil || restored.ContractABIs == nil || restored.RecurringPayments == nil {
+		t.Error("the maps added after version 1 are missing")
+	}
+	if restored.WebauthnData.PendingSignatures == nil || restored.Policy.SpendLimits == nil {
+		t.Error("the nested fields added after version 1 are missing")
+	}
+}
+
+// conflictingRepository fails every update of the user like a concurrent update would
+type conflictingRepository struct {
+	common.Repository
+}
+
+func (conflictingRepository) UpsertUser(models.User) error {
+	return common.ErrConflict
+}
+
+type acceptingValidator struct{}
+
+func (acceptingValidator) Validate(any) error {
+	return nil
+}
+
+func TestFailedRestoreKeepsSigningKey(t *testing.T) {
+	memory := repository.NewMemory()
+	previous := testSigningKey(t)
+	previous.AuditLogKeyed = true
+	if err := memory.SaveSigningKey(previous); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memory.AppendAuditEvent(models.AuditEvent{Type: models.AuditLogin, Details: map[string]string{}}, previous.AuditKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	user := models.NewUser("user@example.com", "User")
+	user.WebauthnData.Sessions[RegistrationKey] = webauthn.SessionData{}
+	if err := memory.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := make([]byte, 32)
+	archive, err := sealBackup(backupContent{User: models.NewUser("user@example.com", "User"), SigningKey: testSigningKey(t), CreatedAt: 1}, backupKDFPasskey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]any{"backup": archive, "passkey_secret": secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Validator = acceptingValidator{}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	a := &Api{repo: conflictingRepository{memory}, signingKey: previous, auditKey: previous.AuditKey()}
+	if err = a.HandleRegisterRestore()(c); !errors.Is(err, common.ErrConflict) {
+		t.Fatalf("expected %v, got %v", common.ErrConflict, err)
+	}
+
+	stored, err := memory.GetSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.PublicKey.Equal(previous.PublicKey) {
+		t.Error("the restored signing key has been kept")
+	}
+
+	events, _, err := memory.GetAuditEvents(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !models.AuditEvents(events).Verify(previous.AuditKey(), nil) {
+		t.Error("the audit log is not hashed with the signing key of the enclave")
+	}
+}
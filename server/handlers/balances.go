@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	// maxConcurrentBalanceCalls limits the number of rpc calls that are in flight across all networks
+	maxConcurrentBalanceCalls = 16
+	balanceNetworkTimeout     = 10 * time.Second
+)
+
+// balanceOfSelector is the function selector of balanceOf(address)
+var balanceOfSelector = []byte{0x70, 0xa0, 0x82, 0x31}
+
+type tokenBalance struct {
+	models.Token
+	Balance string `json:"balance,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type networkBalance struct {
+	ChainIDHex string         `json:"chain_id_hex"`
+	Currency   string         `json:"currency"`
+	Decimals   int64          `json:"decimals"`
+	Balance    string         `json:"balance,omitempty"`
+	Tokens     []tokenBalance `json:"tokens"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type walletBalances struct {
+	Name     string           `json:"name"`
+	Address  string           `json:"address"`
+	Networks []networkBalance `json:"networks"`
+}
+
+// fetchBalances queries the native and token balances of every wallet on every network.
+// Failures are reported per network and per token instead of failing the whole request.
+func fetchBalances(ctx context.Context, wallets models.Wallets, networks models.Networks, tokens models.Tokens) []walletBalances {
+	result := make([]walletBalances, len(wallets))
+	for i, wallet := range wallets {
+		result[i] = walletBalances{
+			Name:     wallet.Name,
+			Address:  wallet.Address,
+			Networks: make([]networkBalance, len(networks)),
+		}
+		for j, network := range networks {
+			result[i].Networks[j] = networkBalance{
+				ChainIDHex: network.ChainIDHex,
+				Currency:   network.Currency,
+				Decimals:   network.Decimals,
+				Tokens:     make([]tokenBalance, len(tokens[network.ChainIDHex])),
+			}
+			for k, token := range tokens[network.ChainIDHex] {
+				result[i].Networks[j].Tokens[k] = tokenBalance{Token: token}
+			}
+		}
+	}
+
+	sem := make(chan struct{}, maxConcurrentBalanceCalls)
+	var wg sync.WaitGroup
+	for j, network := range networks {
+		wg.Add(1)
+		go func(j int, network models.Network) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, balanceNetworkTimeout)
+			defer cancel()
+
+			client, err := ethclient.DialContext(ctx, network.RPC)
+			if err != nil {
+				for i := range result {
+					result[i].Networks[j].Error = fmt.Sprintf("failed to dial rpc: %s", err)
+				}
+				return
+			}
+			defer client.Close()
+
+			// Every goroutine writes to a distinct element of result, so no further locking is needed
+			var networkWg sync.WaitGroup
+			for i := range result {
+				address := common.HexToAddress(result[i].Address)
+				balance := &result[i].Networks[j]
+
+				networkWg.Add(1)
+				go func() {
+					defer networkWg.Done()
+					sem <- struct{}{}
+					defer func() { <-sem }()
+
+					native, err := client.BalanceAt(ctx, address, nil)
+					if err != nil {
+						balance.Error = fmt.Sprintf("failed to get balance: %s", err)
+						return
+					}
+					balance.Balance = native.String()
+				}()
+
+				for k := range balance.Tokens {
+					token := &balance.Tokens[k]
+
+					networkWg.Add(1)
+					go func() {
+						defer networkWg.Done()
+						sem <- struct{}{}
+						defer func() { <-sem }()
+
+						amount, err := tokenBalanceOf(ctx, client, common.HexToAddress(token.Address), address)
+						if err != nil {
+							token.Error = err.Error()
+							return
+						}
+						token.Balance = amount.String()
+					}()
+				}
+			}
+			networkWg.Wait()
+		}(j, network)
+	}
+	wg.Wait()
+
+	return result
+}
+
+func tokenBalanceOf(ctx context.Context, client *ethclient.Client, token common.Address, owner common.Address) (*big.Int, error) {
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(owner.Bytes(), 32)...)
+	res, err := client.CallContract(ctx, ethereum.CallMsg{
+		To:   &token,
+		Data: data,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call balanceOf: %w", err)
+	}
+	if len(res) != 32 {
+		return nil, fmt.Errorf("balanceOf returned %d bytes instead of 32", len(res))
+	}
+
+	return new(big.Int).SetBytes(res), nil
+}
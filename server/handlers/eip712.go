@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/slices"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Versions of eth_signTypedData. They differ in how the data is encoded, so the same data can result in different hashes.
+const (
+	typedDataV1 = "v1" //eth_signTypedData, a flat list of values without a domain that predates EIP-712
+	typedDataV3 = "v3" //eth_signTypedData_v3, EIP-712 without arrays
+	typedDataV4 = "v4" //eth_signTypedData_v4, EIP-712 with arrays
+)
+
+// legacyTypedDataField is a value of typed data signed with eth_signTypedData (v1)
+type legacyTypedDataField struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value any    `json:"value"`
+}
+
+// typedMessage is typed data of one of the eth_signTypedData versions
+type typedMessage struct {
+	Version string
+	Data    apitypes.TypedData     //Used by v3 and v4
+	Legacy  []legacyTypedDataField //Used by v1
+	Hash    ethcommon.Hash
+}
+
+// parseTypedData decodes typed data of version and computes the hash that is signed
+func parseTypedData(raw json.RawMessage, version string) (typedMessage, error) {
+	msg := typedMessage{Version: version}
+
+	var err error
+	switch version {
+	case typedDataV1:
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		// Values are packed with the precision of their type, which float64 does not have
+		decoder.UseNumber()
+		if err = decoder.Decode(&msg.Legacy); err != nil {
+			return typedMessage{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid typed data").SetInternal(err)
+		}
+		msg.Hash, err = hashLegacyTypedData(msg.Legacy)
+	case typedDataV3, typedDataV4:
+		if err = json.Unmarshal(raw, &msg.Data); err != nil {
+			return typedMessage{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid typed data").SetInternal(err)
+		}
+		msg.Hash, err = hashTypedData(msg.Data, version)
+	default:
+		return typedMessage{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown typed data version %s", version))
+	}
+	if err != nil {
+		return typedMessage{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid typed data: %s", err.Error()))
+	}
+
+	return msg, nil
+}
+
+// hashTypedData computes the EIP-712 hash like the reference implementation of eth_signTypedData_v3 and eth_signTypedData_v4
+func hashTypedData(data apitypes.TypedData, version string) (ethcommon.Hash, error) {
+	if _, ok := data.Types["EIP712Domain"]; !ok {
+		return ethcommon.Hash{}, errors.New("the type EIP712Domain is missing")
+	}
+
+	domainSeparator, err := encodeTypedStruct(&data, "EIP712Domain", data.Domain.Map(), version)
+	if err != nil {
+		return ethcommon.Hash{}, fmt.Errorf("failed to encode domain: %w", err)
+	}
+
+	message, err := encodeTypedStruct(&data, data.PrimaryType, data.Message, version)
+	if err != nil {
+		return ethcommon.Hash{}, fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	return crypto.Keccak256Hash([]byte("\x19\x01"), crypto.Keccak256(domainSeparator), crypto.Keccak256(message)), nil
+}
+
+// encodeTypedStruct encodes the values of a struct. Values that are not part of the type are rejected, because they would be
+// shown to the user without being signed.
+func encodeTypedStruct(data *apitypes.TypedData, structType string, values map[string]any, version string) ([]byte, error) {
+	fields, ok := data.Types[structType]
+	if !ok {
+		return nil, fmt.Errorf("the type %s is undefined", structType)
+	}
+
+	for name := range values {
+		known := slices.ContainsFunc(fields, func(field apitypes.Type) bool {
+			return field.Name == name
+		})
+		if !known {
+			return nil, fmt.Errorf("the field %s is not part of the type %s", name, structType)
+		}
+	}
+
+	buffer := bytes.NewBuffer(data.TypeHash(structType))
+	for _, field := range fields {
+		value, ok := values[field.Name]
+		// v3 leaves out missing values, v4 requires them
+		if !ok && version == typedDataV3 {
+			continue
+		}
+
+		encoded, err := encodeTypedField(data, field.Name, field.Type, value, version)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(encoded)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func encodeTypedField(data *apitypes.TypedData, name, fieldType string, value any, version string) ([]byte, error) {
+	if _, ok := data.Types[fieldType]; ok {
+		// v4 encodes a missing struct as zero
+		if value == nil && version == typedDataV4 {
+			return make([]byte, 32), nil
+		}
+
+		values, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("the field %s is not a %s", name, fieldType)
+		}
+
+		encoded, err := encodeTypedStruct(data, fieldType, values, version)
+		if err != nil {
+			return nil, err
+		}
+
+		return crypto.Keccak256(encoded), nil
+	}
+
+	if value == nil {
+		return nil, fmt.Errorf("the value of the field %s is missing", name)
+	}
+
+	if strings.HasSuffix(fieldType, "]") {
+		if version != typedDataV4 {
+			return nil, fmt.Errorf("arrays like the field %s are only supported by %s", name, typedDataV4)
+		}
+
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("the field %s is not an array", name)
+		}
+
+		// Nested arrays are encoded recursively
+		itemType := fieldType[:strings.LastIndex(fieldType, "[")]
+		var buffer bytes.Buffer
+		for _, item := range items {
+			encoded, err := encodeTypedField(data, name, itemType, item, version)
+			if err != nil {
+				return nil, err
+			}
+			buffer.Write(encoded)
+		}
+
+		return crypto.Keccak256(buffer.Bytes()), nil
+	}
+
+	encoded, err := data.EncodePrimitiveValue(fieldType, value, 0)
+	if err != nil {
+		return nil, fmt.Errorf("the field %s is invalid: %w", name, err)
+	}
+
+	return encoded, nil
+}
+
+// hashLegacyTypedData computes the hash of eth_signTypedData (v1) like the reference implementation.
+// It is the hash of the packed schema followed by the hash of the packed values.
+func hashLegacyTypedData(fields []legacyTypedDataField) (ethcommon.Hash, error) {
+	if len(fields) == 0 {
+		return ethcommon.Hash{}, errors.New("the data is empty")
+	}
+
+	var schema, values bytes.Buffer
+	for _, field := range fields {
+		if field.Name == "" || field.Type == "" {
+			return ethcommon.Hash{}, errors.New("every value needs a type and a name")
+		}
+
+		packed, err := packLegacyValue(field.Type, field.Value, 0)
+		if err != nil {
+			return ethcommon.Hash{}, fmt.Errorf("the value %s is invalid: %w", field.Name, err)
+		}
+
+		schema.WriteString(field.Type + " " + field.Name)
+		values.Write(packed)
+	}
+
+	return crypto.Keccak256Hash(crypto.Keccak256(schema.Bytes()), crypto.Keccak256(values.Bytes())), nil
+}
+
+// packLegacyValue packs value like Solidity's abi.encodePacked. Elements of arrays are padded to size bits, other values use their
+// natural size if size is zero.
+func packLegacyValue(valueType string, value any, size int) ([]byte, error) {
+	if i := strings.Index(valueType, "["); i != -1 {
+		return packLegacyArray(valueType[:i], valueType[i:], value)
+	}
+
+	switch valueType {
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		return []byte(s), nil
+	case "bytes":
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a string")
+		}
+		// Strings without hex prefix are packed as text
+		if b, err := hexutil.Decode(s); err == nil {
+			return b, nil
+		}
+		return []byte(s), nil
+	case "bool":
+		b, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("not a boolean")
+		}
+		packed := make([]byte, packedSize(size, 8))
+		if b {
+			packed[len(packed)-1] = 1
+		}
+		return packed, nil
+	case "address":
+		s, ok := value.(string)
+		if !ok || !ethcommon.IsHexAddress(s) {
+			return nil, errors.New("not an address")
+		}
+		return ethcommon.LeftPadBytes(ethcommon.HexToAddress(s).Bytes(), packedSize(size, 160)), nil
+	case "int", "uint":
+		valueType += "256"
+	}
+
+	if strings.HasPrefix(valueType, "bytes") {
+		length, err := strconv.Atoi(strings.TrimPrefix(valueType, "bytes"))
+		if err != nil || length < 1 || length > 32 {
+			return nil, fmt.Errorf("unknown type %s", valueType)
+		}
+
+		s, ok := value.(string)
+		if !ok {
+			return nil, errors.New("not a hex string")
+		}
+		b, err := hexutil.Decode(s)
+		if err != nil || len(b) > length {
+			return nil, fmt.Errorf("not a %s", valueType)
+		}
+		return ethcommon.RightPadBytes(b, length), nil
+	}
+
+	signed := strings.HasPrefix(valueType, "int")
+	if !signed && !strings.HasPrefix(valueType, "uint") {
+		return nil, fmt.Errorf("unknown type %s", valueType)
+	}
+
+	bits, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(valueType, "u"), "int"))
+	if err != nil || bits < 8 || bits > 256 || bits%8 != 0 {
+		return nil, fmt.Errorf("unknown type %s", valueType)
+	}
+
+	n, err := parseLegacyNumber(value)
+	if err != nil {
+		return nil, err
+	}
+	if n.Sign() < 0 && !signed {
+		return nil, errors.New("negative value for an unsigned type")
+	}
+	if n.BitLen() > bits {
+		return nil, fmt.Errorf("the value does not fit into %s", valueType)
+	}
+
+	// Negative values are stored as two's complement of the type, the padding of array elements is not sign extended
+	if n.Sign() < 0 {
+		n = new(big.Int).Add(n, new(big.Int).Lsh(big.NewInt(1), uint(bits)))
+	}
+
+	return ethcommon.LeftPadBytes(n.Bytes(), packedSize(size, bits)), nil
+}
+
+// packLegacyArray packs the elements of a one-dimensional array, each padded to 32 bytes
+func packLegacyArray(elementType, dimension string, value any) ([]byte, error) {
+	if strings.Count(dimension, "[") != 1 || !strings.HasSuffix(dimension, "]") {
+		return nil, errors.New("nested arrays are not supported")
+	}
+
+	items, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+
+	if length := strings.Trim(dimension, "[]"); length != "" {
+		max, err := strconv.Atoi(length)
+		if err != nil {
+			return nil, fmt.Errorf("invalid array size %s", length)
+		}
+		if len(items) > max {
+			return nil, fmt.Errorf("more than %d elements", max)
+		}
+	}
+
+	var buffer bytes.Buffer
+	for _, item := range items {
+		packed, err := packLegacyValue(elementType, item, 256)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(packed)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func packedSize(size, natural int) int {
+	if size == 0 {
+		return natural / 8
+	}
+
+	return size / 8
+}
+
+// parseLegacyNumber accepts json numbers as well as decimal and hex strings
+func parseLegacyNumber(value any) (*big.Int, error) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return nil, errors.New("not a number")
+	}
+
+	n, ok := new(big.Int), false
+	if hex, found := strings.CutPrefix(s, "0x"); found {
+		n, ok = n.SetString(hex, 16)
+	} else {
+		n, ok = n.SetString(s, 10)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s is not an integer", s)
+	}
+
+	return n, nil
+}
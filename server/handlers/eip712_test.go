@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"strings"
+	"testing"
+)
+
+// The vectors are taken from the tests of @metamask/eth-sig-util
+
+const mailTypedData = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallet", "type": "address"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "string"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+const mailArraysTypedData = `{
+	"types": {
+		"EIP712Domain": [
+			{"name": "name", "type": "string"},
+			{"name": "version", "type": "string"},
+			{"name": "chainId", "type": "uint256"},
+			{"name": "verifyingContract", "type": "address"}
+		],
+		"Person": [
+			{"name": "name", "type": "string"},
+			{"name": "wallets", "type": "address[]"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person[]"},
+			{"name": "contents", "type": "string"}
+		],
+		"Group": [
+			{"name": "name", "type": "string"},
+			{"name": "members", "type": "Person[]"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {
+		"name": "Ether Mail",
+		"version": "1",
+		"chainId": 1,
+		"verifyingContract": "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	},
+	"message": {
+		"from": {
+			"name": "Cow",
+			"wallets": [
+				"0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826",
+				"0xDeaDbeefdEAdbeefdEadbEEFdeadbeEFdEaDbeeF"
+			]
+		},
+		"to": [{
+			"name": "Bob",
+			"wallets": [
+				"0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB",
+				"0xB0BdaBea57B0BDABeA57b0bdABEA57b0BDabEa57",
+				"0xB0B0b0b0b0b0B000000000000000000000000000"
+			]
+		}],
+		"contents": "Hello, Bob!"
+	}
+}`
+
+const legacyTypedData = `[{"type": "string", "name": "message", "value": "Hi, Alice!"}]`
+
+// keccak256("cow")
+const cowPrivateKey = "c85ef7d79691fe79573b1a7064c19c1a9819ebdbd1faaab1a8ec92344438aaf4"
+
+func TestTypedDataVectors(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		version    string
+		privateKey string
+		hash       string
+		signature  string
+	}{
+		{
+			name:       "v1",
+			data:       legacyTypedData,
+			version:    typedDataV1,
+			privateKey: "4af1bceebf7f3634ec3cff8a2c38e51178d5d4ce585c52d6043e5e2cc3418bb0",
+			hash:       "0x14b9f24872e28cc49e72dc104d7380d8e0ba84a3fe2e712704bcac66a5702bd5",
+			signature:  "0x49e75d475d767de7fcc67f521e0d86590723d872e6111e51c393e8c1e2f21d032dfaf5833af158915f035db6af4f37bf2d5d29781cd81f28a44c5cb4b9d241531b",
+		},
+		{
+			name:       "v3",
+			data:       mailTypedData,
+			version:    typedDataV3,
+			privateKey: cowPrivateKey,
+			hash:       "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2",
+			signature:  "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b915621c",
+		},
+		{
+			name:       "v4",
+			data:       mailTypedData,
+			version:    typedDataV4,
+			privateKey: cowPrivateKey,
+			hash:       "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2",
+			signature:  "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b915621c",
+		},
+		{
+			name:       "v4 with arrays",
+			data:       mailArraysTypedData,
+			version:    typedDataV4,
+			privateKey: cowPrivateKey,
+			hash:       "0xa85c2e2b118698e88db68a8105b794a8cc7cec074e89ef991cb4f5f533819cc2",
+			signature:  "0x65cbd956f2fae28a601bebc9b906cea0191744bd4c4247bcd27cd08f8eb6b71c78efdf7a31dc9abee78f492292721f362d296cf86b4538e07b51303b67f749061b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseTypedData([]byte(tt.data), tt.version)
+			if err != nil {
+				t.Fatalf("failed to parse typed data: %v", err)
+			}
+			if msg.Hash.Hex() != tt.hash {
+				t.Errorf("expected hash %s, got %s", tt.hash, msg.Hash.Hex())
+			}
+
+			privateKey, err := crypto.HexToECDSA(tt.privateKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature, err := signEncodedMessage(msg.Hash, privateKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signature != tt.signature {
+				t.Errorf("expected signature %s, got %s", tt.signature, signature)
+			}
+		})
+	}
+}
+
+func TestTypedDataVersionDifferences(t *testing.T) {
+	// The recipient of the mail is missing
+	missingStruct := strings.Replace(mailTypedData, `"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},`, "", 1)
+	// The name of the sender is missing
+	missingValue := strings.Replace(mailTypedData, `"name": "Cow", `, "", 1)
+	unknownField := strings.Replace(mailTypedData, `"contents": "Hello, Bob!"`, `"contents": "Hello, Bob!", "amount": 1`, 1)
+
+	tests := []struct {
+		name    string
+		data    string
+		version string
+		valid   bool
+	}{
+		{"v3 rejects arrays", mailArraysTypedData, typedDataV3, false},
+		{"v3 skips missing values", missingValue, typedDataV3, true},
+		{"v4 requires missing values", missingValue, typedDataV4, false},
+		{"v3 skips missing structs", missingStruct, typedDataV3, true},
+		{"v4 encodes missing structs as zero", missingStruct, typedDataV4, true},
+		{"v3 rejects unknown fields", unknownField, typedDataV3, false},
+		{"v4 rejects unknown fields", unknownField, typedDataV4, false},
+		{"unknown version", mailTypedData, "v2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTypedData([]byte(tt.data), tt.version)
+			if tt.valid && err != nil {
+				t.Errorf("expected valid typed data, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected invalid typed data")
+			}
+		})
+	}
+}
+
+func TestTypedDataMissingStructs(t *testing.T) {
+	missingStruct := strings.Replace(mailTypedData, `"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},`, "", 1)
+
+	full, err := parseTypedData([]byte(mailTypedData), typedDataV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3, err := parseTypedData([]byte(missingStruct), typedDataV3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, err := parseTypedData([]byte(missingStruct), typedDataV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v4.Hash == full.Hash {
+		t.Error("a missing struct does not change the hash")
+	}
+	// v3 leaves the struct out, v4 encodes it as zero
+	if v3.Hash == v4.Hash {
+		t.Error("v3 and v4 encode a missing struct the same way")
+	}
+}
+
+func TestEthSignRequiresOptIn(t *testing.T) {
+	user := models.NewUser("user@example.com", "User")
+
+	err := checkEthSign(user)
+	var violation *common.PolicyViolation
+	if !errors.As(err, &violation) || violation.Rule != policyRuleEthSign {
+		t.Fatalf("expected a violation of the rule %s, got %v", policyRuleEthSign, err)
+	}
+
+	previous := user.Policy
+	user.Policy.AllowEthSign = true
+	if err = checkEthSign(user); err != nil {
+		t.Errorf("expected eth_sign to be allowed, got %v", err)
+	}
+	if !user.Policy.Loosens(previous) {
+		t.Error("allowing eth_sign does not loosen the policy")
+	}
+}
+
+func TestParseEthSignHash(t *testing.T) {
+	tests := []struct {
+		hash  string
+		valid bool
+	}{
+		{"0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2", true},
+		{"0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957b", false},
+		{"0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd200", false},
+		{"Hello, Bob!", false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseEthSignHash(tt.hash)
+		if tt.valid != (err == nil) {
+			t.Errorf("unexpected result for %s: %v", tt.hash, err)
+		}
+	}
+}
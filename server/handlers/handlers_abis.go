@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/exp/maps"
+	"net/http"
+)
+
+// Uploaded ABIs are stored with the user, so their size is limited
+const maxContractABISize = 256 * 1024
+
+func (a *Api) HandleGetContractABIs() echo.HandlerFunc {
+	type output struct {
+		ABIs []models.ContractABI `json:"abis"`
+	}
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		return c.JSON(http.StatusOK, output{maps.Values(user.ContractABIs)})
+	}
+}
+
+func (a *Api) HandleSaveContractABI() echo.HandlerFunc {
+	type input struct {
+		Chain   string          `param:"chain" validate:"required,hexadecimal"`
+		Address string          `param:"address" validate:"required,ethereum_address"`
+		Name    string          `json:"name" validate:"required,max=64"`
+		ABI     json.RawMessage `json:"abi" validate:"required"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		if _, ok := networks.FindByChainIDHex(in.Chain); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+		if len(in.ABI) > maxContractABISize {
+			return echo.NewHTTPError(http.StatusBadRequest, "ABI is too large")
+		}
+		if _, err := abi.JSON(bytes.NewReader(in.ABI)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "ABI is invalid").SetInternal(err)
+		}
+
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, in.ABI); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "ABI is invalid").SetInternal(err)
+		}
+
+		contract := models.ContractABI{
+			Name:    in.Name,
+			ChainID: in.Chain,
+			Address: in.Address,
+			ABI:     compacted.Bytes(),
+		}
+
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			user.ContractABIs[models.ContractABIKey(in.Chain, in.Address)] = contract
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditContractABISaved, map[string]string{
+			"chain_id": in.Chain,
+			"address":  in.Address,
+			"name":     in.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *Api) HandleRemoveContractABI() echo.HandlerFunc {
+	type input struct {
+		Chain   string `param:"chain" validate:"required,hexadecimal"`
+		Address string `param:"address" validate:"required,ethereum_address"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			key := models.ContractABIKey(in.Chain, in.Address)
+			if _, ok := user.ContractABIs[key]; !ok {
+				return echo.NewHTTPError(http.StatusNotFound, "ABI does not exist")
+			}
+
+			delete(user.ContractABIs, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditContractABIRemoved, map[string]string{
+			"chain_id": in.Chain,
+			"address":  in.Address,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *Api) HandleDecodeCalldata() echo.HandlerFunc {
+	type input struct {
+		ChainID string `json:"chain_id" validate:"required,hexadecimal"`
+		To      string `json:"to" validate:"required,ethereum_address"`
+		Data    string `json:"data" validate:"required"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		data, err := hexutil.Decode(in.Data)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Data is invalid").SetInternal(err)
+		}
+
+		call, err := decodeCalldata(user, in.ChainID, in.To, data)
+		if errors.Is(err, errUnknownMethod) {
+			return echo.NewHTTPError(http.StatusNotFound, "Method is unknown")
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, call)
+	}
+}
+
+func (a *Api) HandleDecodeTypedData() echo.HandlerFunc {
+	type input struct {
+		Data apitypes.TypedData `json:"typed_data" validate:"required"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		return c.JSON(http.StatusOK, decodeTypedData(user, in.Data))
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"time"
+)
+
+func (a *Api) HandleGetApprovals() echo.HandlerFunc {
+	type output struct {
+		Approvals []approvalOutput `json:"approvals"`
+	}
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		now := time.Now().Unix()
+		approvals := make([]approvalOutput, 0, len(user.PendingApprovals))
+		for _, approval := range user.PendingApprovals {
+			if approval.ExpiresAt >= now {
+				approvals = append(approvals, newApprovalOutput(approval))
+			}
+		}
+
+		return c.JSON(http.StatusOK, output{approvals})
+	}
+}
+
+func (a *Api) HandleApproveInitialize() echo.HandlerFunc {
+	type input struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		approval, ok := user.PendingApprovals[in.ID]
+		if !ok || approval.ExpiresAt < time.Now().Unix() {
+			return echo.NewHTTPError(http.StatusNotFound, "Approval does not exist or has expired")
+		}
+
+		options, err := a.loginInitialize(&user, boundSessionKey(ApproveKey, in.ID))
+		if err != nil {
+			return err
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+// HandleApproveFinalize adds the approval of the asserting credential and executes the operation once the quorum is reached
+func (a *Api) HandleApproveFinalize() echo.HandlerFunc {
+	type input struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+	return func(c echo.Context) error {
+		// The body holds the assertion, so only the path parameters are bound
+		var in input
+		if err := (&echo.DefaultBinder{}).BindPathParams(c, &in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		cred, _, err := a.loginFinalize(&user, c.Request(), boundSessionKey(ApproveKey, in.ID))
+		if err != nil {
+			return err
+		}
+
+		return a.addApproval(c, user, in.ID, credentialName(user, cred))
+	}
+}
+
+// addApproval adds the approval of credential and executes the operation once the quorum is reached
+func (a *Api) addApproval(c echo.Context, user models.User, id, credential string) error {
+	now := time.Now()
+	releaseExpiredApprovals(&user, now)
+
+	approval, ok := user.PendingApprovals[id]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Approval does not exist or has expired")
+	}
+
+	if approval.IsApprovedBy(credential) {
+		return echo.NewHTTPError(http.StatusBadRequest, "This credential has already approved the operation")
+	}
+
+	approval.Approvals = append(approval.Approvals, models.Approval{
+		Credential: credential,
+		Timestamp:  now.Unix(),
+	})
+
+	err := a.recordAuditEventWithCredential(models.AuditApprovalGiven, credential, map[string]string{
+		"id":        approval.ID,
+		"operation": approval.Operation,
+		"subject":   approval.Subject,
+	})
+	if err != nil {
+		return err
+	}
+
+	if approval.IsComplete() {
+		delete(user.PendingApprovals, id)
+		return a.executeApproval(c, user, approval)
+	}
+
+	user.PendingApprovals[id] = approval
+	err = a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, newApprovalOutput(approval))
+}
+
+// HandleRejectApproval discards an operation waiting for approval. Rejecting is never riskier than approving,
+// so any session of the user can reject an operation without an assertion.
+func (a *Api) HandleRejectApproval() echo.HandlerFunc {
+	type input struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		approval, ok := user.PendingApprovals[in.ID]
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Approval does not exist or has expired")
+		}
+
+		delete(user.PendingApprovals, in.ID)
+		releaseApproval(&user, approval)
+
+		err := a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditApprovalRejected, map[string]string{
+			"id":        approval.ID,
+			"operation": approval.Operation,
+			"subject":   approval.Subject,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
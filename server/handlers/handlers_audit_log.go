@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func (a *Api) HandleGetAuditLog() echo.HandlerFunc {
+	type input struct {
+		Offset int `query:"offset" validate:"gte=0"`
+		Limit  int `query:"limit" validate:"omitempty,gte=1,lte=100"`
+	}
+	type output struct {
+		Events []models.AuditEvent `json:"events"`
+		Total  int                 `json:"total"`
+		Valid  bool                `json:"valid"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		if in.Limit == 0 {
+			in.Limit = 50
+		}
+
+		// The chain is verified from the event before the page, the first page is verified from the start of the log
+		offset, limit := in.Offset, in.Limit
+		if offset > 0 {
+			offset--
+			limit++
+		}
+
+		events, total, err := a.repo.GetAuditEvents(offset, limit)
+		if err != nil {
+			return err
+		}
+
+		var previous *models.AuditEvent
+		if in.Offset > 0 && len(events) > 0 {
+			previous = &events[0]
+			events = events[1:]
+		}
+
+		return c.JSON(http.StatusOK, output{
+			Events: events,
+			Total:  total,
+			Valid:  a.verifyAuditEvents(events, previous),
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (a *Api) HandleExportBackup() echo.HandlerFunc {
+	type input struct {
+		Passphrase    string `json:"passphrase" validate:"required_without=PasskeySecret,omitempty,min=12"`
+		PasskeySecret []byte `json:"passkey_secret" validate:"required_without=Passphrase,omitempty,min=32"`
+	}
+	type output struct {
+		Backup backupArchive `json:"backup"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		// Ongoing ceremonies and the OTP are bound to this enclave and must not be restored elsewhere
+		user.ResetCeremonies()
+		user.OTP = models.OTP{}
+
+		kdf, secret := backupSecret(in.Passphrase, in.PasskeySecret)
+		archive, err := sealBackup(backupContent{
+			User:       user,
+			SigningKey: a.signingKey,
+			CreatedAt:  time.Now().Unix(),
+		}, kdf, secret)
+		if err != nil {
+			return fmt.Errorf("failed to create backup: %w", err)
+		}
+
+		err = a.recordAuditEvent(c, models.AuditBackupExport, map[string]string{
+			"kdf": kdf,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{archive})
+	}
+}
+
+// HandleRegisterRestore imports a backup instead of finalizing the registration.
+// The user logs in with the passkeys contained in the backup afterwards.
+// The restored signing key is used after the next restart of the enclave.
+func (a *Api) HandleRegisterRestore() echo.HandlerFunc {
+	type input struct {
+		Backup        backupArchive `json:"backup" validate:"required"`
+		Passphrase    string        `json:"passphrase" validate:"required_without=PasskeySecret"`
+		PasskeySecret []byte        `json:"passkey_secret" validate:"required_without=Passphrase"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user, err := a.repo.GetUser()
+		if errors.Is(err, common.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Registration must be initialized beforehand")
+		} else if err != nil {
+			return err
+		}
+
+		if len(user.WebauthnData.Credentials) > 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "User is already registered")
+		}
+		if _, ok := user.WebauthnData.Sessions[RegistrationKey]; !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Registration must be initialized beforehand")
+		}
+
+		kdf, secret := backupSecret(in.Passphrase, in.PasskeySecret)
+		if in.Backup.KDF != kdf {
+			return echo.NewHTTPError(http.StatusBadRequest, "The provided secret does not match the backup")
+		}
+
+		content, err := openBackup(in.Backup, secret)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+		}
+
+		if !strings.EqualFold(content.User.Email, user.Email) {
+			return echo.NewHTTPError(http.StatusBadRequest, "The backup belongs to a different account")
+		}
+
+		restored := content.User
+		restored.Version = user.Version
+		restored.ResetCeremonies()
+		restored.OTP = models.OTP{}
+
+		// The log is hashed with the restored key below
+		signingKey := content.SigningKey
+		signingKey.AuditLogKeyed = true
+
+		err = a.repo.SaveSigningKey(signingKey)
+		if err != nil {
+			return err
+		}
+
+		// The audit key is derived from the signing key, so the log has to be hashed with the restored one
+		err = a.rekeyAuditLog(signingKey)
+		if err != nil {
+			a.rollbackRestore(false)
+			return err
+		}
+
+		err = a.repo.UpsertUser(restored)
+		if err != nil {
+			a.rollbackRestore(true)
+			return err
+		}
+
+		a.recordCompletedAuditEvent(c, models.AuditBackupRestore, map[string]string{
+			"created_at": strconv.FormatInt(content.CreatedAt, 10),
+		})
+
+		log.Info().Caller().Msg("restored backup, the restored signing key will be used after the next restart")
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// rollbackRestore stores the signing key of the enclave again and hashes the audit log with it if rekeyed,
+// so a restore that failed half way can be repeated
+func (a *Api) rollbackRestore(rekeyed bool) {
+	if rekeyed {
+		err := a.rekeyAuditLog(a.signingKey)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to hash the audit log with the signing key of the enclave again")
+		}
+	}
+
+	err := a.repo.SaveSigningKey(a.signingKey)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to store the signing key of the enclave again")
+	}
+}
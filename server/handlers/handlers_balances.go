@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+var tokens = models.Tokens{
+	fmt.Sprintf("0x%x", 1): {
+		{Symbol: "USDC", Address: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", Decimals: 6},
+		{Symbol: "USDT", Address: "0xdAC17F958D2ee523a2206206994597C13D831ec7", Decimals: 6},
+		{Symbol: "DAI", Address: "0x6B175474E89094C44Da98b954EedeAC495271d0F", Decimals: 18},
+		{Symbol: "WETH", Address: "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2", Decimals: 18},
+	},
+	fmt.Sprintf("0x%x", 137): {
+		{Symbol: "USDC", Address: "0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174", Decimals: 6},
+		{Symbol: "USDT", Address: "0xc2132D05D31c914a87C6611C10748AEb04B58e8F", Decimals: 6},
+		{Symbol: "DAI", Address: "0x8f3Cf7ad23Cd3CaDbD9735AFf958023239c6A063", Decimals: 18},
+	},
+	fmt.Sprintf("0x%x", 43114): {
+		{Symbol: "USDC", Address: "0xB97EF9Ef8734C71904D8002F8b6Bc66Dd9c48a6E", Decimals: 6},
+	},
+	fmt.Sprintf("0x%x", 42161): {
+		{Symbol: "USDC", Address: "0xaf88d065e77c8cC2239327C5EDb3A432268e5831", Decimals: 6},
+		{Symbol: "USDT", Address: "0xFd086bC7CD5C481DCC9C85ebE478A1C0b69FCbb9", Decimals: 6},
+	},
+	fmt.Sprintf("0x%x", 56): {
+		{Symbol: "USDT", Address: "0x55d398326f99059fF775485246999027B3197955", Decimals: 18},
+		{Symbol: "BUSD", Address: "0xe9e7CEA3DedcA5984780Bafc599bD69ADd087D56", Decimals: 18},
+	},
+}
+
+func (a *Api) HandleGetBalances() echo.HandlerFunc {
+	type input struct {
+		Chain           string `query:"chain" validate:"omitempty,hexadecimal"`
+		IncludeArchived bool   `query:"include_archived"`
+	}
+	type output struct {
+		Wallets []walletBalances `json:"wallets"`
+		// Partial is set if at least one balance could not be fetched
+		Partial bool `json:"partial"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		selectedNetworks := networks
+		if in.Chain != "" {
+			network, ok := networks.FindByChainIDHex(in.Chain)
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+			}
+			selectedNetworks = models.Networks{network}
+		}
+
+		wallets := make(models.Wallets, 0, len(user.Wallets))
+		for _, wallet := range user.Wallets {
+			if !wallet.Archived || in.IncludeArchived {
+				wallets = append(wallets, wallet)
+			}
+		}
+
+		balances := fetchBalances(c.Request().Context(), wallets, selectedNetworks, tokens)
+
+		partial := false
+		for _, wallet := range balances {
+			for _, network := range wallet.Networks {
+				if network.Error != "" {
+					partial = true
+				}
+				for _, token := range network.Tokens {
+					if token.Error != "" {
+						partial = true
+					}
+				}
+			}
+		}
+
+		return c.JSON(http.StatusOK, output{
+			Wallets: balances,
+			Partial: partial,
+		})
+	}
+}
@@ -43,31 +43,38 @@ func (a *Api) HandleCreateCredentialFinalize() echo.HandlerFunc {
 			return err
 		}
 
-		user := c.Get("user").(models.User)
-
-		_, ok := user.WebauthnData.Credentials[in.CredentialName]
-		if ok {
-			return echo.NewHTTPError(http.StatusBadRequest, "A credential with this name already exists")
-		}
-
-		session, ok := user.WebauthnData.Sessions[AddCredentialKey]
-		if !ok {
-			return echo.NewHTTPError(http.StatusBadRequest, "CreateCredential must be initialized beforehand")
-		}
-		delete(user.WebauthnData.Sessions, AddCredentialKey)
-
 		ccr, err := in.CreationResponse.Parse()
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
 
-		cred, err := a.w.CreateCredential(user.WebauthnData, session, ccr)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			_, ok := user.WebauthnData.Credentials[in.CredentialName]
+			if ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "A credential with this name already exists")
+			}
+
+			session, ok := user.WebauthnData.Sessions[AddCredentialKey]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "CreateCredential must be initialized beforehand")
+			}
+			delete(user.WebauthnData.Sessions, AddCredentialKey)
+
+			cred, err := a.w.CreateCredential(user.WebauthnData, session, ccr)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+
+			user.WebauthnData.Credentials[in.CredentialName] = *cred
+			return nil
+		})
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			return err
 		}
 
-		user.WebauthnData.Credentials[in.CredentialName] = *cred
-		err = a.repo.UpsertUser(user)
+		err = a.recordAuditEvent(c, models.AuditCredentialAdded, map[string]string{
+			"name": in.CredentialName,
+		})
 		if err != nil {
 			return err
 		}
@@ -89,26 +96,65 @@ func (a *Api) HandleRemoveCredential() echo.HandlerFunc {
 			return err
 		}
 
-		claims := c.Get("claims").(common.EnclaveClaims)
 		user := c.Get("user").(models.User)
 
-		_, ok := user.WebauthnData.Credentials[in.CredentialName]
-		if !ok {
-			return echo.NewHTTPError(http.StatusNotFound)
+		err := checkCredentialRemoval(c, user, in.CredentialName)
+		if err != nil {
+			return err
 		}
 
-		if claims.Credential == in.CredentialName {
-			return echo.NewHTTPError(http.StatusBadRequest, "You cannot delete the credential you are currently logged in with")
-		}
-		delete(user.WebauthnData.Credentials, in.CredentialName)
+		if required := requiredApprovals(user.Policy, models.OperationCredentialRemoval); required > 1 {
+			approval, err := newPendingApproval(models.OperationCredentialRemoval, in.CredentialName, required, "")
+			if err != nil {
+				return err
+			}
 
-		err := a.repo.UpsertUser(user)
-		if err != nil {
-			return err
+			return a.requestApproval(c, user, approval)
 		}
 
-		return c.NoContent(http.StatusOK)
+		return a.removeCredential(c, user, in.CredentialName)
+	}
+}
+
+func (a *Api) removeCredential(c echo.Context, user models.User, name string) error {
+	err := checkCredentialRemoval(c, user, name)
+	if err != nil {
+		return err
+	}
+
+	delete(user.WebauthnData.Credentials, name)
+	err = a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = a.recordAuditEvent(c, models.AuditCredentialRemoved, map[string]string{
+		"name": name,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// checkCredentialRemoval refuses to remove the credential of the current session
+// and credentials needed to reach the quorum of the policy
+func checkCredentialRemoval(c echo.Context, user models.User, name string) error {
+	claims := c.Get("claims").(common.EnclaveClaims)
+
+	if claims.Credential == name {
+		return echo.NewHTTPError(http.StatusBadRequest, "You cannot delete the credential you are currently logged in with")
+	}
+
+	if _, ok := user.WebauthnData.Credentials[name]; !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
 	}
+	if len(user.WebauthnData.Credentials)-1 < user.Policy.RequiredCredentials() {
+		return echo.NewHTTPError(http.StatusBadRequest, "The remaining credentials could not approve the operations of your policy")
+	}
+
+	return nil
 }
 
 func (a *Api) HandleGetCredentials() echo.HandlerFunc {
@@ -6,20 +6,29 @@ import (
 	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 func (a *Api) HandleEmergencyAccessGrantInvitation() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		user := c.Get("user").(models.User)
 		claims := c.Get("claims").(common.EnclaveClaims)
 		enclaveURL := c.Get("enclave_url").(string)
 
-		user.EmergencyAccessGrants[claims.Subject] = &models.EmergencyAccessGrant{
-			Email:      claims.Subject,
-			EnclaveURL: enclaveURL,
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			user.EmergencyAccessGrants[claims.Subject] = &models.EmergencyAccessGrant{
+				Email:      claims.Subject,
+				EnclaveURL: enclaveURL,
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		err := a.repo.UpsertUser(user)
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantReceived, map[string]string{
+			"grantor": claims.Subject,
+		})
 		if err != nil {
 			return err
 		}
@@ -83,12 +92,27 @@ func (a *Api) HandleRespondEmergencyAccessGrantInvitation() echo.HandlerFunc {
 			return err
 		}
 
-		if in.Accept {
-			data.HasAccepted = true
-		} else {
-			delete(user.EmergencyAccessGrants, in.GrantorEmail)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessGrants[in.GrantorEmail]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+
+			if in.Accept {
+				data.HasAccepted = true
+			} else {
+				delete(user.EmergencyAccessGrants, in.GrantorEmail)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		err = a.repo.UpsertUser(user)
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantResponse, map[string]string{
+			"grantor":  in.GrantorEmail,
+			"accepted": strconv.FormatBool(in.Accept),
+		})
 		if err != nil {
 			return err
 		}
@@ -151,10 +175,25 @@ func (a *Api) HandleRequestEmergencyAccess() echo.HandlerFunc {
 			return err
 		}
 
-		data.HasRequestedTakeover = true
-		data.TakeoverAllowedAfter = takeoverAllowedAfter
-		data.NotificationSeriesID = seriesID
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessGrants[in.GrantorEmail]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+
+			data.HasRequestedTakeover = true
+			data.TakeoverAllowedAfter = takeoverAllowedAfter
+			data.NotificationSeriesID = seriesID
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantRequested, map[string]string{
+			"grantor":                in.GrantorEmail,
+			"takeover_allowed_after": strconv.FormatInt(takeoverAllowedAfter, 10),
+		})
 		if err != nil {
 			return err
 		}
@@ -192,8 +231,17 @@ func (a *Api) HandleEmergencyAccessGrantRemoval() echo.HandlerFunc {
 			}
 		}
 
-		delete(user.EmergencyAccessGrants, claims.Subject)
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			delete(user.EmergencyAccessGrants, claims.Subject)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantRemoved, map[string]string{
+			"grantor": claims.Subject,
+		})
 		if err != nil {
 			return err
 		}
@@ -233,10 +281,24 @@ func (a *Api) HandleEmergencyAccessRequestDenial() echo.HandlerFunc {
 			return err
 		}
 
-		data.HasRequestedTakeover = false
-		data.TakeoverAllowedAfter = 0
-		data.NotificationSeriesID = ""
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessGrants[claims.Subject]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+
+			data.HasRequestedTakeover = false
+			data.TakeoverAllowedAfter = 0
+			data.NotificationSeriesID = ""
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantDenied, map[string]string{
+			"grantor": claims.Subject,
+		})
 		if err != nil {
 			return err
 		}
@@ -280,20 +342,31 @@ func (a *Api) HandleRequestEmergencyAccessTakeover() echo.HandlerFunc {
 			return err
 		}
 
-		for _, wallet := range wallets {
-			wallet.Public = false
-			wallet.Name = fmt.Sprintf("%s (%s)", wallet.Name, in.GrantorEmail)
-			user.Wallets = append(user.Wallets, wallet)
-		}
-
 		backendApiClient, _ := common.NewBackendApiClient(a.cfg.BackendURL, models.User{}, nil)
 		err = backendApiClient.DeleteUser(enclaveJWT)
 		if err != nil {
 			return fmt.Errorf("failed to delete enclave of emergency access grantor: %w", err)
 		}
 
-		delete(user.EmergencyAccessGrants, in.GrantorEmail)
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			for _, wallet := range wallets {
+				wallet.Public = false
+				wallet.Name = fmt.Sprintf("%s (%s)", wallet.Name, in.GrantorEmail)
+				wallet.DerivationPath = "" // The wallet was derived from the seed of the grantor
+				user.Wallets = append(user.Wallets, wallet)
+			}
+
+			delete(user.EmergencyAccessGrants, in.GrantorEmail)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyGrantTakeover, map[string]string{
+			"grantor": in.GrantorEmail,
+			"wallets": strconv.Itoa(len(wallets)),
+		})
 		if err != nil {
 			return err
 		}
@@ -7,7 +7,9 @@ import (
 	"github.com/Leantar/elonwallet-function/models"
 	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -54,12 +56,26 @@ func (a *Api) HandleCreateEmergencyContact() echo.HandlerFunc {
 			return err
 		}
 
-		user.EmergencyAccessContacts[in.Email] = &models.EmergencyAccessContact{
-			Email:               in.Email,
-			EnclaveURL:          enclaveURL,
-			WaitingPeriodInDays: in.WaitingPeriodInDays,
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			if _, ok := user.EmergencyAccessContacts[in.Email]; ok {
+				return echo.NewHTTPError(http.StatusConflict, "Contact already exists")
+			}
+
+			user.EmergencyAccessContacts[in.Email] = &models.EmergencyAccessContact{
+				Email:               in.Email,
+				EnclaveURL:          enclaveURL,
+				WaitingPeriodInDays: in.WaitingPeriodInDays,
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		err = a.repo.UpsertUser(user)
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyContactAdded, map[string]string{
+			"contact":                in.Email,
+			"waiting_period_in_days": strconv.FormatUint(in.WaitingPeriodInDays, 10),
+		})
 		if err != nil {
 			return err
 		}
@@ -103,41 +119,67 @@ func (a *Api) HandleRemoveEmergencyContact() echo.HandlerFunc {
 
 		user := c.Get("user").(models.User)
 
-		data, ok := user.EmergencyAccessContacts[in.Email]
-		if !ok {
+		if _, ok := user.EmergencyAccessContacts[in.Email]; !ok {
 			return echo.NewHTTPError(http.StatusNotFound)
 		}
 
-		enclaveApiClient, err := common.NewEnclaveApiClient(data.EnclaveURL, user, a.signingKey.PrivateKey)
-		if err != nil {
-			return fmt.Errorf("failed to create enclave api client: %w", err)
-		}
+		if required := requiredApprovals(user.Policy, models.OperationEmergencyContactRemoval); required > 1 {
+			approval, err := newPendingApproval(models.OperationEmergencyContactRemoval, in.Email, required, "")
+			if err != nil {
+				return err
+			}
 
-		err = enclaveApiClient.RemoveEmergencyAccessGrant()
-		if err != nil {
-			return fmt.Errorf("failed to remove emergency access grant: %w", err)
+			return a.requestApproval(c, user, approval)
 		}
 
-		if data.HasRequestedTakeover && data.NotificationSeriesID != "" {
-			backendApiClient, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
-			if err != nil {
-				return fmt.Errorf("failed to create backend api client: %w", err)
-			}
+		return a.removeEmergencyContact(c, user, a.latestUser, in.Email)
+	}
+}
 
-			err = backendApiClient.DeleteNotificationSeries(data.NotificationSeriesID)
-			if err != nil {
-				return fmt.Errorf("failed to delete scheduled notifications: %w", err)
-			}
+func (a *Api) removeEmergencyContact(c echo.Context, user models.User, update userUpdate, email string) error {
+	data, ok := user.EmergencyAccessContacts[email]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	enclaveApiClient, err := common.NewEnclaveApiClient(data.EnclaveURL, user, a.signingKey.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create enclave api client: %w", err)
+	}
+
+	err = enclaveApiClient.RemoveEmergencyAccessGrant()
+	if err != nil {
+		return fmt.Errorf("failed to remove emergency access grant: %w", err)
+	}
+
+	if data.HasRequestedTakeover && data.NotificationSeriesID != "" {
+		backendApiClient, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("failed to create backend api client: %w", err)
 		}
 
-		delete(user.EmergencyAccessContacts, in.Email)
-		err = a.repo.UpsertUser(user)
+		err = backendApiClient.DeleteNotificationSeries(data.NotificationSeriesID)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to delete scheduled notifications: %w", err)
 		}
+	}
 
-		return c.NoContent(http.StatusOK)
+	_, err = update(func(user *models.User) error {
+		delete(user.EmergencyAccessContacts, email)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	err = a.recordAuditEvent(c, models.AuditEmergencyContactRemoved, map[string]string{
+		"contact": email,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
 }
 
 func (a *Api) HandleDenyEmergencyContactAccessRequest() echo.HandlerFunc {
@@ -180,9 +222,23 @@ func (a *Api) HandleDenyEmergencyContactAccessRequest() echo.HandlerFunc {
 			return fmt.Errorf("failed to delete scheduled notifications: %w", err)
 		}
 
-		data.HasRequestedTakeover = false
-		data.TakeoverAllowedAfter = 0
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessContacts[in.Email]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+
+			data.HasRequestedTakeover = false
+			data.TakeoverAllowedAfter = 0
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyAccessDenied, map[string]string{
+			"contact": in.Email,
+		})
 		if err != nil {
 			return err
 		}
@@ -204,25 +260,33 @@ func (a *Api) HandleEmergencyAccessGrantResponse() echo.HandlerFunc {
 			return err
 		}
 
-		user := c.Get("user").(models.User)
 		claims := c.Get("claims").(common.EnclaveClaims)
 
-		data, ok := user.EmergencyAccessContacts[claims.Subject]
-		if !ok {
-			return echo.NewHTTPError(http.StatusNotFound)
-		}
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessContacts[claims.Subject]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
 
-		if data.HasAccepted {
-			return echo.NewHTTPError(http.StatusBadRequest, "Invitation has already been accepted")
-		}
+			if data.HasAccepted {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invitation has already been accepted")
+			}
 
-		if in.Accept {
-			data.HasAccepted = true
-		} else {
-			delete(user.EmergencyAccessContacts, claims.Subject)
+			if in.Accept {
+				data.HasAccepted = true
+			} else {
+				delete(user.EmergencyAccessContacts, claims.Subject)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		err := a.repo.UpsertUser(user)
+		err = a.recordAuditEvent(c, models.AuditEmergencyContactResponse, map[string]string{
+			"contact":  claims.Subject,
+			"accepted": strconv.FormatBool(in.Accept),
+		})
 		if err != nil {
 			return err
 		}
@@ -250,27 +314,54 @@ func (a *Api) HandleEmergencyContactAccessRequest() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusBadRequest, "Takeover has already been requested")
 		}
 
-		data.HasRequestedTakeover = true
-		data.TakeoverAllowedAfter = time.Now().Add(time.Duration(data.WaitingPeriodInDays) * 24 * time.Hour).Unix()
+		takeoverAllowedAfter := time.Now().Add(time.Duration(data.WaitingPeriodInDays) * 24 * time.Hour).Unix()
 
 		backendApiClient, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
 		if err != nil {
 			return fmt.Errorf("failed to create backend api client: %w", err)
 		}
 
-		notifications := createScheduledNotifications(data.WaitingPeriodInDays, claims.Subject, data.TakeoverAllowedAfter)
+		notifications := createScheduledNotifications(data.WaitingPeriodInDays, claims.Subject, takeoverAllowedAfter)
 		seriesID, err := backendApiClient.ScheduleNotificationSeries(notifications)
 		if err != nil {
 			return err
 		}
 
-		data.NotificationSeriesID = seriesID
-		err = a.repo.UpsertUser(user)
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			data, ok := user.EmergencyAccessContacts[claims.Subject]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound)
+			}
+
+			if !data.HasAccepted {
+				return echo.NewHTTPError(http.StatusBadRequest, "You must accept the invitation first")
+			} else if data.HasRequestedTakeover {
+				return echo.NewHTTPError(http.StatusBadRequest, "Takeover has already been requested")
+			}
+
+			data.HasRequestedTakeover = true
+			data.TakeoverAllowedAfter = takeoverAllowedAfter
+			data.NotificationSeriesID = seriesID
+			return nil
+		})
+		if err != nil {
+			// The notifications must not outlive a request that was never stored
+			deleteErr := backendApiClient.DeleteNotificationSeries(seriesID)
+			if deleteErr != nil {
+				log.Error().Caller().Err(deleteErr).Msg("failed to delete scheduled notifications")
+			}
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditEmergencyAccessRequested, map[string]string{
+			"contact":                claims.Subject,
+			"takeover_allowed_after": strconv.FormatInt(takeoverAllowedAfter, 10),
+		})
 		if err != nil {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, output{data.TakeoverAllowedAfter})
+		return c.JSON(http.StatusOK, output{takeoverAllowedAfter})
 	}
 }
 
@@ -309,6 +400,13 @@ func (a *Api) HandleEmergencyContactTakeoverRequest() echo.HandlerFunc {
 			return fmt.Errorf("failed to create jwt: %w", err)
 		}
 
+		err = a.recordAuditEvent(c, models.AuditEmergencyTakeover, map[string]string{
+			"contact": claims.Subject,
+		})
+		if err != nil {
+			return err
+		}
+
 		return c.JSON(http.StatusOK, output{
 			Wallets: user.Wallets,
 			JWT:     jwt,
@@ -380,6 +478,9 @@ func removeEmergencyContacts(user models.User, subject string, repo common.Repos
 		}
 	}
 
-	user.EmergencyAccessContacts = make(map[string]*models.EmergencyAccessContact, 0)
-	return repo.UpsertUser(user)
+	_, err := common.UpdateUser(repo, func(user *models.User) error {
+		user.EmergencyAccessContacts = make(map[string]*models.EmergencyAccessContact, 0)
+		return nil
+	})
+	return err
 }
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func (a *Api) HandleRevealMnemonicInitialize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		if user.HDSeed != nil && user.HDSeed.Revealed {
+			return echo.NewHTTPError(http.StatusBadRequest, "The mnemonic has already been revealed")
+		}
+
+		options, _, err := a.initializeCeremony(RevealMnemonicKey, nil)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+func (a *Api) HandleRevealMnemonicFinalize() echo.HandlerFunc {
+	type output struct {
+		Mnemonic       string `json:"mnemonic"`
+		DerivationPath string `json:"derivation_path"`
+	}
+	return func(c echo.Context) error {
+		user, err := a.finalizeCeremony(c.Request(), RevealMnemonicKey, func(user *models.User, _ *webauthn.Credential, _ *webauthn.SessionData) error {
+			if user.HDSeed != nil && user.HDSeed.Revealed {
+				return echo.NewHTTPError(http.StatusBadRequest, "The mnemonic has already been revealed")
+			}
+
+			err := user.EnsureHDSeed()
+			if err != nil {
+				return err
+			}
+			user.HDSeed.Revealed = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The mnemonic can only be revealed once, so it is returned even if the event can not be recorded
+		a.recordCompletedAuditEvent(c, models.AuditMnemonicRevealed, nil)
+
+		return c.JSON(http.StatusOK, output{
+			Mnemonic:       user.HDSeed.Mnemonic,
+			DerivationPath: models.BaseDerivationPath,
+		})
+	}
+}
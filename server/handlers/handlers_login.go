@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
@@ -14,17 +13,7 @@ import (
 
 func (a *Api) HandleLoginInitialize() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		user, err := a.repo.GetUser()
-		if err != nil {
-			return err
-		}
-
-		options, err := a.loginInitialize(&user, LoginKey)
-		if err != nil {
-			return err
-		}
-
-		err = a.repo.UpsertUser(user)
+		options, _, err := a.initializeCeremony(LoginKey, nil)
 		if err != nil {
 			return err
 		}
@@ -38,17 +27,16 @@ func (a *Api) HandleLoginFinalize() echo.HandlerFunc {
 		BackendJWT string `json:"backend_jwt"`
 	}
 	return func(c echo.Context) error {
-		user, err := a.repo.GetUser()
+		var cred *webauthn.Credential
+		user, err := a.finalizeCeremony(c.Request(), LoginKey, func(_ *models.User, credential *webauthn.Credential, _ *webauthn.SessionData) error {
+			cred = credential
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
-		cred, _, err := a.loginFinalize(&user, c.Request(), LoginKey)
-		if err != nil {
-			return err
-		}
-
-		err = a.repo.UpsertUser(user)
+		err = a.recordAuditEventWithCredential(models.AuditLogin, credentialName(user, cred), nil)
 		if err != nil {
 			return err
 		}
@@ -71,15 +59,7 @@ func (a *Api) HandleLoginFinalize() echo.HandlerFunc {
 }
 
 func createSessionCookie(user models.User, currentCredential *webauthn.Credential, sk ed25519.PrivateKey) (*http.Cookie, error) {
-	var currentCredentialName string
-	for name, credential := range user.WebauthnData.Credentials {
-		if bytes.Equal(credential.ID, currentCredential.ID) {
-			currentCredentialName = name
-			break
-		}
-	}
-
-	jwt, err := common.CreateEnclaveJWT(user, common.ScopeUser, currentCredentialName, sk)
+	jwt, err := common.CreateEnclaveJWT(user, common.ScopeUser, credentialName(user, currentCredential), sk)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create jwt: %w", err)
 	}
@@ -1,22 +1,67 @@
 package handlers
 
 import (
+	"encoding/json"
 	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"time"
 )
 
-func (a *Api) HandleSignPersonal() echo.HandlerFunc {
+// HandlePreviewPersonal shows what signing a message means before the user approves it.
+// Sign-In with Ethereum messages are parsed and validated like they are before signing.
+func (a *Api) HandlePreviewPersonal() echo.HandlerFunc {
 	type input struct {
 		Message string `json:"message" validate:"required"`
 		From    string `json:"from" validate:"required,ethereum_address"`
+		Origin  string `json:"origin" validate:"omitempty,url"` //Site that requested the signature, the origin of the request if empty
 	}
 
 	type output struct {
-		Signature string `json:"signature"`
+		MessageHash string       `json:"message_hash"`
+		SignIn      *siweMessage `json:"sign_in"` //Nil if the message is not a Sign-In with Ethereum message
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if _, ok := user.Wallets.FindByAddress(in.From); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		signIn, err := checkSignIn(user, in.Message, in.From, requestingOrigin(c, in.Origin), time.Now())
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			MessageHash: crypto.Keccak256Hash([]byte(in.Message)).Hex(),
+			SignIn:      signIn,
+		})
+	}
+}
+
+// HandleSignPersonal signs a message right away if the policy exempts it from the webauthn ceremony
+func (a *Api) HandleSignPersonal() echo.HandlerFunc {
+	type input struct {
+		Message string `json:"message" validate:"required"`
+		From    string `json:"from" validate:"required,ethereum_address"`
+		Origin  string `json:"origin" validate:"omitempty,url"` //Site that requested the signature, the origin of the request if empty
 	}
 	return func(c echo.Context) error {
 		var in input
@@ -34,29 +79,157 @@ func (a *Api) HandleSignPersonal() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
 		}
 
-		privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+		if user.Policy.RequiresSignatureCeremony(wallet.Address, models.SignatureTypePersonal, "") {
+			return &common.PolicyViolation{
+				Rule:    policyRuleSignatureCeremony,
+				Message: "Signing this message has to be confirmed with a passkey, use /message/sign/initialize",
+			}
+		}
+
+		signIn, err := checkSignIn(user, in.Message, in.From, requestingOrigin(c, in.Origin), time.Now())
 		if err != nil {
-			log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+			return err
+		}
+
+		return a.signMessage(c, wallet, in.Message, signIn)
+	}
+}
+
+func (a *Api) HandleSignPersonalInitialize() echo.HandlerFunc {
+	type input struct {
+		Message string `json:"message" validate:"required"`
+		From    string `json:"from" validate:"required,ethereum_address"`
+		Origin  string `json:"origin" validate:"omitempty,url"` //Site that requested the signature, the origin of the request if empty
+	}
+	type output struct {
+		*protocol.CredentialAssertion
+		MessageHash string       `json:"message_hash"`
+		SignIn      *siweMessage `json:"sign_in"` //Nil if the message is not a Sign-In with Ethereum message
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
 		}
 
-		signature, err := signPersonal(in.Message, privateKey)
+		user := c.Get("user").(models.User)
+
+		if _, ok := user.Wallets.FindByAddress(in.From); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		origin := requestingOrigin(c, in.Origin)
+		signIn, err := checkSignIn(user, in.Message, in.From, origin, time.Now())
 		if err != nil {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, output{signature})
+		options, _, err := a.initializeCeremony(SignMessageKey, func(user *models.User, challenge string) error {
+			user.WebauthnData.PendingSignatures[challenge] = models.PendingSignature{
+				Type:    models.SignatureTypePersonal,
+				From:    in.From,
+				Message: in.Message,
+				Origin:  origin,
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			MessageHash:         crypto.Keccak256Hash([]byte(in.Message)).Hex(),
+			SignIn:              signIn,
+		})
 	}
 }
 
+func (a *Api) HandleSignPersonalFinalize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, pending, err := a.signatureFinalize(c.Request(), SignMessageKey)
+		if err != nil {
+			return err
+		}
+
+		wallet, ok := user.Wallets.FindByAddress(pending.From)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		// Validated again, because the message might have expired during the ceremony
+		signIn, err := checkSignIn(user, pending.Message, pending.From, pending.Origin, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return a.signMessage(c, wallet, pending.Message, signIn)
+	}
+}
+
+// HandleSignTypedData signs typed data right away if the policy exempts it from the webauthn ceremony
 func (a *Api) HandleSignTypedData() echo.HandlerFunc {
 	type input struct {
-		Data apitypes.TypedData `json:"typed_data" validate:"required"`
-		From string             `json:"from" validate:"required,ethereum_address"`
+		Data    json.RawMessage `json:"typed_data" validate:"required"`
+		Version string          `json:"version" validate:"omitempty,oneof=v1 v3 v4"` //v4 if empty
+		From    string          `json:"from" validate:"required,ethereum_address"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		wallet, ok := user.Wallets.FindByAddress(in.From)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		msg, err := parseTypedData(in.Data, typedDataVersion(in.Version))
+		if err != nil {
+			return err
+		}
+
+		analysis := analyzeTypedMessage(user, msg, time.Now())
+		err = evaluateTypedDataPolicy(user, analysis)
+		if err != nil {
+			return err
+		}
+
+		// Typed data that can move assets is never exempt, because a stolen session could sign it otherwise
+		if analysis.IsHighRisk() || user.Policy.RequiresSignatureCeremony(wallet.Address, models.SignatureTypeTypedData, msg.Data.PrimaryType) {
+			return &common.PolicyViolation{
+				Rule:    policyRuleSignatureCeremony,
+				Message: "Signing this typed data has to be confirmed with a passkey, use /typed-data/sign/initialize",
+			}
+		}
+
+		return a.signTypedMessage(c, wallet, msg, analysis)
 	}
+}
 
+func (a *Api) HandleSignTypedDataInitialize() echo.HandlerFunc {
+	type input struct {
+		Data    json.RawMessage `json:"typed_data" validate:"required"`
+		Version string          `json:"version" validate:"omitempty,oneof=v1 v3 v4"` //v4 if empty
+		From    string          `json:"from" validate:"required,ethereum_address"`
+	}
 	type output struct {
-		Signature string `json:"signature"`
+		*protocol.CredentialAssertion
+		Version     string                   `json:"version"`
+		PrimaryType string                   `json:"primary_type"`
+		Domain      apitypes.TypedDataDomain `json:"domain"`
+		Fields      []legacyTypedDataField   `json:"fields,omitempty"` //Only set for v1, which has no primary type and domain
+		Hash        string                   `json:"hash"`
+		Analysis    typedDataAnalysis        `json:"analysis"`
 	}
 	return func(c echo.Context) error {
 		var in input
@@ -69,21 +242,281 @@ func (a *Api) HandleSignTypedData() echo.HandlerFunc {
 
 		user := c.Get("user").(models.User)
 
-		wallet, ok := user.Wallets.FindByAddress(in.From)
+		if _, ok := user.Wallets.FindByAddress(in.From); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		msg, err := parseTypedData(in.Data, typedDataVersion(in.Version))
+		if err != nil {
+			return err
+		}
+
+		analysis := analyzeTypedMessage(user, msg, time.Now())
+		err = evaluateTypedDataPolicy(user, analysis)
+		if err != nil {
+			return err
+		}
+
+		options, _, err := a.initializeCeremony(SignTypedDataKey, func(user *models.User, challenge string) error {
+			user.WebauthnData.PendingSignatures[challenge] = models.PendingSignature{
+				Type:      models.SignatureTypeTypedData,
+				From:      in.From,
+				TypedData: in.Data,
+				Version:   msg.Version,
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			Version:             msg.Version,
+			PrimaryType:         msg.Data.PrimaryType,
+			Domain:              msg.Data.Domain,
+			Fields:              msg.Legacy,
+			Hash:                msg.Hash.Hex(),
+			Analysis:            analysis,
+		})
+	}
+}
+
+func (a *Api) HandleSignTypedDataFinalize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, pending, err := a.signatureFinalize(c.Request(), SignTypedDataKey)
+		if err != nil {
+			return err
+		}
+
+		wallet, ok := user.Wallets.FindByAddress(pending.From)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		msg, err := parseTypedData(pending.TypedData, pending.Version)
+		if err != nil {
+			return err
+		}
+
+		// The policy might have changed since the ceremony has been initialized
+		analysis := analyzeTypedMessage(user, msg, time.Now())
+		err = evaluateTypedDataPolicy(user, analysis)
+		if err != nil {
+			return err
+		}
+
+		return a.signTypedMessage(c, wallet, msg, analysis)
+	}
+}
+
+// HandleEthSignInitialize starts the ceremony for eth_sign. The hash can not be inspected, it might as well be the hash of a
+// transaction, so eth_sign has to be allowed by the policy and is never exempt from the ceremony.
+func (a *Api) HandleEthSignInitialize() echo.HandlerFunc {
+	type input struct {
+		Hash string `json:"hash" validate:"required"`
+		From string `json:"from" validate:"required,ethereum_address"`
+	}
+	type output struct {
+		*protocol.CredentialAssertion
+		Hash string `json:"hash"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if _, ok := user.Wallets.FindByAddress(in.From); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
+		}
+
+		hash, err := parseEthSignHash(in.Hash)
+		if err != nil {
+			return err
+		}
+
+		err = checkEthSign(user)
+		if err != nil {
+			return err
+		}
+
+		options, _, err := a.initializeCeremony(EthSignKey, func(user *models.User, challenge string) error {
+			user.WebauthnData.PendingSignatures[challenge] = models.PendingSignature{
+				Type:    models.SignatureTypeEthSign,
+				From:    in.From,
+				Message: hash.Hex(),
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			Hash:                hash.Hex(),
+		})
+	}
+}
+
+func (a *Api) HandleEthSignFinalize() echo.HandlerFunc {
+	type output struct {
+		Signature string `json:"signature"`
+	}
+	return func(c echo.Context) error {
+		user, pending, err := a.signatureFinalize(c.Request(), EthSignKey)
+		if err != nil {
+			return err
+		}
+
+		wallet, ok := user.Wallets.FindByAddress(pending.From)
 		if !ok {
 			return echo.NewHTTPError(http.StatusBadRequest, "Signing wallet does not exist")
 		}
 
+		// eth_sign might have been disallowed since the ceremony has been initialized
+		err = checkEthSign(user)
+		if err != nil {
+			return err
+		}
+
 		privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
 		if err != nil {
 			log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
 		}
 
-		signature, err := signTypedData(in.Data, privateKey)
+		signature, err := signEncodedMessage(ethcommon.HexToHash(pending.Message), privateKey)
 		if err != nil {
 			return err
 		}
 
+		a.recordCompletedAuditEvent(c, models.AuditEthSign, map[string]string{
+			"from": wallet.Address,
+			"hash": pending.Message,
+		})
+
 		return c.JSON(http.StatusOK, output{signature})
 	}
 }
+
+// signatureFinalize finishes the ceremony of sessionKey and stores the user before the message bound to the challenge is signed
+func (a *Api) signatureFinalize(req *http.Request, sessionKey string) (models.User, models.PendingSignature, error) {
+	var pending models.PendingSignature
+	user, err := a.finalizeCeremony(req, sessionKey, func(user *models.User, _ *webauthn.Credential, session *webauthn.SessionData) error {
+		var ok bool
+		pending, ok = user.WebauthnData.PendingSignatures[session.Challenge]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Please call the initialize endpoint first")
+		}
+		delete(user.WebauthnData.PendingSignatures, session.Challenge)
+		return nil
+	})
+	if err != nil {
+		return models.User{}, models.PendingSignature{}, err
+	}
+
+	return user, pending, nil
+}
+
+func (a *Api) signMessage(c echo.Context, wallet models.Wallet, message string, signIn *siweMessage) error {
+	type output struct {
+		Signature string `json:"signature"`
+	}
+
+	privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+	}
+
+	signature, err := signPersonal(message, privateKey)
+	if err != nil {
+		return err
+	}
+
+	details := map[string]string{
+		"from":         wallet.Address,
+		"message_hash": crypto.Keccak256Hash([]byte(message)).Hex(),
+	}
+	if signIn != nil {
+		details["sign_in_domain"] = signIn.Domain
+		details["sign_in_uri"] = signIn.URI
+	}
+
+	a.recordCompletedAuditEvent(c, models.AuditPersonalSign, details)
+
+	return c.JSON(http.StatusOK, output{signature})
+}
+
+func (a *Api) signTypedMessage(c echo.Context, wallet models.Wallet, msg typedMessage, analysis typedDataAnalysis) error {
+	type output struct {
+		Signature string `json:"signature"`
+	}
+
+	privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+	}
+
+	signature, err := signEncodedMessage(msg.Hash, privateKey)
+	if err != nil {
+		return err
+	}
+
+	a.recordCompletedAuditEvent(c, models.AuditTypedDataSign, map[string]string{
+		"from":               wallet.Address,
+		"version":            msg.Version,
+		"hash":               msg.Hash.Hex(),
+		"primary_type":       msg.Data.PrimaryType,
+		"domain_name":        msg.Data.Domain.Name,
+		"verifying_contract": msg.Data.Domain.VerifyingContract,
+		"kind":               analysis.Kind,
+	})
+
+	return c.JSON(http.StatusOK, output{signature})
+}
+
+// typedDataVersion defaults to v4, the version dApps use unless they ask for another one
+func typedDataVersion(version string) string {
+	if version == "" {
+		return typedDataV4
+	}
+
+	return version
+}
+
+// parseEthSignHash accepts the 32 byte hashes eth_sign is defined for
+func parseEthSignHash(hash string) (ethcommon.Hash, error) {
+	b, err := hexutil.Decode(hash)
+	if err != nil || len(b) != ethcommon.HashLength {
+		return ethcommon.Hash{}, echo.NewHTTPError(http.StatusBadRequest, "The hash must be 32 bytes encoded as hex string")
+	}
+
+	return ethcommon.BytesToHash(b), nil
+}
+
+func checkEthSign(user models.User) error {
+	if !user.Policy.AllowEthSign {
+		return &common.PolicyViolation{
+			Rule:    policyRuleEthSign,
+			Message: "eth_sign can sign transactions without showing them, it has to be allowed by the policy first",
+		}
+	}
+
+	return nil
+}
+
+// requestingOrigin returns the origin of the site that requested a signature. The wallet reports it for requests of other sites,
+// otherwise the request has been made by the site sending it.
+func requestingOrigin(c echo.Context, reported string) string {
+	if reported != "" {
+		return reported
+	}
+
+	return c.Request().Header.Get(echo.HeaderOrigin)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"math/big"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,17 +25,33 @@ func (a *Api) HandleGetOTP() echo.HandlerFunc {
 			if err != nil {
 				return fmt.Errorf("failed to generate otp: %w", err)
 			}
-			user.OTP = models.OTP{
-				Secret:     otp,
-				ValidUntil: time.Now().Add(time.Minute * 30).Unix(),
-				TimesTried: 0,
-				Active:     true,
-			}
 
-			err = a.repo.UpsertUser(user)
+			user, err = common.UpdateUser(a.repo, func(user *models.User) error {
+				// Another request might have created an otp in the meantime
+				if !isExpiredOrInvalidOTP(user.OTP) {
+					return nil
+				}
+
+				user.OTP = models.OTP{
+					Secret:     otp,
+					ValidUntil: time.Now().Add(time.Minute * 30).Unix(),
+					TimesTried: 0,
+					Active:     true,
+				}
+				return nil
+			})
 			if err != nil {
 				return err
 			}
+
+			if user.OTP.Secret == otp {
+				err = a.recordAuditEvent(c, models.AuditOTPCreated, map[string]string{
+					"valid_until": strconv.FormatInt(user.OTP.ValidUntil, 10),
+				})
+				if err != nil {
+					return err
+				}
+			}
 		}
 
 		return c.JSON(http.StatusOK, user.OTP)
@@ -54,34 +71,47 @@ func (a *Api) HandleLoginWithOTP() echo.HandlerFunc {
 			return err
 		}
 
-		user, err := a.repo.GetUser()
+		// Every guess is counted, so concurrent guesses can not exceed the allowed tries
+		var expired, wrong bool
+		user, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			expired, wrong = false, false
+
+			if !user.OTP.Active {
+				return echo.NewHTTPError(http.StatusUnauthorized, invalidOTP)
+			}
+			if time.Now().After(time.Unix(user.OTP.ValidUntil, 0)) || user.OTP.TimesTried > 2 {
+				expired = true
+				user.OTP.Active = false
+				return nil
+			}
+			if user.OTP.Secret != in.OTP {
+				wrong = true
+				user.OTP.TimesTried++
+				return nil
+			}
+
+			// Invalidate the otp after successful use
+			user.OTP.Active = false
+			return nil
+		})
 		if err != nil {
 			return err
 		}
 
-		if !user.OTP.Active {
-			return echo.NewHTTPError(http.StatusUnauthorized, invalidOTP)
-		}
-		if time.Now().After(time.Unix(user.OTP.ValidUntil, 0)) || user.OTP.TimesTried > 2 {
-			user.OTP.Active = false
-			err := a.repo.UpsertUser(user)
-			if err != nil {
-				return err
-			}
+		if expired {
 			return echo.NewHTTPError(http.StatusUnauthorized, invalidOTP)
 		}
-		if user.OTP.Secret != in.OTP {
-			user.OTP.TimesTried++
-			err := a.repo.UpsertUser(user)
+		if wrong {
+			err = a.recordAuditEvent(c, models.AuditOTPLoginFailed, map[string]string{
+				"times_tried": strconv.FormatInt(user.OTP.TimesTried, 10),
+			})
 			if err != nil {
 				return err
 			}
 			return echo.NewHTTPError(http.StatusUnauthorized, invalidOTP)
 		}
 
-		// Invalidate the otp after successful use
-		user.OTP.Active = false
-		err = a.repo.UpsertUser(user)
+		err = a.recordAuditEvent(c, models.AuditOTPLogin, nil)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+func (a *Api) HandleGetPolicy() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		return c.JSON(http.StatusOK, user.Policy)
+	}
+}
+
+// HandleUpdatePolicy replaces the policy of the user. Tightening a policy is possible with every session,
+// but loosening it requires a session that could also access strictly authenticated resources.
+func (a *Api) HandleUpdatePolicy() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		in := models.NewPolicy()
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+		normalizePolicy(&in)
+
+		user := c.Get("user").(models.User)
+
+		if in.RequiredCredentials() > len(user.WebauthnData.Credentials) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A quorum rule requires more credentials than you have registered")
+		}
+
+		loosened := in.Loosens(user.Policy)
+		if loosened {
+			claims := c.Get("claims").(common.EnclaveClaims)
+			recent, err := common.IsRecentSession(claims)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid or malformed jwt").SetInternal(err)
+			}
+			if !recent {
+				return echo.NewHTTPError(http.StatusForbidden, "This session is too old to loosen the policy")
+			}
+
+			if required := requiredApprovals(user.Policy, models.OperationPolicyLoosening); required > 1 {
+				approval, err := newPendingApproval(models.OperationPolicyLoosening, "", required, "")
+				if err != nil {
+					return err
+				}
+				approval.Policy = &in
+
+				return a.requestApproval(c, user, approval)
+			}
+		}
+
+		return a.updatePolicy(c, a.latestUser, in, loosened)
+	}
+}
+
+func (a *Api) updatePolicy(c echo.Context, update userUpdate, policy models.Policy, loosened bool) error {
+	_, err := update(func(user *models.User) error {
+		// The policy has been compared with an older state, which might have been tightened since
+		if !loosened && policy.Loosens(user.Policy) {
+			return common.ErrConflict
+		}
+		if policy.RequiredCredentials() > len(user.WebauthnData.Credentials) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A quorum rule requires more credentials than you have registered")
+		}
+
+		user.Policy = policy
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = a.recordAuditEvent(c, models.AuditPolicyUpdated, map[string]string{
+		"loosened": strconv.FormatBool(loosened),
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// normalizePolicy replaces lists that have been sent as null, so the stored policy always contains empty lists
+func normalizePolicy(policy *models.Policy) {
+	if policy.SpendLimits == nil {
+		policy.SpendLimits = make([]models.SpendLimit, 0)
+	}
+	if policy.Allowlist == nil {
+		policy.Allowlist = make([]string, 0)
+	}
+	if policy.Denylist == nil {
+		policy.Denylist = make([]string, 0)
+	}
+	if policy.ContractRules == nil {
+		policy.ContractRules = make([]models.ContractRule, 0)
+	}
+	if policy.QuorumRules == nil {
+		policy.QuorumRules = make([]models.QuorumRule, 0)
+	}
+	if policy.DelayRules == nil {
+		policy.DelayRules = make([]models.DelayRule, 0)
+	}
+	if policy.SignInDomains == nil {
+		policy.SignInDomains = make([]string, 0)
+	}
+	if policy.SignatureExemptions == nil {
+		policy.SignatureExemptions = make([]models.SignatureExemption, 0)
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"time"
+)
+
+func (a *Api) HandleGetRecurringPayments() echo.HandlerFunc {
+	type output struct {
+		Payments []models.RecurringPayment `json:"payments"`
+	}
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		payments := make([]models.RecurringPayment, 0, len(user.RecurringPayments))
+		for _, payment := range user.RecurringPayments {
+			payments = append(payments, payment)
+		}
+
+		return c.JSON(http.StatusOK, output{payments})
+	}
+}
+
+// HandleRecurringPaymentInitialize starts the ceremony that authorizes every run of a recurring payment at once
+func (a *Api) HandleRecurringPaymentInitialize() echo.HandlerFunc {
+	type input struct {
+		Name      string `json:"name" validate:"required,max=64"`
+		From      string `json:"from" validate:"required,ethereum_address"`
+		To        string `json:"to" validate:"required,ethereum_address"`
+		ChainID   string `json:"chain_id" validate:"required,hexadecimal"`
+		Token     string `json:"token" validate:"omitempty,ethereum_address"`
+		Amount    string `json:"amount" validate:"required,number"`
+		Schedule  string `json:"schedule" validate:"required"`
+		StartAt   int64  `json:"start_at" validate:"gte=0"` //The first run is not before, zero to start right away
+		EndAt     int64  `json:"end_at" validate:"gte=0"`
+		MaxAmount string `json:"max_amount" validate:"omitempty,number"`
+	}
+	type output struct {
+		*protocol.CredentialAssertion
+		NextRunAt int64        `json:"next_run_at"`
+		Call      *decodedCall `json:"call"` //Nil for payments in the native currency
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if _, ok := user.Wallets.FindByAddress(in.From); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Sending wallet does not exist")
+		}
+		if _, ok := networks.FindByChainIDHex(in.ChainID); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+		if countActiveRecurringPayments(user) >= maxRecurringPayments {
+			return echo.NewHTTPError(http.StatusBadRequest, "Too many recurring payments are active")
+		}
+
+		schedule, err := models.ParseCronSchedule(in.Schedule)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid schedule: %s", err.Error()))
+		}
+
+		now := time.Now()
+		payment := models.RecurringPayment{
+			Name:      in.Name,
+			From:      in.From,
+			To:        in.To,
+			ChainID:   in.ChainID,
+			Token:     in.Token,
+			Amount:    in.Amount,
+			Schedule:  in.Schedule,
+			EndAt:     in.EndAt,
+			MaxAmount: in.MaxAmount,
+			Paid:      "0",
+			Status:    models.RecurringActive,
+		}
+
+		params, amount, err := recurringPaymentParams(payment)
+		if err != nil || amount.Sign() <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Amount must be positive")
+		}
+		if !payment.CanPay() {
+			return echo.NewHTTPError(http.StatusBadRequest, "The maximum amount does not cover a single payment")
+		}
+
+		// Every run is evaluated again when it is sent
+		_, err = evaluatePolicy(&user, &params, unreservedNonce, now)
+		if err != nil {
+			return err
+		}
+
+		required, err := requiredTransactionApprovals(user, &params)
+		if err != nil {
+			return err
+		}
+		if required > 1 {
+			return &common.PolicyViolation{
+				Rule:    policyRuleQuorum,
+				Message: "Payments that need the approval of multiple credentials can not be recurring",
+			}
+		}
+
+		// A delay rule postpones the first run, so a recurring payment can not be used to bypass it
+		firstRunAfter, err := delayedExecution(user, &params, time.Unix(in.StartAt, 0), now)
+		if err != nil {
+			return err
+		}
+
+		next := schedule.Next(firstRunAfter)
+		if next.IsZero() || (in.EndAt != 0 && next.Unix() > in.EndAt) {
+			return echo.NewHTTPError(http.StatusBadRequest, "The schedule has no run before the end date")
+		}
+		payment.NextRunAt = next.Unix()
+
+		options, _, err := a.initializeCeremony(RecurringKey, func(user *models.User, challenge string) error {
+			user.WebauthnData.PendingRecurring[challenge] = payment
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			NextRunAt:           payment.NextRunAt,
+			Call:                describeCalldata(user, &params),
+		})
+	}
+}
+
+func (a *Api) HandleRecurringPaymentFinalize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("failed to generate recurring payment id: %w", err)
+		}
+
+		var payment models.RecurringPayment
+		_, err = a.finalizeCeremony(c.Request(), RecurringKey, func(user *models.User, cred *webauthn.Credential, session *webauthn.SessionData) error {
+			var ok bool
+			payment, ok = user.WebauthnData.PendingRecurring[session.Challenge]
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "Please call the initialize endpoint first")
+			}
+			delete(user.WebauthnData.PendingRecurring, session.Challenge)
+
+			if countActiveRecurringPayments(*user) >= maxRecurringPayments {
+				return echo.NewHTTPError(http.StatusBadRequest, "Too many recurring payments are active")
+			}
+
+			now := time.Now().Unix()
+			payment.ID = id.String()
+			payment.Credential = credentialName(*user, cred)
+			payment.CreatedAt = now
+			payment.UpdatedAt = now
+			user.RecurringPayments[payment.ID] = payment
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditRecurringCreated, recurringAuditDetails(payment))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusCreated, payment)
+	}
+}
+
+// HandleCancelRecurringPayment stops a recurring payment together with its runs that have not been sent yet
+func (a *Api) HandleCancelRecurringPayment() echo.HandlerFunc {
+	type input struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		a.scheduleMu.Lock()
+		defer a.scheduleMu.Unlock()
+
+		var payment models.RecurringPayment
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			var ok bool
+			payment, ok = user.RecurringPayments[in.ID]
+			if !ok {
+				return echo.NewHTTPError(http.StatusNotFound, "Recurring payment does not exist")
+			}
+			if payment.Status != models.RecurringActive {
+				return echo.NewHTTPError(http.StatusBadRequest, "Only active recurring payments can be cancelled")
+			}
+
+			payment.Status = models.RecurringCancelled
+			payment.UpdatedAt = time.Now().Unix()
+			user.RecurringPayments[in.ID] = payment
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		scheduled, err := a.repo.GetScheduledTransactions()
+		if err != nil {
+			return err
+		}
+		for _, run := range scheduled {
+			if run.Recurring == in.ID && run.IsCancellable() {
+				run.Status = models.ScheduledCancelled
+				run.UpdatedAt = payment.UpdatedAt
+
+				err = a.repo.SaveScheduledTransaction(run)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = a.recordAuditEvent(c, models.AuditRecurringCancelled, recurringAuditDetails(payment))
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func countActiveRecurringPayments(user models.User) int {
+	count := 0
+	for _, payment := range user.RecurringPayments {
+		if payment.Status == models.RecurringActive {
+			count++
+		}
+	}
+
+	return count
+}
+
+func recurringAuditDetails(payment models.RecurringPayment) map[string]string {
+	return map[string]string{
+		"id":         payment.ID,
+		"name":       payment.Name,
+		"from":       payment.From,
+		"to":         payment.To,
+		"chain_id":   payment.ChainID,
+		"token":      payment.Token,
+		"amount":     payment.Amount,
+		"schedule":   payment.Schedule,
+		"max_amount": payment.MaxAmount,
+	}
+}
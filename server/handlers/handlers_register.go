@@ -30,7 +30,9 @@ func (a *Api) HandleRegisterInitialize() echo.HandlerFunc {
 			return fmt.Errorf("failed to check if user exists: %w", err)
 		}
 
+		version := user.Version
 		user = models.NewUser(in.Email, in.Email)
+		user.Version = version // Replaces a previous unfinished registration
 		registrationOptions := getCreationOptions(nil)
 
 		options, session, err := a.w.BeginRegistration(user.WebauthnData, registrationOptions)
@@ -86,7 +88,12 @@ func (a *Api) HandleRegisterFinalize() echo.HandlerFunc {
 		}
 		user.WebauthnData.Credentials[in.CredentialName] = *cred
 
-		wallet, err := a.createWallet("Default", true, user)
+		index, err := user.ReserveHDIndex()
+		if err != nil {
+			return err
+		}
+
+		wallet, err := a.createWallet("Default", true, user, index)
 		if err != nil {
 			return err
 		}
@@ -97,6 +104,21 @@ func (a *Api) HandleRegisterFinalize() echo.HandlerFunc {
 			return err
 		}
 
+		err = a.recordAuditEventWithCredential(models.AuditRegistration, in.CredentialName, map[string]string{
+			"email": user.Email,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEventWithCredential(models.AuditWalletCreated, in.CredentialName, map[string]string{
+			"name":    wallet.Name,
+			"address": wallet.Address,
+		})
+		if err != nil {
+			return err
+		}
+
 		cookie, err := createSessionCookie(user, cred, a.signingKey.PrivateKey)
 		if err != nil {
 			return err
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	minScheduleDelay = time.Minute
+	maxScheduleDelay = 365 * 24 * time.Hour
+)
+
+// The nonce of a scheduled transaction is only known once it is sent, so the policy preview uses a nonce no reservation has
+const unreservedNonce = math.MaxUint64
+
+func (a *Api) HandleScheduleTransactionInitialize() echo.HandlerFunc {
+	type input struct {
+		transactionParams
+		ExecuteAt int64 `json:"execute_at" validate:"required"`
+	}
+	type output struct {
+		*protocol.CredentialAssertion
+		ExecuteAt int64        `json:"execute_at"` //Later than requested if a delay rule applies
+		Call      *decodedCall `json:"call"`       //Nil if the transaction has no calldata or the method is unknown
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if in.Nonce != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "The nonce of scheduled transactions is chosen when they are sent")
+		}
+		if _, ok := networks.FindByChainIDHex(in.ChainID); !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+
+		now := time.Now()
+		executeAt := time.Unix(in.ExecuteAt, 0)
+		if executeAt.Before(now.Add(minScheduleDelay)) || executeAt.After(now.Add(maxScheduleDelay)) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Transactions can be scheduled between a minute and a year ahead")
+		}
+
+		// The policy is evaluated again when the transaction is sent
+		_, err := evaluatePolicy(&user, &in.transactionParams, unreservedNonce, now)
+		if err != nil {
+			return err
+		}
+
+		executeAt, err = delayedExecution(user, &in.transactionParams, executeAt, now)
+		if err != nil {
+			return err
+		}
+
+		options, err := a.loginInitialize(&user, ScheduleKey)
+		if err != nil {
+			return err
+		}
+
+		session := user.WebauthnData.Sessions[ScheduleKey]
+		user.WebauthnData.PendingSchedules[session.Challenge] = models.PendingSchedule{
+			Params:    models.TransactionParams(in.transactionParams),
+			ExecuteAt: executeAt.Unix(),
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			ExecuteAt:           executeAt.Unix(),
+			Call:                describeCalldata(user, &in.transactionParams),
+		})
+	}
+}
+
+func (a *Api) HandleScheduleTransactionFinalize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		cred, session, err := a.loginFinalize(&user, c.Request(), ScheduleKey)
+		if err != nil {
+			return err
+		}
+
+		pending, ok := user.WebauthnData.PendingSchedules[session.Challenge]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Please call the initialize endpoint first")
+		}
+		delete(user.WebauthnData.PendingSchedules, session.Challenge)
+
+		params := transactionParams(pending.Params)
+
+		// The policy might have changed since the ceremony has been initialized
+		executeAt, err := delayedExecution(user, &params, time.Unix(pending.ExecuteAt, 0), time.Now())
+		if err != nil {
+			return err
+		}
+
+		required, err := requiredTransactionApprovals(user, &params)
+		if err != nil {
+			return err
+		}
+		if required > 1 {
+			approval, err := newPendingApproval(models.OperationTransaction, params.From, required, credentialName(user, cred))
+			if err != nil {
+				return err
+			}
+			approval.Transaction = &models.PendingTransactionApproval{
+				Action:    models.TransactionActionSchedule,
+				Params:    pending.Params,
+				ExecuteAt: executeAt.Unix(),
+			}
+
+			return a.requestApproval(c, user, approval)
+		}
+
+		return a.scheduleTransaction(c, user, &params, credentialName(user, cred), models.ScheduleKindScheduled, executeAt)
+	}
+}
+
+func (a *Api) HandleGetScheduledTransactions() echo.HandlerFunc {
+	type input struct {
+		Wallet string `query:"wallet" validate:"omitempty,ethereum_address"`
+	}
+	type output struct {
+		Transactions []models.ScheduledTransaction `json:"transactions"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		scheduled, err := a.repo.GetScheduledTransactions()
+		if err != nil {
+			return err
+		}
+
+		transactions := make([]models.ScheduledTransaction, 0, len(scheduled))
+		for _, s := range scheduled {
+			if in.Wallet == "" || strings.EqualFold(s.Params.From, in.Wallet) {
+				s.RawTransaction = ""
+				transactions = append(transactions, s)
+			}
+		}
+
+		return c.JSON(http.StatusOK, output{transactions})
+	}
+}
+
+// HandleCancelScheduledTransaction cancels a transaction that has not been signed yet.
+// Like rejecting an approval, cancelling is never riskier than sending, so no ceremony is needed.
+func (a *Api) HandleCancelScheduledTransaction() echo.HandlerFunc {
+	type input struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		a.scheduleMu.Lock()
+		defer a.scheduleMu.Unlock()
+
+		scheduled, err := a.repo.GetScheduledTransaction(in.ID)
+		if errors.Is(err, common.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Scheduled transaction does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		if !scheduled.IsCancellable() {
+			return echo.NewHTTPError(http.StatusBadRequest, "Only transactions that have not been sent yet can be cancelled")
+		}
+
+		scheduled.Status = models.ScheduledCancelled
+		scheduled.UpdatedAt = time.Now().Unix()
+
+		err = a.repo.SaveScheduledTransaction(scheduled)
+		if err != nil {
+			return err
+		}
+		a.refundRecurringRun(scheduled)
+
+		err = a.recordAuditEvent(c, models.AuditScheduledCancelled, scheduledAuditDetails(scheduled))
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// delayedExecution postpones executeAt until the delay of the policy has passed
+func delayedExecution(user models.User, params *transactionParams, executeAt, now time.Time) (time.Time, error) {
+	delay, err := transactionDelay(user, params)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if earliest := now.Add(delay); executeAt.Before(earliest) {
+		return earliest, nil
+	}
+
+	return executeAt, nil
+}
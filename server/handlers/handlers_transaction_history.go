@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+func (a *Api) HandleGetTransactions() echo.HandlerFunc {
+	type input struct {
+		Wallet string `query:"wallet" validate:"omitempty,ethereum_address"`
+		Offset int    `query:"offset" validate:"gte=0"`
+		Limit  int    `query:"limit" validate:"omitempty,gte=1,lte=100"`
+	}
+	type output struct {
+		Transactions []models.TransactionRecord `json:"transactions"`
+		Total        int                        `json:"total"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if in.Wallet != "" {
+			if _, ok := user.Wallets.FindByAddress(in.Wallet); !ok {
+				return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+			}
+		}
+
+		if in.Limit == 0 {
+			in.Limit = 50
+		}
+
+		transactions, total, err := a.repo.GetTransactions(in.Wallet, in.Offset, in.Limit)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, output{
+			Transactions: transactions,
+			Total:        total,
+		})
+	}
+}
+
+func (a *Api) HandleGetTransaction() echo.HandlerFunc {
+	type input struct {
+		Hash string `param:"hash" validate:"required,hexadecimal,len=66"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		transaction, err := a.repo.GetTransaction(in.Hash)
+		if errors.Is(err, common.ErrNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Transaction does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, transaction)
+	}
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+)
+
+func (a *Api) HandleSpeedUpTransactionInitialize() echo.HandlerFunc {
+	return a.replaceTransactionInitialize(SpeedUpKey, false)
+}
+
+func (a *Api) HandleSpeedUpTransactionFinalize() echo.HandlerFunc {
+	return a.replaceTransactionFinalize(SpeedUpKey, models.TransactionActionSpeedUp)
+}
+
+func (a *Api) HandleCancelTransactionInitialize() echo.HandlerFunc {
+	return a.replaceTransactionInitialize(CancelKey, true)
+}
+
+func (a *Api) HandleCancelTransactionFinalize() echo.HandlerFunc {
+	return a.replaceTransactionFinalize(CancelKey, models.TransactionActionCancel)
+}
+
+func (a *Api) replaceTransactionInitialize(sessionKey string, cancel bool) echo.HandlerFunc {
+	type input struct {
+		Hash string `param:"hash" validate:"required,hexadecimal,len=66"`
+		replacementFees
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		record, err := a.getReplaceableTransaction(user, in.Hash)
+		if err != nil {
+			return err
+		}
+
+		network, ok := networks.FindByChainIDHex(record.ChainID)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+
+		client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
+		if err != nil {
+			return fmt.Errorf("failed to dial rpc: %w", err)
+		}
+
+		params, err := createReplacementParams(c.Request().Context(), client, record, cancel, in.replacementFees)
+		if err != nil {
+			return err
+		}
+
+		options, err := a.transactionInitialize(c.Request().Context(), &user, params, boundSessionKey(sessionKey, record.Hash), true)
+		if err != nil {
+			return err
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+func (a *Api) replaceTransactionFinalize(sessionKey string, action string) echo.HandlerFunc {
+	type input struct {
+		Hash string `param:"hash" validate:"required,hexadecimal,len=66"`
+	}
+	return func(c echo.Context) error {
+		// The body holds the assertion, so only the path parameters are bound
+		var in input
+		if err := (&echo.DefaultBinder{}).BindPathParams(c, &in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		params, cred, err := a.transactionFinalize(&user, c.Request(), boundSessionKey(sessionKey, in.Hash))
+		if err != nil {
+			return err
+		}
+
+		required, err := requiredTransactionApprovals(user, params)
+		if err != nil {
+			return err
+		}
+		if required > 1 {
+			return a.requestTransactionApproval(c, user, params, credentialName(user, cred), required, action, in.Hash)
+		}
+
+		return a.sendReplacement(c, user, params, in.Hash, credentialName(user, cred), action)
+	}
+}
+
+// sendReplacement stores the user, whose ceremony has been finalized, before sending the transaction replacing hash
+func (a *Api) sendReplacement(c echo.Context, user models.User, params *transactionParams, hash, credential, action string) error {
+	type output struct {
+		Hash string `json:"hash"`
+	}
+
+	err := a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	// The transaction might have been mined or replaced during the ceremony
+	record, err := a.getReplaceableTransaction(user, hash)
+	if err != nil {
+		return err
+	}
+
+	network, ok := networks.FindByChainIDHex(params.ChainID)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+	}
+
+	client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
+	if err != nil {
+		return fmt.Errorf("failed to dial rpc: %w", err)
+	}
+
+	signedTx, err := createSignedTransaction(user, params, network, client, c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	err = client.SendTransaction(c.Request().Context(), signedTx)
+	if err != nil {
+		return fmt.Errorf("failed to send tx: %w", err)
+	}
+
+	// The replacement has been broadcast, so the client needs its hash even if it can not be tracked
+	replacement := newTransactionRecord(params, signedTx, credential)
+	replacement.Replaces = record.Hash
+	err = a.repo.SaveTransaction(replacement)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save replacement %s", replacement.Hash)
+	}
+
+	record.ReplacedBy = replacement.Hash
+	err = a.repo.SaveTransaction(record)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save replaced transaction %s", record.Hash)
+	}
+
+	auditEventType := models.AuditTransactionSpeedUp
+	if action == models.TransactionActionCancel {
+		auditEventType = models.AuditTransactionCancel
+	}
+
+	details := transactionAuditDetails(params, signedTx)
+	details["replaces"] = record.Hash
+	a.recordCompletedAuditEvent(c, auditEventType, details)
+
+	return c.JSON(http.StatusOK, output{signedTx.Hash().Hex()})
+}
+
+func (a *Api) getReplaceableTransaction(user models.User, hash string) (models.TransactionRecord, error) {
+	record, err := a.repo.GetTransaction(hash)
+	if errors.Is(err, common.ErrNotFound) {
+		return models.TransactionRecord{}, echo.NewHTTPError(http.StatusNotFound, "Transaction does not exist")
+	}
+	if err != nil {
+		return models.TransactionRecord{}, err
+	}
+
+	if _, ok := user.Wallets.FindByAddress(record.From); !ok {
+		return models.TransactionRecord{}, echo.NewHTTPError(http.StatusBadRequest, "Sending wallet does not exist")
+	}
+	if !record.Replaceable() {
+		return models.TransactionRecord{}, echo.NewHTTPError(http.StatusBadRequest, "Transaction is no longer pending")
+	}
+	if record.ReplacedBy != "" {
+		return models.TransactionRecord{}, echo.NewHTTPError(http.StatusBadRequest, "Transaction has already been replaced, please replace the newest transaction instead")
+	}
+
+	return record, nil
+}
@@ -4,12 +4,22 @@ import (
 	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (a *Api) HandleSendTransactionInitialize() echo.HandlerFunc {
+	type output struct {
+		*protocol.CredentialAssertion
+		Simulation *simulation  `json:"simulation"`
+		Call       *decodedCall `json:"call"` //Nil if the transaction has no calldata or the method is unknown
+	}
 	return func(c echo.Context) error {
 		var in transactionParams
 		if err := c.Bind(&in); err != nil {
@@ -21,7 +31,12 @@ func (a *Api) HandleSendTransactionInitialize() echo.HandlerFunc {
 
 		user := c.Get("user").(models.User)
 
-		options, err := a.transactionInitialize(&user, &in, SendTransactionKey)
+		network, ok := networks.FindByChainIDHex(in.ChainID)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+
+		options, err := a.transactionInitialize(c.Request().Context(), &user, &in, SendTransactionKey, false)
 		if err != nil {
 			return err
 		}
@@ -31,53 +46,96 @@ func (a *Api) HandleSendTransactionInitialize() echo.HandlerFunc {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, options)
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			Simulation:          simulateTransaction(c.Request().Context(), &in, network),
+			Call:                describeCalldata(user, &in),
+		})
 	}
 }
 
 func (a *Api) HandleSendTransactionFinalize() echo.HandlerFunc {
-	type output struct {
-		Hash string `json:"hash"`
-	}
-
 	return func(c echo.Context) error {
 		user := c.Get("user").(models.User)
 
-		params, err := a.transactionFinalize(&user, c.Request(), SendTransactionKey)
+		params, cred, err := a.transactionFinalize(&user, c.Request(), SendTransactionKey)
 		if err != nil {
 			return err
 		}
 
-		err = a.repo.UpsertUser(user)
+		required, err := requiredTransactionApprovals(user, params)
 		if err != nil {
 			return err
 		}
-
-		network, ok := networks.FindByChainIDHex(params.ChainID)
-		if !ok {
-			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		if required > 1 {
+			return a.requestTransactionApproval(c, user, params, credentialName(user, cred), required, models.TransactionActionSend, "")
 		}
 
-		client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
-		if err != nil {
-			return fmt.Errorf("failed to dial rpc: %w", err)
-		}
+		return a.sendTransaction(c, user, params, credentialName(user, cred))
+	}
+}
 
-		signedTx, err := createSignedTransaction(user, params, network, client, c.Request().Context())
-		if err != nil {
-			return err
-		}
+// sendTransaction stores the user, whose ceremony has been finalized, before signing and sending the transaction.
+// credential names the credentials that approved the transaction.
+// Transactions covered by a delay rule are scheduled instead, so they can be cancelled until the delay has passed.
+func (a *Api) sendTransaction(c echo.Context, user models.User, params *transactionParams, credential string) error {
+	type output struct {
+		Hash string `json:"hash"`
+	}
 
-		err = client.SendTransaction(c.Request().Context(), signedTx)
-		if err != nil {
-			return fmt.Errorf("failed to send tx: %w", err)
-		}
+	delay, err := transactionDelay(user, params)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		return a.scheduleTransaction(c, user, params, credential, models.ScheduleKindTimeLocked, time.Now().Add(delay))
+	}
+
+	err = a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	network, ok := networks.FindByChainIDHex(params.ChainID)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+	}
 
-		return c.JSON(http.StatusOK, output{signedTx.Hash().Hex()})
+	client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
+	if err != nil {
+		a.releaseNonce(params)
+		return fmt.Errorf("failed to dial rpc: %w", err)
 	}
+
+	signedTx, err := createSignedTransaction(user, params, network, client, c.Request().Context())
+	if err != nil {
+		a.releaseNonce(params)
+		return err
+	}
+
+	err = client.SendTransaction(c.Request().Context(), signedTx)
+	if err != nil {
+		a.releaseNonce(params)
+		return fmt.Errorf("failed to send tx: %w", err)
+	}
+
+	// The transaction has been broadcast, so the client needs its hash even if it can not be tracked
+	err = a.repo.SaveTransaction(newTransactionRecord(params, signedTx, credential))
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save sent transaction %s", signedTx.Hash().Hex())
+	}
+
+	a.recordCompletedAuditEvent(c, models.AuditTransactionSend, transactionAuditDetails(params, signedTx))
+
+	return c.JSON(http.StatusOK, output{signedTx.Hash().Hex()})
 }
 
 func (a *Api) HandleSignTransactionInitialize() echo.HandlerFunc {
+	type output struct {
+		*protocol.CredentialAssertion
+		Simulation *simulation  `json:"simulation"`
+		Call       *decodedCall `json:"call"` //Nil if the transaction has no calldata or the method is unknown
+	}
 	return func(c echo.Context) error {
 		var in transactionParams
 		if err := c.Bind(&in); err != nil {
@@ -89,7 +147,17 @@ func (a *Api) HandleSignTransactionInitialize() echo.HandlerFunc {
 
 		user := c.Get("user").(models.User)
 
-		options, err := a.transactionInitialize(&user, &in, SignTransactionKey)
+		network, ok := networks.FindByChainIDHex(in.ChainID)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		}
+
+		err := checkTimeLock(user, &in)
+		if err != nil {
+			return err
+		}
+
+		options, err := a.transactionInitialize(c.Request().Context(), &user, &in, SignTransactionKey, false)
 		if err != nil {
 			return err
 		}
@@ -99,48 +167,87 @@ func (a *Api) HandleSignTransactionInitialize() echo.HandlerFunc {
 			return err
 		}
 
-		return c.JSON(http.StatusOK, options)
+		return c.JSON(http.StatusOK, output{
+			CredentialAssertion: options,
+			Simulation:          simulateTransaction(c.Request().Context(), &in, network),
+			Call:                describeCalldata(user, &in),
+		})
 	}
 }
 
 func (a *Api) HandleSignTransactionFinalize() echo.HandlerFunc {
-	type output struct {
-		Transaction string `json:"transaction"`
-	}
-
 	return func(c echo.Context) error {
 		user := c.Get("user").(models.User)
 
-		params, err := a.transactionFinalize(&user, c.Request(), SignTransactionKey)
+		params, cred, err := a.transactionFinalize(&user, c.Request(), SignTransactionKey)
 		if err != nil {
 			return err
 		}
 
-		err = a.repo.UpsertUser(user)
+		required, err := requiredTransactionApprovals(user, params)
 		if err != nil {
 			return err
 		}
-
-		network, ok := networks.FindByChainIDHex(params.ChainID)
-		if !ok {
-			return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+		if required > 1 {
+			return a.requestTransactionApproval(c, user, params, credentialName(user, cred), required, models.TransactionActionSign, "")
 		}
 
-		client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
-		if err != nil {
-			return fmt.Errorf("failed to dial rpc: %w", err)
-		}
+		return a.signPendingTransaction(c, user, params)
+	}
+}
 
-		signedTx, err := createSignedTransaction(user, params, network, client, c.Request().Context())
-		if err != nil {
-			return err
-		}
+// signPendingTransaction stores the user, whose ceremony has been finalized, before signing the transaction
+func (a *Api) signPendingTransaction(c echo.Context, user models.User, params *transactionParams) error {
+	type output struct {
+		Transaction string `json:"transaction"`
+	}
 
-		txBytes, err := signedTx.MarshalBinary()
-		if err != nil {
-			return fmt.Errorf("failed to marshal signed tx")
-		}
+	err := a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	// The policy might have changed since the ceremony has been initialized
+	err = checkTimeLock(user, params)
+	if err != nil {
+		a.releaseNonce(params)
+		return err
+	}
+
+	network, ok := networks.FindByChainIDHex(params.ChainID)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+	}
+
+	client, err := ethclient.DialContext(c.Request().Context(), network.RPC)
+	if err != nil {
+		a.releaseNonce(params)
+		return fmt.Errorf("failed to dial rpc: %w", err)
+	}
+
+	signedTx, err := createSignedTransaction(user, params, network, client, c.Request().Context())
+	if err != nil {
+		a.releaseNonce(params)
+		return err
+	}
+
+	txBytes, err := signedTx.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal signed tx")
+	}
+
+	a.recordCompletedAuditEvent(c, models.AuditTransactionSign, transactionAuditDetails(params, signedTx))
+
+	return c.JSON(http.StatusOK, output{hexutil.Encode(txBytes)})
+}
 
-		return c.JSON(http.StatusOK, output{hexutil.Encode(txBytes)})
+func transactionAuditDetails(params *transactionParams, tx *types.Transaction) map[string]string {
+	return map[string]string{
+		"from":     params.From,
+		"to":       params.To,
+		"value":    tx.Value().String(),
+		"chain_id": params.ChainID,
+		"nonce":    strconv.FormatUint(tx.Nonce(), 10),
+		"hash":     tx.Hash().Hex(),
 	}
 }
@@ -1,16 +1,23 @@
 package handlers
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
 	"net/http"
+	"strconv"
 )
 
 func (a *Api) HandleGetWallets() echo.HandlerFunc {
 	type redactedWallet struct {
-		Name    string `json:"name"`
-		Address string `json:"address"`
-		Public  bool   `json:"public"`
+		Name           string `json:"name"`
+		Address        string `json:"address"`
+		Public         bool   `json:"public"`
+		DerivationPath string `json:"derivation_path"`
+		Archived       bool   `json:"archived"`
 	}
 	type output struct {
 		Wallets []redactedWallet `json:"wallets"`
@@ -21,9 +28,11 @@ func (a *Api) HandleGetWallets() echo.HandlerFunc {
 		redactedWallets := make([]redactedWallet, len(user.Wallets))
 		for i, wallet := range user.Wallets {
 			redactedWallets[i] = redactedWallet{
-				Name:    wallet.Name,
-				Address: wallet.Address,
-				Public:  wallet.Public,
+				Name:           wallet.Name,
+				Address:        wallet.Address,
+				Public:         wallet.Public,
+				DerivationPath: wallet.DerivationPath,
+				Archived:       wallet.Archived,
 			}
 		}
 
@@ -53,13 +62,39 @@ func (a *Api) HandleCreateWallet() echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusBadRequest, "A wallet with this name already exists")
 		}
 
-		wallet, err := a.createWallet(in.Name, in.Public, user)
+		// The index is persisted before the wallet is created, so concurrent requests never derive the same wallet
+		var index uint32
+		user, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			var err error
+			index, err = user.ReserveHDIndex()
+			return err
+		})
 		if err != nil {
 			return err
 		}
-		user.Wallets = append(user.Wallets, wallet)
 
-		err = a.repo.UpsertUser(user)
+		wallet, err := a.createWallet(in.Name, in.Public, user, index)
+		if err != nil {
+			return err
+		}
+
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			if user.Wallets.Exists(in.Name) {
+				return echo.NewHTTPError(http.StatusBadRequest, "A wallet with this name already exists")
+			}
+
+			user.Wallets = append(user.Wallets, wallet)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletCreated, map[string]string{
+			"name":    wallet.Name,
+			"address": wallet.Address,
+			"public":  strconv.FormatBool(wallet.Public),
+		})
 		if err != nil {
 			return err
 		}
@@ -67,3 +102,469 @@ func (a *Api) HandleCreateWallet() echo.HandlerFunc {
 		return c.NoContent(http.StatusCreated)
 	}
 }
+
+func (a *Api) HandleImportWallet() echo.HandlerFunc {
+	type input struct {
+		Name   string `json:"name" validate:"required,alphanum"`
+		Public bool   `json:"public"`
+		walletImport
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if user.Wallets.Exists(in.Name) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A wallet with this name already exists")
+		}
+
+		wallet, err := importWallet(in.Name, in.Public, in.walletImport)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := user.Wallets.FindByAddress(wallet.Address); ok {
+			return echo.NewHTTPError(http.StatusConflict, "This wallet has already been imported")
+		}
+
+		if in.Public {
+			err = a.publishWallet(wallet, user)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			if user.Wallets.Exists(in.Name) {
+				return echo.NewHTTPError(http.StatusBadRequest, "A wallet with this name already exists")
+			}
+			if _, ok := user.Wallets.FindByAddress(wallet.Address); ok {
+				return echo.NewHTTPError(http.StatusConflict, "This wallet has already been imported")
+			}
+
+			user.Wallets = append(user.Wallets, wallet)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletImported, map[string]string{
+			"name":    wallet.Name,
+			"address": wallet.Address,
+			"public":  strconv.FormatBool(wallet.Public),
+			"type":    in.Type,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusCreated)
+	}
+}
+
+func (a *Api) HandleExportWalletInitialize() echo.HandlerFunc {
+	type input struct {
+		Address    string `json:"address" validate:"required,ethereum_address"`
+		Passphrase string `json:"passphrase" validate:"required,min=12"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		wallet, ok := user.Wallets.FindByAddress(in.Address)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+		}
+
+		keyJSON, err := exportWallet(wallet, in.Passphrase)
+		if err != nil {
+			return err
+		}
+
+		options, err := a.loginInitialize(&user, ExportWalletKey)
+		if err != nil {
+			return err
+		}
+
+		// The keystore is already encrypted, so the passphrase never has to be stored
+		challenge := user.WebauthnData.Sessions[ExportWalletKey].Challenge
+		user.WebauthnData.PendingExports[challenge] = models.PendingWalletExport{
+			Address:  wallet.Address,
+			Keystore: string(keyJSON),
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+func (a *Api) HandleExportWalletFinalize() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(models.User)
+
+		cred, session, err := a.loginFinalize(&user, c.Request(), ExportWalletKey)
+		if err != nil {
+			return err
+		}
+
+		export, ok := user.WebauthnData.PendingExports[session.Challenge]
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "Please call the initialize endpoint first")
+		}
+		delete(user.WebauthnData.PendingExports, session.Challenge)
+
+		if required := requiredApprovals(user.Policy, models.OperationWalletExport); required > 1 {
+			approval, err := newPendingApproval(models.OperationWalletExport, export.Address, required, credentialName(user, cred))
+			if err != nil {
+				return err
+			}
+			approval.Export = &export
+
+			return a.requestApproval(c, user, approval)
+		}
+
+		return a.completeWalletExport(c, user, export)
+	}
+}
+
+// completeWalletExport stores the user, whose ceremony has been finalized, before handing out the keystore
+func (a *Api) completeWalletExport(c echo.Context, user models.User, export models.PendingWalletExport) error {
+	type output struct {
+		Keystore json.RawMessage `json:"keystore"`
+	}
+
+	err := a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	wallet, ok := user.Wallets.FindByAddress(export.Address)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+	}
+
+	err = a.recordAuditEvent(c, models.AuditWalletExported, map[string]string{
+		"name":    wallet.Name,
+		"address": wallet.Address,
+	})
+	if err != nil {
+		return err
+	}
+
+	backendApiClient, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create backend api client: %w", err)
+	}
+
+	title := "Wallet exported"
+	body := fmt.Sprintf("Your wallet %s (%s) has been exported as a keystore file. If this was not you, move your funds to a new wallet immediately.", wallet.Name, wallet.Address)
+	err = backendApiClient.SendNotification(title, body)
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %w", err)
+	}
+
+	return c.JSON(http.StatusOK, output{json.RawMessage(export.Keystore)})
+}
+
+func (a *Api) HandleRenameWallet() echo.HandlerFunc {
+	type input struct {
+		Address string `param:"address" validate:"required,ethereum_address"`
+		Name    string `json:"name" validate:"required,alphanum"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		current, ok := user.Wallets.FindByAddress(in.Address)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+		}
+		if current.Name == in.Name {
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		// The name is reserved before the backend is called, so a concurrent rename can not take it
+		var wallet models.Wallet
+		user, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			index := user.Wallets.IndexByAddress(in.Address)
+			if index == -1 {
+				return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+			}
+			wallet = user.Wallets[index]
+			if wallet.Name == in.Name {
+				return nil
+			}
+			if user.Wallets.Exists(in.Name) {
+				return echo.NewHTTPError(http.StatusBadRequest, "A wallet with this name already exists")
+			}
+
+			user.Wallets[index].Name = in.Name
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if wallet.Name == in.Name {
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		// The backend only knows the name a wallet was published with, so public wallets are published again
+		if wallet.Public {
+			renamed := wallet
+			renamed.Name = in.Name
+
+			err = a.republishWallet(wallet, renamed, user)
+			if err != nil {
+				a.revertWalletName(wallet, in.Name)
+				return err
+			}
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletRenamed, map[string]string{
+			"address":  wallet.Address,
+			"old_name": wallet.Name,
+			"new_name": in.Name,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *Api) HandleArchiveWallet() echo.HandlerFunc {
+	type input struct {
+		Address  string `param:"address" validate:"required,ethereum_address"`
+		Archived bool   `json:"archived"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		var wallet models.Wallet
+		_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+			index := user.Wallets.IndexByAddress(in.Address)
+			if index == -1 {
+				return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+			}
+
+			user.Wallets[index].Archived = in.Archived
+			wallet = user.Wallets[index]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if in.Archived {
+			err = a.cancelWalletPayments(c, wallet.Address)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletArchived, map[string]string{
+			"name":     wallet.Name,
+			"address":  wallet.Address,
+			"archived": strconv.FormatBool(in.Archived),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *Api) HandleSetWalletVisibility() echo.HandlerFunc {
+	type input struct {
+		Address string `param:"address" validate:"required,ethereum_address"`
+		Public  bool   `json:"public"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		wallet, ok := user.Wallets.FindByAddress(in.Address)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+		}
+		if wallet.Public == in.Public {
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		var err error
+		if in.Public {
+			err = a.publishWallet(wallet, user)
+		} else {
+			err = a.unpublishWallet(wallet, user)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			index := user.Wallets.IndexByAddress(wallet.Address)
+			if index == -1 {
+				return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+			}
+
+			user.Wallets[index].Public = in.Public
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletVisibility, map[string]string{
+			"name":    wallet.Name,
+			"address": wallet.Address,
+			"public":  strconv.FormatBool(in.Public),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func (a *Api) HandleDeleteWalletInitialize() echo.HandlerFunc {
+	type input struct {
+		Address string `param:"address" validate:"required,ethereum_address"`
+	}
+	return func(c echo.Context) error {
+		var in input
+		if err := c.Bind(&in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		if _, ok := user.Wallets.FindByAddress(in.Address); !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+		}
+
+		options, err := a.loginInitialize(&user, boundSessionKey(DeleteWalletKey, in.Address))
+		if err != nil {
+			return err
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, options)
+	}
+}
+
+func (a *Api) HandleDeleteWalletFinalize() echo.HandlerFunc {
+	type input struct {
+		Address string `param:"address" validate:"required,ethereum_address"`
+	}
+	return func(c echo.Context) error {
+		// The body holds the assertion, so only the path parameters are bound
+		var in input
+		if err := (&echo.DefaultBinder{}).BindPathParams(c, &in); err != nil {
+			return err
+		}
+		if err := c.Validate(&in); err != nil {
+			return err
+		}
+
+		user := c.Get("user").(models.User)
+
+		_, _, err := a.loginFinalize(&user, c.Request(), boundSessionKey(DeleteWalletKey, in.Address))
+		if err != nil {
+			return err
+		}
+
+		err = a.repo.UpsertUser(user)
+		if err != nil {
+			return err
+		}
+
+		wallet, ok := user.Wallets.FindByAddress(in.Address)
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+		}
+
+		if wallet.Public {
+			err = a.unpublishWallet(wallet, user)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+			index := user.Wallets.IndexByAddress(wallet.Address)
+			if index == -1 {
+				return echo.NewHTTPError(http.StatusNotFound, "Wallet does not exist")
+			}
+
+			user.Wallets = append(user.Wallets[:index], user.Wallets[index+1:]...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The wallet is gone already, so its payments are cancelled on a best effort basis
+		err = a.cancelWalletPayments(c, wallet.Address)
+		if err != nil {
+			log.Error().Caller().Err(err).Msgf("failed to cancel the payments of deleted wallet %s", wallet.Address)
+		}
+
+		err = a.recordAuditEvent(c, models.AuditWalletDeleted, map[string]string{
+			"name":    wallet.Name,
+			"address": wallet.Address,
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Reservation lifetime of a ceremony whose webauthn session does not expire by itself
+	ceremonyNonceTTL = 5 * time.Minute
+	// Signed transactions might be broadcast by the frontend, so their nonce stays reserved
+	// until the node reports it as used or this lifetime passes
+	signedNonceTTL = 10 * time.Minute
+)
+
+// reserveNonce assigns the next free nonce of the sending wallet to params. A nonce chosen by the caller is reserved instead,
+// unless the node reports it as used or another transaction reserved it.
+func reserveNonce(ctx context.Context, user *models.User, params *transactionParams, session webauthn.SessionData) error {
+	network, ok := networks.FindByChainIDHex(params.ChainID)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Network does not exist")
+	}
+
+	client, err := ethclient.DialContext(ctx, network.RPC)
+	if err != nil {
+		return fmt.Errorf("failed to dial rpc: %w", err)
+	}
+	defer client.Close()
+
+	pendingNonce, err := client.PendingNonceAt(ctx, ethcommon.HexToAddress(params.From))
+	if err != nil {
+		return fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	now := time.Now()
+	expires := session.Expires
+	if expires.IsZero() {
+		expires = now.Add(ceremonyNonceTTL)
+	}
+
+	if params.Nonce != "" {
+		nonce, err := parseReservedNonce(params)
+		if err != nil {
+			return err
+		}
+
+		if !user.ReserveChosenNonce(params.ChainID, params.From, nonce, pendingNonce, session.Challenge, now.Unix(), expires.Unix()) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Nonce is already used by another transaction, use the speed up or cancel endpoints to replace it")
+		}
+
+		return nil
+	}
+
+	nonce := user.ReserveNonce(params.ChainID, params.From, pendingNonce, session.Challenge, now.Unix(), expires.Unix())
+	params.Nonce = hexutil.EncodeUint64(nonce)
+
+	return nil
+}
+
+// releaseNonce gives the nonce of params back if its transaction could not be signed or sent.
+// The amounts recorded as spent by the transaction are released as well.
+func (a *Api) releaseNonce(params *transactionParams) {
+	nonce, err := parseReservedNonce(params)
+	if err != nil {
+		return
+	}
+
+	_, err = common.UpdateUser(a.repo, func(user *models.User) error {
+		user.ReleaseNonce(params.ChainID, params.From, nonce)
+		user.RemoveSpend(params.From, params.ChainID, nonce)
+		return nil
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to release nonce %d of %s", nonce, params.From)
+	}
+}
+
+// parseReservedNonce returns the nonce that has been assigned to params by reserveNonce or the caller
+func parseReservedNonce(params *transactionParams) (uint64, error) {
+	nonce, err := hexutil.DecodeUint64(replaceLeadingZeroesFromHexNumber(params.Nonce))
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Nonce is invalid").SetInternal(err)
+	}
+
+	return nonce, nil
+}
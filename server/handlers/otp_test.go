@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/repository"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentOTPGuessesAreCounted(t *testing.T) {
+	memory := repository.NewMemory()
+	user := models.NewUser("user@example.com", "User")
+	user.OTP = models.OTP{
+		Secret:     "123456",
+		ValidUntil: time.Now().Add(time.Minute).Unix(),
+		Active:     true,
+	}
+	if err := memory.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey := testSigningKey(t)
+	a := &Api{repo: memory, signingKey: signingKey, auditKey: signingKey.AuditKey()}
+
+	e := echo.New()
+	e.Validator = acceptingValidator{}
+
+	const guesses = 3
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"otp":"654321"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			err := a.HandleLoginWithOTP()(e.NewContext(req, httptest.NewRecorder()))
+			if httpErr, ok := err.(*echo.HTTPError); !ok || httpErr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %v", http.StatusUnauthorized, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, err := memory.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.OTP.TimesTried != guesses {
+		t.Fatalf("expected %d tries, got %d", guesses, stored.OTP.TimesTried)
+	}
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	policyRuleDailyLimit        = "daily_limit"
+	policyRuleWeeklyLimit       = "weekly_limit"
+	policyRuleAllowlist         = "allowlist"
+	policyRuleDenylist          = "denylist"
+	policyRuleContract          = "contract_rule"
+	policyRuleUnlimitedApproval = "unlimited_approval"
+	policyRuleTimeLock          = "time_lock"
+	policyRuleQuorum            = "quorum"
+	policyRuleSignInDomain      = "sign_in_domain"
+	policyRuleSignatureCeremony = "signature_ceremony"
+	policyRuleEthSign           = "eth_sign"
+)
+
+const (
+	spendLimitDay  = 24 * time.Hour
+	spendLimitWeek = 7 * spendLimitDay
+)
+
+// Approvals of at least this amount are treated as unlimited. Permit2 uses the maximum uint160 for unlimited allowances.
+var unlimitedAllowance = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 160), big.NewInt(1))
+
+// transactionEffects is the part of a transaction the policy is evaluated on
+type transactionEffects struct {
+	destinations      []string            //Receivers of the value, of tokens and of approvals
+	spent             map[string]*big.Int //Amounts by lower case token address, the native currency uses an empty address
+	contractCall      bool
+	method            string //Empty if no bundled ABI knows the method
+	selector          string
+	unlimitedApproval bool
+}
+
+// evaluatePolicy checks params against the policy of the user and returns the amounts the transaction spends.
+// Token amounts are only known for ERC-20 and Permit2 transfers and approvals, so spend limits of tokens apply to those.
+// An approval counts as spent, because the spender can transfer the approved amount at any time.
+func evaluatePolicy(user *models.User, params *transactionParams, nonce uint64, now time.Time) ([]models.SpendEntry, error) {
+	effects, err := analyzeTransaction(params)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := user.Policy
+	err = checkDestinations(*user, effects.destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	if effects.contractCall {
+		err = evaluateContractRules(policy, params, effects)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.BlockUnlimitedApprovals && effects.unlimitedApproval {
+		return nil, &common.PolicyViolation{
+			Rule:    policyRuleUnlimitedApproval,
+			Message: "Unlimited approvals are blocked",
+		}
+	}
+
+	entries := make([]models.SpendEntry, 0, len(effects.spent))
+	for token, amount := range effects.spent {
+		if amount.Sign() == 0 {
+			continue
+		}
+
+		for _, limit := range policy.SpendLimits {
+			if !limit.Matches(params.From, params.ChainID, token) {
+				continue
+			}
+			if exceedsLimit(user, limit, limit.Daily, now.Add(-spendLimitDay), nonce, amount) {
+				return nil, &common.PolicyViolation{
+					Rule:    policyRuleDailyLimit,
+					Message: fmt.Sprintf("The transaction exceeds the daily limit of %s", limit.Daily),
+				}
+			}
+			if exceedsLimit(user, limit, limit.Weekly, now.Add(-spendLimitWeek), nonce, amount) {
+				return nil, &common.PolicyViolation{
+					Rule:    policyRuleWeeklyLimit,
+					Message: fmt.Sprintf("The transaction exceeds the weekly limit of %s", limit.Weekly),
+				}
+			}
+		}
+
+		entries = append(entries, models.SpendEntry{
+			Wallet:    params.From,
+			ChainID:   params.ChainID,
+			Token:     token,
+			Amount:    amount.String(),
+			Nonce:     nonce,
+			Timestamp: now.Unix(),
+		})
+	}
+
+	return entries, nil
+}
+
+// checkDestinations applies the allowlist and the denylist to the receivers of value, tokens or approvals.
+// The own wallets of the user are always allowed.
+func checkDestinations(user models.User, destinations []string) error {
+	for _, destination := range destinations {
+		if user.Policy.IsDenylisted(destination) {
+			return &common.PolicyViolation{
+				Rule:    policyRuleDenylist,
+				Message: fmt.Sprintf("%s is on the denylist", destination),
+			}
+		}
+		if !user.Policy.IsAllowlisted(destination) && user.Wallets.IndexByAddress(destination) == -1 {
+			return &common.PolicyViolation{
+				Rule:    policyRuleAllowlist,
+				Message: fmt.Sprintf("%s is not on the allowlist", destination),
+			}
+		}
+	}
+
+	return nil
+}
+
+// evaluateContractRules rejects calls matching a deny rule and, if only allowed contracts can be called,
+// calls without a matching allow rule
+func evaluateContractRules(policy models.Policy, params *transactionParams, effects *transactionEffects) error {
+	for _, rule := range policy.ContractRules {
+		if rule.Action == models.ContractRuleDeny && rule.Matches(params.ChainID, params.To, effects.method, effects.selector) {
+			return &common.PolicyViolation{
+				Rule:    policyRuleContract,
+				Message: fmt.Sprintf("Calls to %s are denied", params.To),
+			}
+		}
+	}
+
+	for _, rule := range policy.ContractRules {
+		if rule.Action == models.ContractRuleAllow && rule.Matches(params.ChainID, params.To, effects.method, effects.selector) {
+			return nil
+		}
+	}
+
+	if policy.OnlyAllowedContracts {
+		return &common.PolicyViolation{
+			Rule:    policyRuleContract,
+			Message: fmt.Sprintf("Calls to %s are not allowed", params.To),
+		}
+	}
+
+	return nil
+}
+
+// exceedsLimit reports whether spending amount on top of the amount spent since exceeds max. An empty max is unlimited.
+func exceedsLimit(user *models.User, limit models.SpendLimit, max string, since time.Time, nonce uint64, amount *big.Int) bool {
+	if max == "" {
+		return false
+	}
+
+	parsed, ok := new(big.Int).SetString(max, 10)
+	if !ok {
+		return true
+	}
+
+	total := user.Spent(limit.Wallet, limit.ChainID, limit.Token, since.Unix(), nonce)
+	return total.Add(total, amount).Cmp(parsed) > 0
+}
+
+func analyzeTransaction(params *transactionParams) (*transactionEffects, error) {
+	value, err := parseValue(params.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := parseData(params.Input)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Input is invalid").SetInternal(err)
+	}
+
+	effects := &transactionEffects{
+		destinations: []string{params.To},
+		spent:        map[string]*big.Int{"": value},
+		contractCall: len(data) > 0,
+	}
+	if len(data) < 4 {
+		return effects, nil
+	}
+
+	effects.selector = hexutil.Encode(data[:4])
+	effects.method = bundledMethodName(data)
+
+	standards := []string{"ERC-20", "ERC-721", "ERC-1155"}
+	if ethcommon.HexToAddress(params.To) == permit2Address {
+		standards = []string{"Permit2"}
+	}
+
+	for _, standard := range standards {
+		method, err := findBundledABI(standard).MethodById(data[:4])
+		if err != nil {
+			continue
+		}
+
+		args, err := method.Inputs.Unpack(data[4:])
+		if err != nil {
+			continue
+		}
+
+		addTokenEffects(effects, params, method, args)
+		break
+	}
+
+	return effects, nil
+}
+
+// addTokenEffects adds the effects of the token standard methods that move tokens or grant approvals
+func addTokenEffects(effects *transactionEffects, params *transactionParams, method *abi.Method, args []any) {
+	token := strings.ToLower(params.To)
+
+	switch {
+	case method.RawName == "transfer" && len(args) == 2:
+		effects.destinations = append(effects.destinations, args[0].(ethcommon.Address).Hex())
+		effects.spent[token] = args[1].(*big.Int)
+	case method.RawName == "transferFrom" && len(args) == 3:
+		effects.destinations = append(effects.destinations, args[1].(ethcommon.Address).Hex())
+		if args[0].(ethcommon.Address) == ethcommon.HexToAddress(params.From) {
+			effects.spent[token] = args[2].(*big.Int)
+		}
+	case method.RawName == "approve" && len(args) == 2:
+		effects.destinations = append(effects.destinations, args[0].(ethcommon.Address).Hex())
+		addApprovalEffects(effects, token, args[1].(*big.Int))
+	case method.RawName == "approve" && len(args) == 4:
+		// Permit2 approve(token, spender, amount, expiration)
+		effects.destinations = append(effects.destinations, args[1].(ethcommon.Address).Hex())
+		addApprovalEffects(effects, strings.ToLower(args[0].(ethcommon.Address).Hex()), args[2].(*big.Int))
+	case method.RawName == "setApprovalForAll" && len(args) == 2:
+		effects.destinations = append(effects.destinations, args[0].(ethcommon.Address).Hex())
+		effects.unlimitedApproval = args[1].(bool)
+	case (method.RawName == "safeTransferFrom" || method.RawName == "safeBatchTransferFrom") && len(args) >= 3:
+		// ERC-721 and ERC-1155 transfers, both take the receiver as second argument
+		effects.destinations = append(effects.destinations, args[1].(ethcommon.Address).Hex())
+	case method.RawName == "transferFrom" && len(args) == 4:
+		// Permit2 transferFrom(from, to, amount, token)
+		effects.destinations = append(effects.destinations, args[1].(ethcommon.Address).Hex())
+		if args[0].(ethcommon.Address) == ethcommon.HexToAddress(params.From) {
+			effects.spent[strings.ToLower(args[3].(ethcommon.Address).Hex())] = args[2].(*big.Int)
+		}
+	case method.RawName == "transferFrom" && len(args) == 1:
+		// Permit2 batch transferFrom, the receivers are part of the transfer details
+		effects.destinations = append(effects.destinations, structAddresses(args[0], "To")...)
+	case method.RawName == "permitTransferFrom" && len(args) == 4:
+		effects.destinations = append(effects.destinations, structAddresses(args[1], "To")...)
+	case method.RawName == "permit" && len(args) == 3:
+		// Permit2 permit grants an allowance to the spender of the signed permit
+		effects.destinations = append(effects.destinations, structAddresses(args[1], "Spender")...)
+	}
+}
+
+// addApprovalEffects counts a limited approval as spent. Unlimited approvals can not be counted against a spend limit,
+// they are covered by the rule blocking unlimited approvals instead.
+func addApprovalEffects(effects *transactionEffects, token string, amount *big.Int) {
+	if amount.Cmp(unlimitedAllowance) >= 0 {
+		effects.unlimitedApproval = true
+		return
+	}
+
+	effects.spent[token] = amount
+}
+
+// structAddresses returns the address field of a decoded tuple or of every tuple in a decoded array of tuples
+func structAddresses(value any, field string) []string {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		addresses := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			addresses = append(addresses, structAddresses(v.Index(i).Interface(), field)...)
+		}
+		return addresses
+	case reflect.Struct:
+		if f := v.FieldByName(field); f.IsValid() {
+			if address, ok := f.Interface().(ethcommon.Address); ok {
+				return []string{address.Hex()}
+			}
+		}
+	}
+
+	return nil
+}
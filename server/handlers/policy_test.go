@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalsCountAgainstSpendLimits(t *testing.T) {
+	const (
+		wallet  = "0x1111111111111111111111111111111111111111"
+		token   = "0xaAaAaAaaAaAaAaaAaAAAAAAAAaaaAaAaAaaAaaAa"
+		spender = "0x2222222222222222222222222222222222222222"
+		chainID = "0x1"
+	)
+
+	erc20 := findBundledABI("ERC-20")
+	permit2 := findBundledABI("Permit2")
+
+	erc20Approval := func(amount *big.Int) transactionParams {
+		data, err := erc20.Pack("approve", ethcommon.HexToAddress(spender), amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transactionParams{From: wallet, To: token, ChainID: chainID, Input: hexutil.Encode(data)}
+	}
+	permit2Approval := func(amount *big.Int) transactionParams {
+		data, err := permit2.Pack("approve", ethcommon.HexToAddress(token), ethcommon.HexToAddress(spender), amount, big.NewInt(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transactionParams{From: wallet, To: permit2Address.Hex(), ChainID: chainID, Input: hexutil.Encode(data)}
+	}
+
+	tests := []struct {
+		name      string
+		params    transactionParams
+		blocked   bool
+		violation string
+		spent     string
+	}{
+		{name: "erc20 approval within limit", params: erc20Approval(big.NewInt(100)), spent: "100"},
+		{name: "erc20 approval above limit", params: erc20Approval(big.NewInt(101)), violation: policyRuleDailyLimit},
+		{name: "permit2 approval within limit", params: permit2Approval(big.NewInt(100)), spent: "100"},
+		{name: "permit2 approval above limit", params: permit2Approval(big.NewInt(101)), violation: policyRuleDailyLimit},
+		{name: "unlimited approval", params: erc20Approval(unlimitedAllowance)},
+		{name: "unlimited approval blocked", params: erc20Approval(unlimitedAllowance), blocked: true, violation: policyRuleUnlimitedApproval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := models.NewUser("user@example.com", "User")
+			user.Policy.BlockUnlimitedApprovals = tt.blocked
+			user.Policy.SpendLimits = []models.SpendLimit{{Wallet: wallet, ChainID: chainID, Token: token, Daily: "100"}}
+
+			entries, err := evaluatePolicy(&user, &tt.params, 0, time.Now())
+
+			var violation *common.PolicyViolation
+			if tt.violation != "" {
+				if !errors.As(err, &violation) || violation.Rule != tt.violation {
+					t.Fatalf("expected violation of %s, got %v", tt.violation, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			spent := ""
+			for _, entry := range entries {
+				if strings.EqualFold(entry.Token, token) {
+					spent = entry.Amount
+				}
+			}
+			if spent != tt.spent {
+				t.Fatalf("expected %q spent, got %q", tt.spent, spent)
+			}
+		})
+	}
+}
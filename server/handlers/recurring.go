@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const maxRecurringPayments = 20
+
+// runRecurringPayments schedules the due runs of all active recurring payments.
+// The runs are sent by the scheduler like every other scheduled transaction.
+func (a *Api) runRecurringPayments(ctx context.Context) {
+	user, err := a.repo.GetUser()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get user for recurring payments")
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, payment := range user.RecurringPayments {
+		if ctx.Err() != nil {
+			return
+		}
+		if payment.IsDue(now) {
+			a.runRecurringPayment(ctx, payment.ID)
+		}
+	}
+}
+
+// runRecurringPayment schedules the due run of a recurring payment and advances the payment to its next run.
+// The ID of a run is derived from the payment and the time of the run, so a run is scheduled only once
+// even if the enclave stops before the payment has been advanced.
+func (a *Api) runRecurringPayment(ctx context.Context, id string) {
+	a.scheduleMu.Lock()
+	defer a.scheduleMu.Unlock()
+
+	user, err := a.repo.GetUser()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get user for recurring payments")
+		return
+	}
+
+	now := time.Now()
+	payment, ok := user.RecurringPayments[id]
+	if !ok || !payment.IsDue(now.Unix()) {
+		return
+	}
+
+	schedule, err := models.ParseCronSchedule(payment.Schedule)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("recurring payment %s has an invalid schedule", id)
+		return
+	}
+
+	runAt := payment.NextRunAt
+	runID := uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("recurring:%s:%d", id, runAt))).String()
+
+	var skipped string
+	_, err = a.repo.GetScheduledTransaction(runID)
+	if errors.Is(err, common.ErrNotFound) {
+		skipped, err = a.scheduleRecurringRun(ctx, payment, runID, now)
+	}
+	if err != nil {
+		// The run is attempted again on the next run of the scheduler
+		log.Error().Caller().Err(err).Msgf("failed to schedule run of recurring payment %s", id)
+		return
+	}
+
+	updatedUser, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		payment, ok := user.RecurringPayments[id]
+		if !ok || payment.NextRunAt != runAt {
+			return nil
+		}
+
+		if skipped == "" {
+			payment.Runs++
+			payment.AddPaid(1)
+			payment.LastError = ""
+		} else {
+			payment.LastError = skipped
+		}
+		payment.Advance(schedule, now)
+
+		user.RecurringPayments[id] = payment
+		return nil
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to advance recurring payment %s", id)
+		return
+	}
+
+	if skipped != "" {
+		a.notify("Recurring payment skipped", fmt.Sprintf("%s could not be paid, because %s.", payment.Name, skipped))
+	}
+	if updatedUser.RecurringPayments[id].Status == models.RecurringCompleted {
+		a.notify("Recurring payment completed", fmt.Sprintf("%s has reached its end and will not be paid again.", payment.Name))
+	}
+}
+
+// scheduleRecurringRun schedules a run of payment. It returns why the run has been skipped if it can not be paid.
+func (a *Api) scheduleRecurringRun(ctx context.Context, payment models.RecurringPayment, runID string, now time.Time) (string, error) {
+	network, ok := networks.FindByChainIDHex(payment.ChainID)
+	if !ok {
+		return "its network is no longer supported", nil
+	}
+
+	params, amount, err := recurringPaymentParams(payment)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scheduledSendTimeout)
+	defer cancel()
+
+	client, err := ethclient.DialContext(ctx, network.RPC)
+	if err != nil {
+		return "", fmt.Errorf("failed to dial rpc: %w", err)
+	}
+	defer client.Close()
+
+	balance, err := recurringBalance(ctx, client, payment)
+	if err != nil {
+		return "", err
+	}
+	if balance.Cmp(amount) < 0 {
+		return fmt.Sprintf("the balance of %s is too low", payment.From), nil
+	}
+
+	err = a.repo.SaveScheduledTransaction(models.ScheduledTransaction{
+		ID:         runID,
+		Kind:       models.ScheduleKindRecurring,
+		Params:     models.TransactionParams(params),
+		Credential: payment.Credential,
+		Status:     models.ScheduledWaiting,
+		ExecuteAt:  payment.NextRunAt,
+		CreatedAt:  now.Unix(),
+		UpdatedAt:  now.Unix(),
+		Recurring:  payment.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Warns about the next run while there is still time to top up the wallet
+	if balance.Cmp(new(big.Int).Mul(amount, big.NewInt(2))) < 0 {
+		a.notify("Low balance", fmt.Sprintf("The balance of %s is too low for the next payment of %s.", payment.From, payment.Name))
+	}
+
+	return "", nil
+}
+
+// refundRecurringRun removes a run that has not been sent from the total paid by its recurring payment
+func (a *Api) refundRecurringRun(scheduled models.ScheduledTransaction) {
+	if scheduled.Recurring == "" {
+		return
+	}
+
+	_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		payment, ok := user.RecurringPayments[scheduled.Recurring]
+		if !ok {
+			return nil
+		}
+
+		schedule, err := models.ParseCronSchedule(payment.Schedule)
+		if err != nil {
+			return err
+		}
+
+		payment.Refund(schedule, time.Now())
+		user.RecurringPayments[scheduled.Recurring] = payment
+		return nil
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to refund run %s of recurring payment %s", scheduled.ID, scheduled.Recurring)
+	}
+}
+
+// cancelWalletPayments cancels the active recurring payments and the waiting scheduled transactions sent from wallet,
+// which would fail on every run once the wallet has been deleted or archived
+func (a *Api) cancelWalletPayments(c echo.Context, wallet string) error {
+	a.scheduleMu.Lock()
+	defer a.scheduleMu.Unlock()
+
+	now := time.Now().Unix()
+
+	var payments []models.RecurringPayment
+	_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		payments = nil
+		for id, payment := range user.RecurringPayments {
+			if payment.Status != models.RecurringActive || !strings.EqualFold(payment.From, wallet) {
+				continue
+			}
+
+			payment.Status = models.RecurringCancelled
+			payment.UpdatedAt = now
+			user.RecurringPayments[id] = payment
+			payments = append(payments, payment)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scheduled, err := a.repo.GetScheduledTransactions()
+	if err != nil {
+		return err
+	}
+	for _, s := range scheduled {
+		if !s.IsCancellable() || !strings.EqualFold(s.Params.From, wallet) {
+			continue
+		}
+
+		s.Status = models.ScheduledCancelled
+		s.UpdatedAt = now
+
+		err = a.repo.SaveScheduledTransaction(s)
+		if err != nil {
+			return err
+		}
+		a.recordCompletedAuditEvent(c, models.AuditScheduledCancelled, scheduledAuditDetails(s))
+	}
+
+	for _, payment := range payments {
+		a.recordCompletedAuditEvent(c, models.AuditRecurringCancelled, recurringAuditDetails(payment))
+	}
+
+	return nil
+}
+
+// recurringPaymentParams creates the transaction of a single payment and returns it together with the amount it transfers
+func recurringPaymentParams(payment models.RecurringPayment) (transactionParams, *big.Int, error) {
+	amount, ok := new(big.Int).SetString(payment.Amount, 10)
+	if !ok {
+		return transactionParams{}, nil, fmt.Errorf("recurring payment %s has an invalid amount", payment.ID)
+	}
+
+	params := transactionParams{
+		Type:    "0x2",
+		From:    payment.From,
+		To:      payment.To,
+		Value:   hexutil.EncodeBig(amount),
+		ChainID: payment.ChainID,
+	}
+
+	if payment.Token != "" {
+		input, err := findBundledABI("ERC-20").Pack("transfer", ethcommon.HexToAddress(payment.To), amount)
+		if err != nil {
+			return transactionParams{}, nil, fmt.Errorf("failed to pack transfer: %w", err)
+		}
+
+		params.To = payment.Token
+		params.Value = "0x0"
+		params.Input = hexutil.Encode(input)
+	}
+
+	return params, amount, nil
+}
+
+// recurringBalance returns the balance of the paying wallet in the currency of payment.
+// Fees are checked when the transaction is signed.
+func recurringBalance(ctx context.Context, client *ethclient.Client, payment models.RecurringPayment) (*big.Int, error) {
+	owner := ethcommon.HexToAddress(payment.From)
+	if payment.Token == "" {
+		balance, err := client.BalanceAt(ctx, owner, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get current balance: %w", err)
+		}
+
+		return balance, nil
+	}
+
+	erc20 := findBundledABI("ERC-20")
+	data, err := erc20.Pack("balanceOf", owner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack balanceOf: %w", err)
+	}
+
+	token := ethcommon.HexToAddress(payment.Token)
+	result, err := client.CallContract(ctx, ethereum.CallMsg{To: &token, Data: data}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token balance: %w", err)
+	}
+
+	values, err := erc20.Unpack("balanceOf", result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack token balance: %w", err)
+	}
+
+	balance, ok := values[0].(*big.Int)
+	if !ok {
+		return nil, errors.New("token balance is not an integer")
+	}
+
+	return balance, nil
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+)
+
+// Nodes only accept a replacement if every fee is at least this many percent higher than the fee of the replaced transaction
+const minFeeBumpPercent = 10
+
+// cancelGas is the gas of a plain value transfer
+const cancelGas = 21000
+
+type replacementFees struct {
+	GasPrice             string `json:"gas_price" validate:"omitempty,hexadecimal"`
+	MaxFeePerGas         string `json:"max_fee_per_gas" validate:"omitempty,hexadecimal"`
+	MaxPriorityFeePerGas string `json:"max_priority_fee_per_gas" validate:"omitempty,hexadecimal"`
+}
+
+// createReplacementParams returns the params of a transaction that replaces record using the same nonce.
+// A cancellation is a zero value transfer to the sending wallet itself.
+func createReplacementParams(ctx context.Context, client *ethclient.Client, record models.TransactionRecord, cancel bool, fees replacementFees) (*transactionParams, error) {
+	record, err := completeRecordFees(ctx, client, record)
+	if err != nil {
+		return nil, err
+	}
+
+	params := transactionParams(record.Params)
+	params.Type = record.Type
+	params.Nonce = hexutil.EncodeUint64(record.Nonce)
+	params.Gas = hexutil.EncodeUint64(record.Gas)
+
+	if cancel {
+		params.To = record.From
+		params.Value = "0x0"
+		params.Input = ""
+		params.AccessList = nil
+		params.Gas = hexutil.EncodeUint64(cancelGas)
+	}
+
+	if record.Type == "0x2" {
+		tipCap, err := bumpFee(record.MaxPriorityFeePerGas, fees.MaxPriorityFeePerGas, func() (*big.Int, error) {
+			return client.SuggestGasTipCap(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		feeCap, err := bumpFee(record.MaxFeePerGas, fees.MaxFeePerGas, func() (*big.Int, error) {
+			return client.SuggestGasPrice(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if feeCap.Cmp(tipCap) < 0 {
+			feeCap = tipCap
+		}
+
+		// createDynamicFeeTransaction reads the fee cap from GasPrice
+		params.GasPrice = hexutil.EncodeBig(feeCap)
+		params.MaxFeePerGas = hexutil.EncodeBig(feeCap)
+		params.MaxPriorityFeePerGas = hexutil.EncodeBig(tipCap)
+	} else {
+		gasPrice, err := bumpFee(record.GasPrice, fees.GasPrice, func() (*big.Int, error) {
+			return client.SuggestGasPrice(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		params.GasPrice = hexutil.EncodeBig(gasPrice)
+	}
+
+	return &params, nil
+}
+
+// bumpFee returns the requested fee if it satisfies the minimum bump of previous.
+// Without a requested fee, the higher of the minimum bump and the suggested fee is used.
+func bumpFee(previous string, requested string, suggest func() (*big.Int, error)) (*big.Int, error) {
+	previousFee, ok := new(big.Int).SetString(previous, 10)
+	if !ok {
+		return nil, fmt.Errorf("fee %s of replaced transaction is invalid", previous)
+	}
+	minimum := minimumBumpedFee(previousFee)
+
+	if requested != "" {
+		fee, err := hexutil.DecodeBig(replaceLeadingZeroesFromHexNumber(requested))
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Fee is invalid").SetInternal(err)
+		}
+		if fee.Cmp(minimum) < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Fee must be at least %s to replace the transaction", minimum))
+		}
+
+		return fee, nil
+	}
+
+	suggested, err := suggest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to suggest fee: %w", err)
+	}
+	if suggested.Cmp(minimum) > 0 {
+		return suggested, nil
+	}
+
+	return minimum, nil
+}
+
+// minimumBumpedFee rounds up, so the result is never below the limit enforced by nodes
+func minimumBumpedFee(fee *big.Int) *big.Int {
+	bumped := new(big.Int).Mul(fee, big.NewInt(100+minFeeBumpPercent))
+	bumped.Add(bumped, big.NewInt(99))
+	return bumped.Div(bumped, big.NewInt(100))
+}
+
+// completeRecordFees fetches the fees of transactions that were recorded before their fees were stored
+func completeRecordFees(ctx context.Context, client *ethclient.Client, record models.TransactionRecord) (models.TransactionRecord, error) {
+	if record.Type != "" {
+		return record, nil
+	}
+
+	tx, _, err := client.TransactionByHash(ctx, common.HexToHash(record.Hash))
+	if err != nil {
+		return models.TransactionRecord{}, fmt.Errorf("failed to get transaction: %w", err)
+	}
+
+	record.Gas = tx.Gas()
+	if tx.Type() == types.DynamicFeeTxType {
+		record.Type = "0x2"
+		record.MaxFeePerGas = tx.GasFeeCap().String()
+		record.MaxPriorityFeePerGas = tx.GasTipCap().String()
+	} else {
+		record.Type = "0x1"
+		record.GasPrice = tx.GasPrice().String()
+	}
+
+	return record, nil
+}
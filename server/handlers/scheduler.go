@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	schedulerInterval    = 30 * time.Second
+	scheduledSendTimeout = 30 * time.Second
+)
+
+// RunScheduler schedules the runs of recurring payments and sends due scheduled transactions until ctx is cancelled.
+// It starts with a run, so transactions that became due while the enclave was down are sent right away.
+func (a *Api) RunScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		a.runRecurringPayments(ctx)
+		a.runScheduledTransactions(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Api) runScheduledTransactions(ctx context.Context) {
+	scheduled, err := a.repo.GetScheduledTransactions()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get scheduled transactions")
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, s := range scheduled {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.IsDue(now) {
+			a.runScheduledTransaction(ctx, s.ID)
+		}
+	}
+}
+
+// runScheduledTransaction sends a due transaction. Failed attempts are repeated on the next runs
+// until MaxScheduledAttempts is reached, policy violations fail right away.
+func (a *Api) runScheduledTransaction(ctx context.Context, id string) {
+	a.scheduleMu.Lock()
+	defer a.scheduleMu.Unlock()
+
+	// Loaded again while holding the lock, because the transaction might have been cancelled in the meantime
+	scheduled, err := a.repo.GetScheduledTransaction(id)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to get scheduled transaction %s", id)
+		return
+	}
+	if !scheduled.IsDue(time.Now().Unix()) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, scheduledSendTimeout)
+	defer cancel()
+
+	err = a.sendScheduledTransaction(ctx, &scheduled)
+	if err == nil {
+		a.completeScheduledTransaction(scheduled)
+		return
+	}
+
+	scheduled.Attempts++
+	scheduled.UpdatedAt = time.Now().Unix()
+
+	var violation *common.PolicyViolation
+	if errors.As(err, &violation) || scheduled.Attempts >= models.MaxScheduledAttempts {
+		a.failScheduledTransaction(scheduled, err)
+		return
+	}
+
+	log.Warn().Caller().Err(err).Msgf("attempt %d to send scheduled transaction %s failed", scheduled.Attempts, id)
+	err = a.repo.SaveScheduledTransaction(scheduled)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save scheduled transaction %s", id)
+	}
+}
+
+// sendScheduledTransaction signs the transaction unless it has been signed before and broadcasts it
+func (a *Api) sendScheduledTransaction(ctx context.Context, scheduled *models.ScheduledTransaction) error {
+	network, ok := networks.FindByChainIDHex(scheduled.Params.ChainID)
+	if !ok {
+		return fmt.Errorf("network %s does not exist", scheduled.Params.ChainID)
+	}
+
+	client, err := ethclient.DialContext(ctx, network.RPC)
+	if err != nil {
+		return fmt.Errorf("failed to dial rpc: %w", err)
+	}
+	defer client.Close()
+
+	if scheduled.Status == models.ScheduledWaiting {
+		err = a.signScheduledTransaction(ctx, client, network, scheduled)
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, err := hexutil.Decode(scheduled.RawTransaction)
+	if err != nil {
+		return fmt.Errorf("failed to decode signed tx: %w", err)
+	}
+
+	tx := new(types.Transaction)
+	err = tx.UnmarshalBinary(raw)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal signed tx: %w", err)
+	}
+
+	err = client.SendTransaction(ctx, tx)
+	if err != nil {
+		// A broadcast repeated after a restart is rejected if the node already knows the transaction
+		if _, _, lookupErr := client.TransactionByHash(ctx, tx.Hash()); lookupErr != nil {
+			return fmt.Errorf("failed to send tx: %w", err)
+		}
+	}
+
+	params := transactionParams(scheduled.Params)
+	err = a.repo.SaveTransaction(newTransactionRecord(&params, tx, scheduled.Credential))
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save sent scheduled transaction %s", scheduled.ID)
+	}
+
+	return nil
+}
+
+// signScheduledTransaction reserves a nonce, evaluates the policy at the time of sending and stores the signed transaction
+// before it is broadcast, so an interrupted broadcast is repeated with the same transaction
+func (a *Api) signScheduledTransaction(ctx context.Context, client *ethclient.Client, network models.Network, scheduled *models.ScheduledTransaction) error {
+	params := transactionParams(scheduled.Params)
+
+	pendingNonce, err := client.PendingNonceAt(ctx, ethcommon.HexToAddress(params.From))
+	if err != nil {
+		return fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	user, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		now := time.Now()
+		nonce := user.ReserveNonce(params.ChainID, params.From, pendingNonce, "", now.Unix(), now.Add(signedNonceTTL).Unix())
+		params.Nonce = hexutil.EncodeUint64(nonce)
+
+		spent, err := evaluatePolicy(user, &params, nonce, now)
+		if err != nil {
+			return err
+		}
+
+		user.RecordSpend(params.From, params.ChainID, nonce, spent, now.Unix())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	signedTx, err := createSignedTransaction(user, &params, network, client, ctx)
+	if err != nil {
+		a.releaseNonce(&params)
+		return err
+	}
+
+	raw, err := signedTx.MarshalBinary()
+	if err != nil {
+		a.releaseNonce(&params)
+		return fmt.Errorf("failed to marshal signed tx: %w", err)
+	}
+
+	scheduled.Params = models.TransactionParams(params)
+	scheduled.RawTransaction = hexutil.Encode(raw)
+	scheduled.Hash = signedTx.Hash().Hex()
+	scheduled.Status = models.ScheduledSending
+	scheduled.UpdatedAt = time.Now().Unix()
+
+	err = a.repo.SaveScheduledTransaction(*scheduled)
+	if err != nil {
+		a.releaseNonce(&params)
+		return err
+	}
+
+	return nil
+}
+
+func (a *Api) completeScheduledTransaction(scheduled models.ScheduledTransaction) {
+	scheduled.Status = models.ScheduledSent
+	scheduled.RawTransaction = ""
+	scheduled.UpdatedAt = time.Now().Unix()
+
+	err := a.repo.SaveScheduledTransaction(scheduled)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save scheduled transaction %s", scheduled.ID)
+	}
+
+	err = a.recordAuditEventWithCredential(models.AuditScheduledSent, scheduled.Credential, scheduledAuditDetails(scheduled))
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to record sent scheduled transaction %s", scheduled.ID)
+	}
+
+	a.notify("Scheduled transaction sent", fmt.Sprintf("Your scheduled transaction from %s to %s has been sent as %s.", scheduled.Params.From, scheduled.Params.To, scheduled.Hash))
+}
+
+// failScheduledTransaction gives back the nonce of a transaction that has been signed but could not be sent
+func (a *Api) failScheduledTransaction(scheduled models.ScheduledTransaction, cause error) {
+	log.Error().Caller().Err(cause).Msgf("scheduled transaction %s failed", scheduled.ID)
+
+	if scheduled.Status == models.ScheduledSending {
+		params := transactionParams(scheduled.Params)
+		a.releaseNonce(&params)
+	}
+	a.refundRecurringRun(scheduled)
+
+	scheduled.Status = models.ScheduledFailed
+	scheduled.RawTransaction = ""
+	scheduled.Error = cause.Error()
+
+	err := a.repo.SaveScheduledTransaction(scheduled)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to save scheduled transaction %s", scheduled.ID)
+	}
+
+	details := scheduledAuditDetails(scheduled)
+	details["error"] = scheduled.Error
+	err = a.recordAuditEventWithCredential(models.AuditScheduledFailed, scheduled.Credential, details)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to record failed scheduled transaction %s", scheduled.ID)
+	}
+
+	reason := fmt.Sprintf("it failed %d times", scheduled.Attempts)
+	var violation *common.PolicyViolation
+	if errors.As(cause, &violation) {
+		reason = violation.Message
+	}
+	a.notify("Scheduled transaction failed", fmt.Sprintf("Your scheduled transaction from %s to %s could not be sent, because %s.", scheduled.Params.From, scheduled.Params.To, reason))
+}
+
+// scheduleTransaction stores the user, whose ceremony has been finalized, and schedules the transaction for executeAt.
+// The nonce is chosen when the transaction is sent, so a nonce reserved by the ceremony is given back.
+func (a *Api) scheduleTransaction(c echo.Context, user models.User, params *transactionParams, credential, kind string, executeAt time.Time) error {
+	if nonce, err := parseReservedNonce(params); err == nil {
+		user.ReleaseNonce(params.ChainID, params.From, nonce)
+		user.RemoveSpend(params.From, params.ChainID, nonce)
+	}
+	params.Nonce = ""
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("failed to generate scheduled transaction id: %w", err)
+	}
+
+	err = a.repo.UpsertUser(user)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	scheduled := models.ScheduledTransaction{
+		ID:         id.String(),
+		Kind:       kind,
+		Params:     models.TransactionParams(*params),
+		Credential: credential,
+		Status:     models.ScheduledWaiting,
+		ExecuteAt:  executeAt.Unix(),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	err = a.repo.SaveScheduledTransaction(scheduled)
+	if err != nil {
+		return err
+	}
+
+	auditEventType := models.AuditTransactionScheduled
+	if kind == models.ScheduleKindTimeLocked {
+		auditEventType = models.AuditTransactionTimeLocked
+	}
+	a.recordCompletedAuditEvent(c, auditEventType, scheduledAuditDetails(scheduled))
+
+	if kind == models.ScheduleKindTimeLocked {
+		a.notify("Transaction delayed", fmt.Sprintf("Your transaction from %s to %s will be sent at %s. Cancel it if this was not you.", params.From, params.To, executeAt.UTC().Format(time.RFC1123)))
+	}
+
+	return c.JSON(http.StatusAccepted, scheduled)
+}
+
+// transactionDelay returns the longest delay of the delay rules that apply to the transaction
+func transactionDelay(user models.User, params *transactionParams) (time.Duration, error) {
+	effects, err := analyzeTransaction(params)
+	if err != nil {
+		return 0, err
+	}
+
+	var delay time.Duration
+	for _, rule := range user.Policy.DelayRules {
+		if d := time.Duration(rule.Delay) * time.Second; d > delay && rule.AppliesTo(params.ChainID, effects.spent) {
+			delay = d
+		}
+	}
+
+	return delay, nil
+}
+
+// checkTimeLock rejects signing transactions covered by a delay rule, because a signed transaction can be sent right away
+func checkTimeLock(user models.User, params *transactionParams) error {
+	delay, err := transactionDelay(user, params)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		return &common.PolicyViolation{
+			Rule:    policyRuleTimeLock,
+			Message: fmt.Sprintf("The policy delays this transaction by %s, so it can only be sent by the wallet", delay),
+		}
+	}
+
+	return nil
+}
+
+// notify sends a notification to the user. Failures are only logged, because the operation it reports has already happened.
+func (a *Api) notify(title, body string) {
+	user, err := a.repo.GetUser()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get user for notification")
+		return
+	}
+
+	backendApiClient, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create backend api client")
+		return
+	}
+
+	err = backendApiClient.SendNotification(title, body)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to send notification")
+	}
+}
+
+func scheduledAuditDetails(scheduled models.ScheduledTransaction) map[string]string {
+	return map[string]string{
+		"id":         scheduled.ID,
+		"kind":       scheduled.Kind,
+		"from":       scheduled.Params.From,
+		"to":         scheduled.Params.To,
+		"value":      scheduled.Params.Value,
+		"chain_id":   scheduled.Params.ChainID,
+		"execute_at": strconv.FormatInt(scheduled.ExecuteAt, 10),
+		"hash":       scheduled.Hash,
+	}
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const simulationTimeout = 10 * time.Second
+
+const (
+	effectNativeTransfer  = "native_transfer"
+	effectERC20Transfer   = "erc20_transfer"
+	effectERC721Transfer  = "erc721_transfer"
+	effectERC1155Transfer = "erc1155_transfer"
+	effectERC20Approval   = "erc20_approval"
+	effectERC721Approval  = "erc721_approval"
+	effectApprovalForAll  = "approval_for_all"
+)
+
+var (
+	transferEventTopic       = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	approvalEventTopic       = crypto.Keccak256Hash([]byte("Approval(address,address,uint256)"))
+	approvalForAllEventTopic = crypto.Keccak256Hash([]byte("ApprovalForAll(address,address,bool)"))
+	transferSingleEventTopic = crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)"))
+	transferBatchEventTopic  = crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])"))
+
+	// Selector of Panic(uint256), which is returned by failed asserts and arithmetic errors
+	panicSelector = crypto.Keccak256([]byte("Panic(uint256)"))[:4]
+)
+
+type simulatedEffect struct {
+	Type        string `json:"type"`
+	Token       string `json:"token,omitempty"` //Contract address, empty for native transfers
+	From        string `json:"from"`            //Owner for approvals
+	To          string `json:"to"`              //Spender or operator for approvals
+	Amount      string `json:"amount,omitempty"`
+	TokenID     string `json:"token_id,omitempty"`
+	Approved    *bool  `json:"approved,omitempty"`
+	Description string `json:"description"`
+}
+
+type simulation struct {
+	Success      bool              `json:"success"`
+	RevertReason string            `json:"revert_reason,omitempty"`
+	GasUsed      uint64            `json:"gas_used,omitempty"`
+	Traced       bool              `json:"traced"` //Token events are only known if the node supports debug_traceCall
+	Effects      []simulatedEffect `json:"effects"`
+	Error        string            `json:"error,omitempty"` //Set if the transaction could not be simulated at all
+}
+
+type callFrame struct {
+	Type         string          `json:"type"`
+	From         common.Address  `json:"from"`
+	To           *common.Address `json:"to"`
+	Value        *hexutil.Big    `json:"value"`
+	GasUsed      hexutil.Uint64  `json:"gasUsed"`
+	Error        string          `json:"error"`
+	RevertReason string          `json:"revertReason"`
+	Output       hexutil.Bytes   `json:"output"`
+	Calls        []callFrame     `json:"calls"`
+	Logs         []callLog       `json:"logs"`
+}
+
+type callLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+}
+
+// simulateTransaction executes params against the latest block without sending it.
+// Simulation problems never fail the request, they are reported in the result instead.
+func simulateTransaction(ctx context.Context, params *transactionParams, network models.Network) *simulation {
+	ctx, cancel := context.WithTimeout(ctx, simulationTimeout)
+	defer cancel()
+
+	result := &simulation{
+		Effects: make([]simulatedEffect, 0),
+	}
+
+	msg, err := simulationCallMsg(params)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	client, err := ethclient.DialContext(ctx, network.RPC)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to dial rpc: %s", err)
+		return result
+	}
+	defer client.Close()
+
+	frame, err := traceCall(ctx, client, msg)
+	if err == nil {
+		result.Traced = true
+		result.GasUsed = uint64(frame.GasUsed)
+		result.Success = frame.Error == ""
+		if !result.Success {
+			result.RevertReason = frameRevertReason(frame)
+		}
+		collectEffects(frame, network, result)
+		return result
+	}
+
+	// The node does not support tracing, so only the outcome and the native value of the call are known
+	_, err = client.CallContract(ctx, msg, nil)
+	if err != nil {
+		var dataErr rpc.DataError
+		if !errors.As(err, &dataErr) && !strings.Contains(err.Error(), "revert") {
+			result.Error = fmt.Sprintf("failed to call: %s", err)
+			return result
+		}
+
+		result.RevertReason = callErrorRevertReason(err)
+		return result
+	}
+
+	result.Success = true
+	if msg.Value.Sign() > 0 && msg.To != nil {
+		result.Effects = append(result.Effects, nativeTransferEffect(msg.From, *msg.To, msg.Value, network))
+	}
+
+	return result
+}
+
+func simulationCallMsg(params *transactionParams) (ethereum.CallMsg, error) {
+	value, err := parseValue(params.Value)
+	if err != nil {
+		return ethereum.CallMsg{}, err
+	}
+
+	data, err := parseData(params.Input)
+	if err != nil {
+		return ethereum.CallMsg{}, err
+	}
+
+	msg := ethereum.CallMsg{
+		From:  common.HexToAddress(params.From),
+		Value: value,
+		Data:  data,
+	}
+	// Contract creations have no recipient
+	if params.To != "" {
+		to := common.HexToAddress(params.To)
+		msg.To = &to
+	}
+	if params.AccessList != nil {
+		msg.AccessList = *params.AccessList
+	}
+	if params.Gas != "" {
+		msg.Gas, err = hexutil.DecodeUint64(replaceLeadingZeroesFromHexNumber(params.Gas))
+		if err != nil {
+			return ethereum.CallMsg{}, fmt.Errorf("gas is invalid: %w", err)
+		}
+	}
+
+	return msg, nil
+}
+
+func traceCall(ctx context.Context, client *ethclient.Client, msg ethereum.CallMsg) (*callFrame, error) {
+	call := traceCallObject(msg)
+
+	config := map[string]any{
+		"tracer":       "callTracer",
+		"tracerConfig": map[string]any{"withLog": true},
+	}
+
+	var frame callFrame
+	err := client.Client().CallContext(ctx, &frame, "debug_traceCall", call, "latest", config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &frame, nil
+}
+
+// traceCallObject converts msg to the call object of debug_traceCall
+func traceCallObject(msg ethereum.CallMsg) map[string]any {
+	call := map[string]any{
+		"from":  msg.From,
+		"value": (*hexutil.Big)(msg.Value),
+		"data":  hexutil.Bytes(msg.Data),
+	}
+	if msg.To != nil {
+		call["to"] = msg.To
+	}
+	if msg.Gas != 0 {
+		call["gas"] = hexutil.Uint64(msg.Gas)
+	}
+	if len(msg.AccessList) > 0 {
+		call["accessList"] = msg.AccessList
+	}
+
+	return call
+}
+
+// collectEffects walks the call tree in execution order. Logs of reverted calls are dropped by the tracer.
+func collectEffects(frame *callFrame, network models.Network, result *simulation) {
+	if frame.Value != nil && frame.Value.ToInt().Sign() > 0 && frame.To != nil && frame.Type != "DELEGATECALL" {
+		result.Effects = append(result.Effects, nativeTransferEffect(frame.From, *frame.To, frame.Value.ToInt(), network))
+	}
+
+	for _, log := range frame.Logs {
+		if effect, ok := decodeEffect(log, network); ok {
+			result.Effects = append(result.Effects, effect)
+		}
+	}
+
+	for i := range frame.Calls {
+		collectEffects(&frame.Calls[i], network, result)
+	}
+}
+
+func nativeTransferEffect(from, to common.Address, value *big.Int, network models.Network) simulatedEffect {
+	return simulatedEffect{
+		Type:        effectNativeTransfer,
+		From:        from.Hex(),
+		To:          to.Hex(),
+		Amount:      value.String(),
+		Description: fmt.Sprintf("%s sends %s %s to %s", from.Hex(), formatUnits(value, network.Decimals), network.Currency, to.Hex()),
+	}
+}
+
+// decodeEffect decodes the standard ERC-20, ERC-721 and ERC-1155 transfer and approval events
+func decodeEffect(log callLog, network models.Network) (simulatedEffect, bool) {
+	if len(log.Topics) == 0 {
+		return simulatedEffect{}, false
+	}
+
+	token := log.Address.Hex()
+	symbol, decimals := tokenDisplay(log.Address, network)
+
+	switch {
+	case log.Topics[0] == transferEventTopic && len(log.Topics) == 3 && len(log.Data) == 32:
+		from, to := topicAddress(log.Topics[1]), topicAddress(log.Topics[2])
+		amount := new(big.Int).SetBytes(log.Data)
+		return simulatedEffect{
+			Type:        effectERC20Transfer,
+			Token:       token,
+			From:        from,
+			To:          to,
+			Amount:      amount.String(),
+			Description: fmt.Sprintf("%s sends %s %s to %s", from, formatAmount(amount, decimals), symbol, to),
+		}, true
+	case log.Topics[0] == transferEventTopic && len(log.Topics) == 4:
+		from, to := topicAddress(log.Topics[1]), topicAddress(log.Topics[2])
+		tokenID := log.Topics[3].Big()
+		return simulatedEffect{
+			Type:        effectERC721Transfer,
+			Token:       token,
+			From:        from,
+			To:          to,
+			TokenID:     tokenID.String(),
+			Description: fmt.Sprintf("%s sends NFT #%s of %s to %s", from, tokenID, symbol, to),
+		}, true
+	case log.Topics[0] == approvalEventTopic && len(log.Topics) == 3 && len(log.Data) == 32:
+		owner, spender := topicAddress(log.Topics[1]), topicAddress(log.Topics[2])
+		amount := new(big.Int).SetBytes(log.Data)
+		description := fmt.Sprintf("%s allows %s to spend %s %s", owner, spender, formatAmount(amount, decimals), symbol)
+		if amount.Cmp(abi.MaxUint256) == 0 {
+			description = fmt.Sprintf("%s allows %s to spend an unlimited amount of %s", owner, spender, symbol)
+		}
+		return simulatedEffect{
+			Type:        effectERC20Approval,
+			Token:       token,
+			From:        owner,
+			To:          spender,
+			Amount:      amount.String(),
+			Description: description,
+		}, true
+	case log.Topics[0] == approvalEventTopic && len(log.Topics) == 4:
+		owner, spender := topicAddress(log.Topics[1]), topicAddress(log.Topics[2])
+		tokenID := log.Topics[3].Big()
+		return simulatedEffect{
+			Type:        effectERC721Approval,
+			Token:       token,
+			From:        owner,
+			To:          spender,
+			TokenID:     tokenID.String(),
+			Description: fmt.Sprintf("%s allows %s to transfer NFT #%s of %s", owner, spender, tokenID, symbol),
+		}, true
+	case log.Topics[0] == approvalForAllEventTopic && len(log.Topics) == 3 && len(log.Data) == 32:
+		owner, operator := topicAddress(log.Topics[1]), topicAddress(log.Topics[2])
+		approved := new(big.Int).SetBytes(log.Data).Sign() != 0
+		description := fmt.Sprintf("%s allows %s to transfer all tokens of %s", owner, operator, symbol)
+		if !approved {
+			description = fmt.Sprintf("%s revokes the permission of %s to transfer all tokens of %s", owner, operator, symbol)
+		}
+		return simulatedEffect{
+			Type:        effectApprovalForAll,
+			Token:       token,
+			From:        owner,
+			To:          operator,
+			Approved:    &approved,
+			Description: description,
+		}, true
+	case log.Topics[0] == transferSingleEventTopic && len(log.Topics) == 4 && len(log.Data) == 64:
+		from, to := topicAddress(log.Topics[2]), topicAddress(log.Topics[3])
+		tokenID := new(big.Int).SetBytes(log.Data[:32])
+		amount := new(big.Int).SetBytes(log.Data[32:])
+		return simulatedEffect{
+			Type:        effectERC1155Transfer,
+			Token:       token,
+			From:        from,
+			To:          to,
+			TokenID:     tokenID.String(),
+			Amount:      amount.String(),
+			Description: fmt.Sprintf("%s sends %s of token #%s of %s to %s", from, amount, tokenID, symbol, to),
+		}, true
+	case log.Topics[0] == transferBatchEventTopic && len(log.Topics) == 4:
+		from, to := topicAddress(log.Topics[2]), topicAddress(log.Topics[3])
+		ids, amounts, ok := decodeTransferBatch(log.Data)
+		if !ok {
+			return simulatedEffect{}, false
+		}
+		parts := make([]string, len(ids))
+		for i := range ids {
+			parts[i] = fmt.Sprintf("%s of token #%s", amounts[i], ids[i])
+		}
+		return simulatedEffect{
+			Type:        effectERC1155Transfer,
+			Token:       token,
+			From:        from,
+			To:          to,
+			Description: fmt.Sprintf("%s sends %s of %s to %s", from, strings.Join(parts, ", "), symbol, to),
+		}, true
+	}
+
+	return simulatedEffect{}, false
+}
+
+func decodeTransferBatch(data []byte) ([]*big.Int, []*big.Int, bool) {
+	uintArray, err := abi.NewType("uint256[]", "", nil)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	values, err := abi.Arguments{{Type: uintArray}, {Type: uintArray}}.Unpack(data)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	ids, ok := values[0].([]*big.Int)
+	if !ok {
+		return nil, nil, false
+	}
+	amounts, ok := values[1].([]*big.Int)
+	if !ok || len(ids) != len(amounts) {
+		return nil, nil, false
+	}
+
+	return ids, amounts, true
+}
+
+// tokenDisplay returns the symbol and decimals of configured tokens. Unknown tokens are shown by address with raw amounts.
+func tokenDisplay(address common.Address, network models.Network) (string, int64) {
+	for _, token := range tokens[network.ChainIDHex] {
+		if common.HexToAddress(token.Address) == address {
+			return token.Symbol, token.Decimals
+		}
+	}
+
+	return address.Hex(), -1
+}
+
+func topicAddress(topic common.Hash) string {
+	return common.BytesToAddress(topic.Bytes()).Hex()
+}
+
+func formatAmount(amount *big.Int, decimals int64) string {
+	if decimals < 0 {
+		return amount.String()
+	}
+
+	return formatUnits(amount, decimals)
+}
+
+// formatUnits formats amount as a decimal number with the given number of decimals without losing precision
+func formatUnits(amount *big.Int, decimals int64) string {
+	divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(decimals), nil)
+	integer, fraction := new(big.Int).QuoRem(new(big.Int).Abs(amount), divisor, new(big.Int))
+
+	formatted := integer.String()
+	if fraction.Sign() != 0 {
+		digits := fmt.Sprintf("%0*s", decimals, fraction.String())
+		formatted += "." + strings.TrimRight(digits, "0")
+	}
+	if amount.Sign() < 0 {
+		formatted = "-" + formatted
+	}
+
+	return formatted
+}
+
+func frameRevertReason(frame *callFrame) string {
+	if frame.RevertReason != "" {
+		return frame.RevertReason
+	}
+	if reason, ok := decodeRevertData(frame.Output); ok {
+		return reason
+	}
+
+	return frame.Error
+}
+
+func callErrorRevertReason(err error) string {
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if data, ok := dataErr.ErrorData().(string); ok {
+			if decoded, decodeErr := hexutil.Decode(data); decodeErr == nil {
+				if reason, ok := decodeRevertData(decoded); ok {
+					return reason
+				}
+			}
+		}
+	}
+
+	return err.Error()
+}
+
+// decodeRevertData decodes Error(string) and Panic(uint256) revert data
+func decodeRevertData(data []byte) (string, bool) {
+	if reason, err := abi.UnpackRevert(data); err == nil {
+		return reason, true
+	}
+	if len(data) == 36 && bytes.Equal(data[:4], panicSelector) {
+		return fmt.Sprintf("panic with code 0x%x", new(big.Int).SetBytes(data[4:])), true
+	}
+
+	return "", false
+}
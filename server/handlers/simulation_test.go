@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/core/types"
+	"strings"
+	"testing"
+)
+
+func TestSimulationCallMsg(t *testing.T) {
+	accessList := types.AccessList{{Address: [20]byte{1}}}
+	params := transactionParams{
+		From:       "0x1111111111111111111111111111111111111111",
+		Value:      "0x1",
+		Input:      "0x6080",
+		Gas:        "0x5208",
+		AccessList: &accessList,
+	}
+
+	// Without a recipient the transaction creates a contract
+	msg, err := simulationCallMsg(&params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To != nil {
+		t.Errorf("expected no recipient, got %s", msg.To)
+	}
+
+	call, err := json.Marshal(traceCallObject(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(call), `"to"`) {
+		t.Errorf("the call object of a contract creation has a recipient: %s", call)
+	}
+	if !strings.Contains(string(call), `"accessList":[{"address":"0x0100000000000000000000000000000000000000"`) {
+		t.Errorf("the call object is missing the access list: %s", call)
+	}
+
+	params.To = "0x2222222222222222222222222222222222222222"
+	msg, err = simulationCallMsg(&params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.To == nil || msg.To.Hex() != params.To {
+		t.Errorf("expected recipient %s, got %v", params.To, msg.To)
+	}
+}
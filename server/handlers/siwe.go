@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	siweHeaderSuffix = " wants you to sign in with your Ethereum account:"
+	// Tolerated difference between the clocks of the site and the enclave
+	siweClockSkew = 5 * time.Minute
+)
+
+const (
+	siweTrustedByOrigin    = "origin"
+	siweTrustedByAllowlist = "allowlist"
+)
+
+var siweNonceRegex = regexp.MustCompile("^[a-zA-Z0-9]{8,}$")
+
+// siweMessage is a parsed EIP-4361 Sign-In with Ethereum message. It is shown to the user before the message is signed.
+type siweMessage struct {
+	Scheme         string   `json:"scheme,omitempty"`
+	Domain         string   `json:"domain"`
+	Address        string   `json:"address"`
+	Statement      string   `json:"statement"`
+	URI            string   `json:"uri"`
+	Version        string   `json:"version"`
+	ChainID        int64    `json:"chain_id"`
+	Network        string   `json:"network"` //Empty if the chain is not supported by the enclave
+	Nonce          string   `json:"nonce"`
+	IssuedAt       int64    `json:"issued_at"`
+	ExpirationTime int64    `json:"expiration_time,omitempty"`
+	NotBefore      int64    `json:"not_before,omitempty"`
+	RequestID      string   `json:"request_id,omitempty"`
+	Resources      []string `json:"resources"`
+	TrustedBy      string   `json:"trusted_by"` //Whether the domain matched the requesting origin or the allowlist of the policy
+}
+
+// isSIWEMessage also detects headers that are not terminated exactly like EIP-4361 requires,
+// so that messages with other line endings are rejected instead of being signed as plain messages
+func isSIWEMessage(message string) bool {
+	header, _, _ := strings.Cut(message, "\n")
+	return strings.Contains(header, strings.TrimSuffix(siweHeaderSuffix, ":"))
+}
+
+// checkSignIn parses and validates message if it is a Sign-In with Ethereum message and returns nil otherwise.
+// The domain of the message has to match the origin that requested the signature or a trusted domain of the policy.
+func checkSignIn(user models.User, message, from, origin string, now time.Time) (*siweMessage, error) {
+	if !isSIWEMessage(message) {
+		return nil, nil
+	}
+
+	msg, err := parseSIWEMessage(message)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid Sign-In with Ethereum message: %s", err.Error()))
+	}
+
+	err = msg.validate(from, now)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid Sign-In with Ethereum message: %s", err.Error()))
+	}
+
+	if network, ok := networks.FindByChainIDHex(hexutil.EncodeUint64(uint64(msg.ChainID))); ok {
+		msg.Network = network.Name
+	}
+
+	msg.TrustedBy, err = msg.trust(user.Policy, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// parseSIWEMessage parses message according to the ABNF of EIP-4361
+func parseSIWEMessage(message string) (*siweMessage, error) {
+	if strings.Contains(message, "\r") {
+		return nil, errors.New("lines must be terminated by \\n only")
+	}
+
+	lines := strings.Split(message, "\n")
+	if len(lines) < 2 {
+		return nil, errors.New("the message is incomplete")
+	}
+
+	msg := &siweMessage{Resources: make([]string, 0)}
+
+	authority := strings.TrimSuffix(lines[0], siweHeaderSuffix)
+	if scheme, domain, ok := strings.Cut(authority, "://"); ok {
+		msg.Scheme = scheme
+		msg.Domain = domain
+	} else {
+		msg.Domain = authority
+	}
+	if msg.Domain == "" || strings.ContainsAny(msg.Domain, " /") {
+		return nil, errors.New("the domain is invalid")
+	}
+
+	msg.Address = lines[1]
+	if !ethcommon.IsHexAddress(msg.Address) || ethcommon.HexToAddress(msg.Address).Hex() != msg.Address {
+		return nil, errors.New("the address must be an EIP-55 checksummed address")
+	}
+
+	i := 2
+	skipBlank := func() {
+		for i < len(lines) && lines[i] == "" {
+			i++
+		}
+	}
+	field := func(tag string) (string, bool) {
+		if i < len(lines) && strings.HasPrefix(lines[i], tag+": ") {
+			i++
+			return strings.TrimPrefix(lines[i-1], tag+": "), true
+		}
+		return "", false
+	}
+	requiredField := func(tag string) (string, error) {
+		value, ok := field(tag)
+		if !ok {
+			return "", fmt.Errorf("the field %s is missing", tag)
+		}
+		return value, nil
+	}
+
+	skipBlank()
+	if i < len(lines) && !strings.HasPrefix(lines[i], "URI: ") {
+		msg.Statement = lines[i]
+		i++
+		skipBlank()
+	}
+
+	var err error
+	if msg.URI, err = requiredField("URI"); err != nil {
+		return nil, err
+	}
+	if uri, err := url.Parse(msg.URI); err != nil || !uri.IsAbs() {
+		return nil, errors.New("the uri must be an absolute uri")
+	}
+
+	if msg.Version, err = requiredField("Version"); err != nil {
+		return nil, err
+	}
+
+	chainID, err := requiredField("Chain ID")
+	if err != nil {
+		return nil, err
+	}
+	msg.ChainID, err = strconv.ParseInt(chainID, 10, 64)
+	if err != nil || msg.ChainID <= 0 {
+		return nil, errors.New("the chain id must be a positive integer")
+	}
+
+	if msg.Nonce, err = requiredField("Nonce"); err != nil {
+		return nil, err
+	}
+	if !siweNonceRegex.MatchString(msg.Nonce) {
+		return nil, errors.New("the nonce must consist of at least 8 alphanumeric characters")
+	}
+
+	issuedAt, err := requiredField("Issued At")
+	if err != nil {
+		return nil, err
+	}
+	if msg.IssuedAt, err = parseSIWETime("Issued At", issuedAt); err != nil {
+		return nil, err
+	}
+
+	if expirationTime, ok := field("Expiration Time"); ok {
+		if msg.ExpirationTime, err = parseSIWETime("Expiration Time", expirationTime); err != nil {
+			return nil, err
+		}
+	}
+	if notBefore, ok := field("Not Before"); ok {
+		if msg.NotBefore, err = parseSIWETime("Not Before", notBefore); err != nil {
+			return nil, err
+		}
+	}
+	if requestID, ok := field("Request ID"); ok {
+		msg.RequestID = requestID
+	}
+
+	if i < len(lines) && lines[i] == "Resources:" {
+		i++
+		for i < len(lines) && strings.HasPrefix(lines[i], "- ") {
+			msg.Resources = append(msg.Resources, strings.TrimPrefix(lines[i], "- "))
+			i++
+		}
+	}
+
+	skipBlank()
+	if i < len(lines) {
+		return nil, fmt.Errorf("unexpected line %q", lines[i])
+	}
+
+	return msg, nil
+}
+
+func parseSIWETime(tag, value string) (int64, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("the field %s must be an RFC 3339 timestamp", tag)
+	}
+
+	return t.Unix(), nil
+}
+
+// validate checks the fields that do not depend on the requesting site
+func (m *siweMessage) validate(from string, now time.Time) error {
+	if !strings.EqualFold(m.Address, from) {
+		return errors.New("the message is meant for a different wallet")
+	}
+	if m.Version != "1" {
+		return fmt.Errorf("version %s is not supported", m.Version)
+	}
+	if m.IssuedAt > now.Add(siweClockSkew).Unix() {
+		return errors.New("the message has been issued in the future")
+	}
+	if m.ExpirationTime != 0 && m.ExpirationTime <= now.Unix() {
+		return errors.New("the message has expired")
+	}
+	if m.NotBefore != 0 && m.NotBefore > now.Add(siweClockSkew).Unix() {
+		return errors.New("the message is not valid yet")
+	}
+
+	return nil
+}
+
+// trust returns why the domain of the message is trusted or a policy violation if it is not
+func (m *siweMessage) trust(policy models.Policy, origin string) (string, error) {
+	if origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid origin")
+		}
+
+		if strings.EqualFold(u.Host, m.Domain) && (m.Scheme == "" || strings.EqualFold(u.Scheme, m.Scheme)) {
+			return siweTrustedByOrigin, nil
+		}
+	}
+
+	if policy.IsTrustedSignInDomain(m.Domain) {
+		return siweTrustedByAllowlist, nil
+	}
+
+	message := fmt.Sprintf("The message signs you in to %s, which is not a trusted domain", m.Domain)
+	if origin != "" {
+		message = fmt.Sprintf("The message signs you in to %s, but it was requested by %s", m.Domain, origin)
+	}
+
+	return "", &common.PolicyViolation{
+		Rule:    policyRuleSignInDomain,
+		Message: message,
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"github.com/Leantar/elonwallet-function/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+const siweTestAddress = "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"
+
+const siweTestMessage = `example.com wants you to sign in with your Ethereum account:
+0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826
+
+Sign in to Example
+
+URI: https://example.com/login
+Version: 1
+Chain ID: 1
+Nonce: 32891756
+Issued At: 2021-09-30T16:25:24Z
+Resources:
+- ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/`
+
+func TestCheckSignIn(t *testing.T) {
+	user := models.NewUser("user@example.com", "User")
+	now := time.Date(2021, 9, 30, 17, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		message string
+		origin  string
+		signIn  bool
+		valid   bool
+	}{
+		{"plain message", "Hello, Bob!", "https://example.com", false, true},
+		{"sign in", siweTestMessage, "https://example.com", true, true},
+		{"other origin", siweTestMessage, "https://evil.example", true, false},
+		{"crlf line endings", strings.ReplaceAll(siweTestMessage, "\n", "\r\n"), "https://evil.example", true, false},
+		{"crlf header", strings.Replace(siweTestMessage, "\n", "\r\n", 1), "https://example.com", true, false},
+		{"header with trailing text", strings.Replace(siweTestMessage, "account:", "account: ", 1), "https://evil.example", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := checkSignIn(user, tt.message, siweTestAddress, tt.origin, now)
+			if tt.valid != (err == nil) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if tt.valid && tt.signIn != (msg != nil) {
+				t.Errorf("expected sign in %t, got %+v", tt.signIn, msg)
+			}
+		})
+	}
+}
+
+func TestParseSIWEMessage(t *testing.T) {
+	msg, err := parseSIWEMessage(siweTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Domain != "example.com" || msg.Address != siweTestAddress || msg.Statement != "Sign in to Example" {
+		t.Errorf("unexpected header %+v", msg)
+	}
+	if msg.URI != "https://example.com/login" || msg.ChainID != 1 || msg.Nonce != "32891756" || len(msg.Resources) != 1 {
+		t.Errorf("unexpected fields %+v", msg)
+	}
+}
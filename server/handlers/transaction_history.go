@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	transactionPollInterval = 15 * time.Second
+	transactionPollTimeout  = 30 * time.Second
+	// A transaction that is unknown to the node for this long is considered dropped, even if its nonce is still unused
+	transactionDropTimeout = time.Hour
+)
+
+func newTransactionRecord(params *transactionParams, tx *types.Transaction, credential string) models.TransactionRecord {
+	now := time.Now().Unix()
+
+	record := models.TransactionRecord{
+		Hash:       tx.Hash().Hex(),
+		ChainID:    params.ChainID,
+		From:       params.From,
+		To:         params.To,
+		Nonce:      tx.Nonce(),
+		Params:     models.TransactionParams(*params),
+		Type:       params.Type,
+		Gas:        tx.Gas(),
+		GasPrice:   tx.GasPrice().String(),
+		Credential: credential,
+		Status:     models.TransactionPending,
+		SentAt:     now,
+		UpdatedAt:  now,
+	}
+	if tx.Type() == types.DynamicFeeTxType {
+		record.GasPrice = ""
+		record.MaxFeePerGas = tx.GasFeeCap().String()
+		record.MaxPriorityFeePerGas = tx.GasTipCap().String()
+	}
+
+	return record
+}
+
+// PollTransactions tracks the status of all unsettled transactions until ctx is cancelled
+func (a *Api) PollTransactions(ctx context.Context) {
+	ticker := time.NewTicker(transactionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.pollTransactions(ctx)
+		}
+	}
+}
+
+func (a *Api) pollTransactions(ctx context.Context) {
+	transactions, err := a.repo.GetUnsettledTransactions()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get unsettled transactions")
+		return
+	}
+
+	byChain := make(map[string][]models.TransactionRecord)
+	for _, t := range transactions {
+		byChain[t.ChainID] = append(byChain[t.ChainID], t)
+	}
+
+	for chainID, transactions := range byChain {
+		network, ok := networks.FindByChainIDHex(chainID)
+		if !ok {
+			log.Warn().Caller().Msgf("network %s of tracked transactions does not exist", chainID)
+			continue
+		}
+
+		a.pollNetworkTransactions(ctx, network, transactions)
+	}
+}
+
+func (a *Api) pollNetworkTransactions(ctx context.Context, network models.Network, transactions []models.TransactionRecord) {
+	ctx, cancel := context.WithTimeout(ctx, transactionPollTimeout)
+	defer cancel()
+
+	client, err := ethclient.DialContext(ctx, network.RPC)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to dial rpc of %s", network.Name)
+		return
+	}
+	defer client.Close()
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to get block number of %s", network.Name)
+		return
+	}
+
+	for _, t := range transactions {
+		updated, err := updateTransactionStatus(ctx, client, head, t)
+		if err != nil {
+			log.Error().Caller().Err(err).Msgf("failed to update status of transaction %s", t.Hash)
+			continue
+		}
+		if updated == t {
+			continue
+		}
+
+		updated.UpdatedAt = time.Now().Unix()
+		err = a.repo.SaveTransaction(updated)
+		if err != nil {
+			log.Error().Caller().Err(err).Msgf("failed to save transaction %s", t.Hash)
+		}
+	}
+}
+
+// updateTransactionStatus returns t with the status reported by the node
+func updateTransactionStatus(ctx context.Context, client *ethclient.Client, head uint64, t models.TransactionRecord) (models.TransactionRecord, error) {
+	hash := common.HexToHash(t.Hash)
+
+	receipt, err := client.TransactionReceipt(ctx, hash)
+	if err == nil {
+		t.BlockNumber = receipt.BlockNumber.Uint64()
+		t.BlockHash = receipt.BlockHash.Hex()
+		t.GasUsed = receipt.GasUsed
+		if receipt.EffectiveGasPrice != nil {
+			t.EffectiveGasPrice = receipt.EffectiveGasPrice.String()
+		}
+		if head >= t.BlockNumber {
+			t.Confirmations = head - t.BlockNumber + 1
+		}
+
+		t.Status = models.TransactionConfirmed
+		if receipt.Status == types.ReceiptStatusFailed {
+			t.Status = models.TransactionReverted
+		}
+
+		return t, nil
+	}
+	if !errors.Is(err, ethereum.NotFound) {
+		return t, err
+	}
+
+	// The transaction is not (or no longer, after a reorg) part of the chain
+	t.Status = models.TransactionPending
+	t.BlockNumber = 0
+	t.BlockHash = ""
+	t.GasUsed = 0
+	t.EffectiveGasPrice = ""
+	t.Confirmations = 0
+
+	_, _, err = client.TransactionByHash(ctx, hash)
+	if err == nil {
+		return t, nil
+	}
+	if !errors.Is(err, ethereum.NotFound) {
+		return t, err
+	}
+
+	// Another transaction with the same nonce has been mined, so this one can never be included
+	nonce, err := client.NonceAt(ctx, common.HexToAddress(t.From), nil)
+	if err != nil {
+		return t, err
+	}
+	if nonce > t.Nonce || time.Since(time.Unix(t.SentAt, 0)) > transactionDropTimeout {
+		t.Status = models.TransactionDropped
+	}
+
+	return t, nil
+}
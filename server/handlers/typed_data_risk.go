@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"golang.org/x/exp/slices"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	typedDataPermit          = "erc2612_permit"
+	typedDataDAIPermit       = "dai_permit"
+	typedDataPermit2Single   = "permit2_single"
+	typedDataPermit2Batch    = "permit2_batch"
+	typedDataPermit2Transfer = "permit2_transfer"
+	typedDataSeaportOrder    = "seaport_order"
+)
+
+const (
+	severityWarning = "warning"
+	severityDanger  = "danger"
+)
+
+const (
+	findingUnknownChain       = "unknown_chain"
+	findingMissingChain       = "missing_chain_id"
+	findingVerifyingContract  = "implausible_verifying_contract"
+	findingTokenApproval      = "token_approval"
+	findingUnlimitedAllowance = "unlimited_allowance"
+	findingFarFutureDeadline  = "far_future_deadline"
+	findingSeaportOrder       = "seaport_order"
+	findingNothingInReturn    = "nothing_in_return"
+	findingMissingDomain      = "missing_domain"
+)
+
+// Deadlines further away than this let a leaked signature be used long after it has been given
+const farFutureDeadline = 90 * 24 * time.Hour
+
+// Seaport 1.1, 1.4, 1.5 and 1.6 are deployed at the same addresses on every chain
+var seaportAddresses = []ethcommon.Address{
+	ethcommon.HexToAddress("0x00000000006c3852cbEf3e08E8dF289169EdE581"),
+	ethcommon.HexToAddress("0x00000000000001ad428e4906aE43D8F9852d0dD6"),
+	ethcommon.HexToAddress("0x00000000000000ADc04C56Bf30aC9d3c0aAF14dC"),
+	ethcommon.HexToAddress("0x0000000000000068F116a894984e2DB1123eB395"),
+}
+
+type typedDataFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// typedDataAllowance is a permission to move tokens of the signer that a signature grants
+type typedDataAllowance struct {
+	Token    string `json:"token"`
+	Spender  string `json:"spender"`
+	Amount   string `json:"amount"`
+	Deadline int64  `json:"deadline"` //Zero if the allowance does not expire
+}
+
+// typedDataAnalysis describes what signing typed data allows others to do. It is shown to the user and evaluated by the policy.
+type typedDataAnalysis struct {
+	Kind       string               `json:"kind"`    //Empty if the structure is not known to move assets
+	Network    string               `json:"network"` //Empty if the domain has no known chain
+	Allowances []typedDataAllowance `json:"allowances"`
+	Findings   []typedDataFinding   `json:"findings"`
+	unlimited  bool
+}
+
+// IsHighRisk reports whether the signature can move assets or has suspicious properties
+func (a typedDataAnalysis) IsHighRisk() bool {
+	return a.Kind != "" || len(a.Findings) > 0
+}
+
+func (a *typedDataAnalysis) addFinding(rule, severity, format string, args ...any) {
+	a.Findings = append(a.Findings, typedDataFinding{
+		Rule:     rule,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// analyzeTypedMessage analyzes typed data of every eth_signTypedData version
+func analyzeTypedMessage(user models.User, msg typedMessage, now time.Time) typedDataAnalysis {
+	if msg.Version != typedDataV1 {
+		return analyzeTypedData(user, msg.Data, now)
+	}
+
+	analysis := typedDataAnalysis{
+		Allowances: make([]typedDataAllowance, 0),
+		Findings:   make([]typedDataFinding, 0),
+	}
+	analysis.addFinding(findingMissingDomain, severityDanger, "Legacy typed data is not bound to a site or network, so the signature can be used anywhere")
+
+	return analysis
+}
+
+// analyzeTypedData recognizes permits and orders that move assets of the signer and checks the domain they are bound to
+func analyzeTypedData(user models.User, data apitypes.TypedData, now time.Time) typedDataAnalysis {
+	analysis := typedDataAnalysis{
+		Kind:       typedDataKind(data),
+		Allowances: make([]typedDataAllowance, 0),
+		Findings:   make([]typedDataFinding, 0),
+	}
+
+	analyzeTypedDataDomain(&analysis, user, data)
+
+	message := data.Message
+	verifyingContract := data.Domain.VerifyingContract
+
+	switch analysis.Kind {
+	case typedDataPermit:
+		analysis.addAllowance(verifyingContract, message["spender"], message["value"], message["deadline"], now)
+	case typedDataDAIPermit:
+		amount := "0"
+		if allowed, _ := message["allowed"].(bool); allowed {
+			amount = math.MaxBig256.String()
+		}
+		analysis.addAllowance(verifyingContract, message["spender"], amount, message["expiry"], now)
+	case typedDataPermit2Single, typedDataPermit2Batch:
+		for _, details := range typedDataObjects(message["details"]) {
+			analysis.addAllowance(details["token"], message["spender"], details["amount"], details["expiration"], now)
+		}
+		analysis.checkDeadline(message["sigDeadline"], now)
+	case typedDataPermit2Transfer:
+		for _, permitted := range typedDataObjects(message["permitted"]) {
+			analysis.addAllowance(permitted["token"], message["spender"], permitted["amount"], message["deadline"], now)
+		}
+	case typedDataSeaportOrder:
+		analyzeSeaportOrder(&analysis, message)
+	}
+
+	for _, allowance := range analysis.Allowances {
+		analysis.addFinding(findingTokenApproval, severityWarning, "%s can transfer %s of the token %s", allowance.Spender, describeAmount(allowance.Amount), allowance.Token)
+	}
+
+	return analysis
+}
+
+// typedDataKind recognizes the structure by its primary type and, where primary types are ambiguous, by its fields
+func typedDataKind(data apitypes.TypedData) string {
+	fields := make(map[string]bool)
+	for _, field := range data.Types[data.PrimaryType] {
+		fields[field.Name] = true
+	}
+
+	switch data.PrimaryType {
+	case "Permit":
+		if fields["holder"] && fields["allowed"] {
+			return typedDataDAIPermit
+		}
+		if fields["spender"] && fields["value"] {
+			return typedDataPermit
+		}
+	case "PermitSingle":
+		return typedDataPermit2Single
+	case "PermitBatch":
+		return typedDataPermit2Batch
+	case "PermitTransferFrom", "PermitBatchTransferFrom", "PermitWitnessTransferFrom", "PermitBatchWitnessTransferFrom":
+		return typedDataPermit2Transfer
+	case "OrderComponents":
+		return typedDataSeaportOrder
+	}
+
+	return ""
+}
+
+func analyzeTypedDataDomain(analysis *typedDataAnalysis, user models.User, data apitypes.TypedData) {
+	if data.Domain.ChainId != nil {
+		chainID := (*big.Int)(data.Domain.ChainId)
+		if network, ok := networks.FindByChainIDHex(hexutil.EncodeBig(chainID)); ok {
+			analysis.Network = network.Name
+		} else {
+			analysis.addFinding(findingUnknownChain, severityDanger, "The chain %s is not a known network", chainID.String())
+		}
+	} else if analysis.Kind != "" {
+		analysis.addFinding(findingMissingChain, severityWarning, "The signature is not bound to a chain and can be used on every chain")
+	}
+
+	verifyingContract := data.Domain.VerifyingContract
+	if verifyingContract == "" {
+		if analysis.Kind != "" {
+			analysis.addFinding(findingVerifyingContract, severityDanger, "The signature is not bound to a contract")
+		}
+		return
+	}
+
+	if !ethcommon.IsHexAddress(verifyingContract) || ethcommon.HexToAddress(verifyingContract) == (ethcommon.Address{}) {
+		analysis.addFinding(findingVerifyingContract, severityDanger, "The verifying contract %s is not a valid address", verifyingContract)
+		return
+	}
+
+	address := ethcommon.HexToAddress(verifyingContract)
+	switch {
+	case user.Wallets.IndexByAddress(verifyingContract) != -1:
+		analysis.addFinding(findingVerifyingContract, severityDanger, "The verifying contract %s is one of your wallets and not a contract", verifyingContract)
+	case isPermit2Kind(analysis.Kind) && address != permit2Address:
+		analysis.addFinding(findingVerifyingContract, severityDanger, "The verifying contract %s is not the Permit2 contract", verifyingContract)
+	case analysis.Kind == typedDataSeaportOrder && !slices.Contains(seaportAddresses, address):
+		analysis.addFinding(findingVerifyingContract, severityDanger, "The verifying contract %s is not a Seaport contract", verifyingContract)
+	}
+}
+
+// analyzeSeaportOrder flags orders that give away the offered items without paying the signer
+func analyzeSeaportOrder(analysis *typedDataAnalysis, message apitypes.TypedDataMessage) {
+	offerer, _ := message["offerer"].(string)
+	offer := typedDataObjects(message["offer"])
+
+	paid := false
+	for _, consideration := range typedDataObjects(message["consideration"]) {
+		recipient, _ := consideration["recipient"].(string)
+		if strings.EqualFold(recipient, offerer) {
+			paid = true
+		}
+	}
+
+	analysis.addFinding(findingSeaportOrder, severityWarning, "Anyone fulfilling this order can take %d offered items from %s", len(offer), offerer)
+	if len(offer) > 0 && !paid {
+		analysis.addFinding(findingNothingInReturn, severityDanger, "The order pays nothing to %s in return for the offered items", offerer)
+	}
+}
+
+func (a *typedDataAnalysis) addAllowance(token, spender, amount, deadline any, now time.Time) {
+	tokenAddress, _ := token.(string)
+	spenderAddress, _ := spender.(string)
+
+	// Allowances of zero revoke a permission
+	parsedAmount, ok := parseTypedInteger(amount)
+	if !ok || parsedAmount.Sign() == 0 {
+		return
+	}
+
+	allowance := typedDataAllowance{
+		Token:   tokenAddress,
+		Spender: spenderAddress,
+		Amount:  parsedAmount.String(),
+	}
+
+	if parsedAmount.Cmp(unlimitedAllowance) >= 0 {
+		a.unlimited = true
+		a.addFinding(findingUnlimitedAllowance, severityDanger, "%s can transfer an unlimited amount of the token %s", spenderAddress, tokenAddress)
+	}
+
+	if parsedDeadline, ok := parseTypedInteger(deadline); ok && parsedDeadline.IsInt64() {
+		allowance.Deadline = parsedDeadline.Int64()
+	}
+	a.checkDeadline(deadline, now)
+
+	a.Allowances = append(a.Allowances, allowance)
+}
+
+// checkDeadline flags deadlines that never expire or are far in the future. Missing deadlines are not flagged.
+func (a *typedDataAnalysis) checkDeadline(deadline any, now time.Time) {
+	if deadline == nil {
+		return
+	}
+
+	parsed, ok := parseTypedInteger(deadline)
+	if !ok {
+		return
+	}
+
+	if parsed.Sign() == 0 && a.Kind == typedDataDAIPermit {
+		a.addFinding(findingFarFutureDeadline, severityWarning, "The permission never expires")
+		return
+	}
+
+	if parsed.Cmp(big.NewInt(now.Add(farFutureDeadline).Unix())) > 0 {
+		a.addFinding(findingFarFutureDeadline, severityWarning, "The signature is valid for more than %d days", int(farFutureDeadline.Hours()/24))
+	}
+}
+
+// evaluateTypedDataPolicy applies the policy to the permissions a signature grants, like it is applied to approvals in transactions
+func evaluateTypedDataPolicy(user models.User, analysis typedDataAnalysis) error {
+	spenders := make([]string, 0, len(analysis.Allowances))
+	for _, allowance := range analysis.Allowances {
+		spenders = append(spenders, allowance.Spender)
+	}
+
+	err := checkDestinations(user, spenders)
+	if err != nil {
+		return err
+	}
+
+	if user.Policy.BlockUnlimitedApprovals && analysis.unlimited {
+		return &common.PolicyViolation{
+			Rule:    policyRuleUnlimitedApproval,
+			Message: "Unlimited approvals are blocked",
+		}
+	}
+
+	return nil
+}
+
+// parseTypedInteger parses an integer of a typed data message, which can be a decimal or hex string or a json number
+func parseTypedInteger(value any) (*big.Int, bool) {
+	switch v := value.(type) {
+	case string:
+		return math.ParseBig256(v)
+	case json.Number:
+		return math.ParseBig256(v.String())
+	case float64:
+		parsed, _ := big.NewFloat(v).Int(nil)
+		return parsed, true
+	}
+
+	return nil, false
+}
+
+// typedDataObjects returns a struct or an array of structs of a typed data message as a list
+func typedDataObjects(value any) []map[string]any {
+	switch v := value.(type) {
+	case map[string]any:
+		return []map[string]any{v}
+	case []any:
+		objects := make([]map[string]any, 0, len(v))
+		for _, element := range v {
+			if object, ok := element.(map[string]any); ok {
+				objects = append(objects, object)
+			}
+		}
+		return objects
+	}
+
+	return nil
+}
+
+func describeAmount(amount string) string {
+	parsed, ok := new(big.Int).SetString(amount, 10)
+	if ok && parsed.Cmp(unlimitedAllowance) >= 0 {
+		return "an unlimited amount"
+	}
+
+	return fmt.Sprintf("up to %s base units", amount)
+}
+
+func isPermit2Kind(kind string) bool {
+	return kind == typedDataPermit2Single || kind == typedDataPermit2Batch || kind == typedDataPermit2Transfer
+}
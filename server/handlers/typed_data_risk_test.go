@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"testing"
+	"time"
+)
+
+const (
+	riskToken   = "0x6B175474E89094C44Da98b954EedeAC495271d0F"
+	riskSpender = "0x2222222222222222222222222222222222222222"
+	riskOfferer = "0x3333333333333333333333333333333333333333"
+)
+
+var riskNow = time.Unix(1700000000, 0)
+
+// riskTypedData builds typed data of primaryType with the given fields, bound to chainID and verifyingContract.
+// A chainID of zero leaves the domain without a chain.
+func riskTypedData(primaryType string, fields []string, chainID int64, verifyingContract string, message apitypes.TypedDataMessage) apitypes.TypedData {
+	types := make([]apitypes.Type, len(fields))
+	for i, field := range fields {
+		types[i] = apitypes.Type{Name: field, Type: "uint256"}
+	}
+
+	domain := apitypes.TypedDataDomain{VerifyingContract: verifyingContract}
+	if chainID != 0 {
+		domain.ChainId = math.NewHexOrDecimal256(chainID)
+	}
+
+	return apitypes.TypedData{
+		Types:       apitypes.Types{primaryType: types},
+		PrimaryType: primaryType,
+		Domain:      domain,
+		Message:     message,
+	}
+}
+
+func riskDeadline(d time.Duration) string {
+	return fmt.Sprint(riskNow.Add(d).Unix())
+}
+
+func erc2612Permit(chainID int64, verifyingContract, value, deadline string) apitypes.TypedData {
+	return riskTypedData("Permit", []string{"owner", "spender", "value", "nonce", "deadline"}, chainID, verifyingContract, apitypes.TypedDataMessage{
+		"owner":    riskOfferer,
+		"spender":  riskSpender,
+		"value":    value,
+		"nonce":    "0",
+		"deadline": deadline,
+	})
+}
+
+func permit2Single(verifyingContract, amount string) apitypes.TypedData {
+	return riskTypedData("PermitSingle", []string{"details", "spender", "sigDeadline"}, 1, verifyingContract, apitypes.TypedDataMessage{
+		"details": map[string]any{
+			"token":      riskToken,
+			"amount":     amount,
+			"expiration": riskDeadline(time.Hour),
+			"nonce":      "0",
+		},
+		"spender":     riskSpender,
+		"sigDeadline": riskDeadline(time.Hour),
+	})
+}
+
+func seaportOrder(verifyingContract, recipient string) apitypes.TypedData {
+	return riskTypedData("OrderComponents", []string{"offerer", "offer", "consideration"}, 1, verifyingContract, apitypes.TypedDataMessage{
+		"offerer": riskOfferer,
+		"offer": []any{
+			map[string]any{"token": riskToken, "identifierOrCriteria": "1"},
+		},
+		"consideration": []any{
+			map[string]any{"token": riskToken, "recipient": recipient},
+		},
+	})
+}
+
+func TestTypedDataKind(t *testing.T) {
+	tests := []struct {
+		name        string
+		primaryType string
+		fields      []string
+		kind        string
+	}{
+		{name: "erc2612 permit", primaryType: "Permit", fields: []string{"owner", "spender", "value", "nonce", "deadline"}, kind: typedDataPermit},
+		{name: "dai permit", primaryType: "Permit", fields: []string{"holder", "spender", "nonce", "expiry", "allowed"}, kind: typedDataDAIPermit},
+		{name: "unknown permit", primaryType: "Permit", fields: []string{"owner", "nonce"}},
+		{name: "permit2 single", primaryType: "PermitSingle", kind: typedDataPermit2Single},
+		{name: "permit2 batch", primaryType: "PermitBatch", kind: typedDataPermit2Batch},
+		{name: "permit2 transfer", primaryType: "PermitTransferFrom", kind: typedDataPermit2Transfer},
+		{name: "permit2 batch transfer", primaryType: "PermitBatchTransferFrom", kind: typedDataPermit2Transfer},
+		{name: "permit2 witness transfer", primaryType: "PermitWitnessTransferFrom", kind: typedDataPermit2Transfer},
+		{name: "permit2 batch witness transfer", primaryType: "PermitBatchWitnessTransferFrom", kind: typedDataPermit2Transfer},
+		{name: "seaport order", primaryType: "OrderComponents", kind: typedDataSeaportOrder},
+		{name: "mail", primaryType: "Mail", fields: []string{"from", "to", "contents"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := riskTypedData(tt.primaryType, tt.fields, 1, riskToken, nil)
+			if kind := typedDataKind(data); kind != tt.kind {
+				t.Fatalf("expected kind %q, got %q", tt.kind, kind)
+			}
+		})
+	}
+}
+
+func TestAnalyzeTypedData(t *testing.T) {
+	unlimited := math.MaxBig256.String()
+	wallet, err := models.NewWallet("wallet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		data       apitypes.TypedData
+		kind       string
+		findings   []string
+		allowances []typedDataAllowance
+		unlimited  bool
+	}{
+		{
+			name:       "erc2612 permit",
+			data:       erc2612Permit(1, riskToken, "1000", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "erc2612 permit with unlimited amount",
+			data:       erc2612Permit(1, riskToken, unlimited, riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingUnlimitedAllowance, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: unlimited, Deadline: riskNow.Add(time.Hour).Unix()}},
+			unlimited:  true,
+		},
+		{
+			name:       "erc2612 permit with far future deadline",
+			data:       erc2612Permit(1, riskToken, "1000", riskDeadline(farFutureDeadline+time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingFarFutureDeadline, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(farFutureDeadline + time.Hour).Unix()}},
+		},
+		{
+			name:       "erc2612 permit revoking an allowance",
+			data:       erc2612Permit(1, riskToken, "0", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "erc2612 permit on an unknown chain",
+			data:       erc2612Permit(999999, riskToken, "1000", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingUnknownChain, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "erc2612 permit without chain",
+			data:       erc2612Permit(0, riskToken, "1000", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingMissingChain, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "erc2612 permit without verifying contract",
+			data:       erc2612Permit(1, "", "1000", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingVerifyingContract, findingTokenApproval},
+			allowances: []typedDataAllowance{{Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "erc2612 permit verified by a wallet of the user",
+			data:       erc2612Permit(1, wallet.Address, "1000", riskDeadline(time.Hour)),
+			kind:       typedDataPermit,
+			findings:   []string{findingVerifyingContract, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: wallet.Address, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name: "dai permit",
+			data: riskTypedData("Permit", []string{"holder", "spender", "nonce", "expiry", "allowed"}, 1, riskToken, apitypes.TypedDataMessage{
+				"holder":  riskOfferer,
+				"spender": riskSpender,
+				"nonce":   "0",
+				"expiry":  "0",
+				"allowed": true,
+			}),
+			kind:       typedDataDAIPermit,
+			findings:   []string{findingUnlimitedAllowance, findingFarFutureDeadline, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: unlimited}},
+			unlimited:  true,
+		},
+		{
+			name: "dai permit revoking an allowance",
+			data: riskTypedData("Permit", []string{"holder", "spender", "nonce", "expiry", "allowed"}, 1, riskToken, apitypes.TypedDataMessage{
+				"holder":  riskOfferer,
+				"spender": riskSpender,
+				"nonce":   "0",
+				"expiry":  "0",
+				"allowed": false,
+			}),
+			kind:       typedDataDAIPermit,
+			findings:   []string{},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "permit2 single",
+			data:       permit2Single(permit2Address.Hex(), "1000"),
+			kind:       typedDataPermit2Single,
+			findings:   []string{findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "permit2 single with unlimited amount",
+			data:       permit2Single(permit2Address.Hex(), unlimitedAllowance.String()),
+			kind:       typedDataPermit2Single,
+			findings:   []string{findingUnlimitedAllowance, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: unlimitedAllowance.String(), Deadline: riskNow.Add(time.Hour).Unix()}},
+			unlimited:  true,
+		},
+		{
+			name:       "permit2 single at an unexpected verifying contract",
+			data:       permit2Single(riskToken, "1000"),
+			kind:       typedDataPermit2Single,
+			findings:   []string{findingVerifyingContract, findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name: "permit2 batch with far future signature deadline",
+			data: riskTypedData("PermitBatch", []string{"details", "spender", "sigDeadline"}, 1, permit2Address.Hex(), apitypes.TypedDataMessage{
+				"details": []any{
+					map[string]any{"token": riskToken, "amount": "1000", "expiration": "0", "nonce": "0"},
+					map[string]any{"token": riskOfferer, "amount": "2000", "expiration": "0", "nonce": "0"},
+				},
+				"spender":     riskSpender,
+				"sigDeadline": riskDeadline(farFutureDeadline + time.Hour),
+			}),
+			kind:     typedDataPermit2Batch,
+			findings: []string{findingFarFutureDeadline, findingTokenApproval, findingTokenApproval},
+			allowances: []typedDataAllowance{
+				{Token: riskToken, Spender: riskSpender, Amount: "1000"},
+				{Token: riskOfferer, Spender: riskSpender, Amount: "2000"},
+			},
+		},
+		{
+			name: "permit2 transfer",
+			data: riskTypedData("PermitTransferFrom", []string{"permitted", "spender", "nonce", "deadline"}, 1, permit2Address.Hex(), apitypes.TypedDataMessage{
+				"permitted": map[string]any{"token": riskToken, "amount": "1000"},
+				"spender":   riskSpender,
+				"nonce":     "0",
+				"deadline":  riskDeadline(time.Hour),
+			}),
+			kind:       typedDataPermit2Transfer,
+			findings:   []string{findingTokenApproval},
+			allowances: []typedDataAllowance{{Token: riskToken, Spender: riskSpender, Amount: "1000", Deadline: riskNow.Add(time.Hour).Unix()}},
+		},
+		{
+			name:       "seaport order paying the offerer",
+			data:       seaportOrder(seaportAddresses[0].Hex(), riskOfferer),
+			kind:       typedDataSeaportOrder,
+			findings:   []string{findingSeaportOrder},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "seaport order paying nothing in return",
+			data:       seaportOrder(seaportAddresses[0].Hex(), riskSpender),
+			kind:       typedDataSeaportOrder,
+			findings:   []string{findingSeaportOrder, findingNothingInReturn},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "seaport order at an unexpected verifying contract",
+			data:       seaportOrder(permit2Address.Hex(), riskOfferer),
+			kind:       typedDataSeaportOrder,
+			findings:   []string{findingVerifyingContract, findingSeaportOrder},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "mail",
+			data:       riskTypedData("Mail", []string{"contents"}, 1, riskToken, apitypes.TypedDataMessage{"contents": "Hello, Bob!"}),
+			findings:   []string{},
+			allowances: []typedDataAllowance{},
+		},
+		{
+			name:       "mail on an unknown chain",
+			data:       riskTypedData("Mail", []string{"contents"}, 999999, riskToken, apitypes.TypedDataMessage{"contents": "Hello, Bob!"}),
+			findings:   []string{findingUnknownChain},
+			allowances: []typedDataAllowance{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := models.NewUser("user@example.com", "User")
+			user.Wallets = append(user.Wallets, wallet)
+
+			analysis := analyzeTypedData(user, tt.data, riskNow)
+			if analysis.Kind != tt.kind {
+				t.Fatalf("expected kind %q, got %q", tt.kind, analysis.Kind)
+			}
+
+			findings := make([]string, len(analysis.Findings))
+			for i, finding := range analysis.Findings {
+				findings[i] = finding.Rule
+			}
+			if fmt.Sprint(findings) != fmt.Sprint(tt.findings) {
+				t.Fatalf("expected findings %v, got %v", tt.findings, findings)
+			}
+
+			if fmt.Sprint(analysis.Allowances) != fmt.Sprint(tt.allowances) {
+				t.Fatalf("expected allowances %v, got %v", tt.allowances, analysis.Allowances)
+			}
+			if analysis.unlimited != tt.unlimited {
+				t.Fatalf("expected unlimited %v, got %v", tt.unlimited, analysis.unlimited)
+			}
+			if analysis.IsHighRisk() != (tt.kind != "" || len(tt.findings) > 0) {
+				t.Fatalf("unexpected risk for kind %q and findings %v", tt.kind, tt.findings)
+			}
+		})
+	}
+}
+
+func TestEvaluateTypedDataPolicy(t *testing.T) {
+	bounded := analyzeTypedData(models.User{}, erc2612Permit(1, riskToken, "1000", riskDeadline(time.Hour)), riskNow)
+	unlimited := analyzeTypedData(models.User{}, erc2612Permit(1, riskToken, unlimitedAllowance.String(), riskDeadline(time.Hour)), riskNow)
+
+	tests := []struct {
+		name      string
+		policy    models.Policy
+		analysis  typedDataAnalysis
+		violation string
+	}{
+		{name: "bounded allowance", analysis: bounded},
+		{name: "unlimited allowance", analysis: unlimited},
+		{name: "unlimited allowance blocked", policy: models.Policy{BlockUnlimitedApprovals: true}, analysis: unlimited, violation: policyRuleUnlimitedApproval},
+		{name: "bounded allowance with unlimited allowances blocked", policy: models.Policy{BlockUnlimitedApprovals: true}, analysis: bounded},
+		{name: "spender on the allowlist", policy: models.Policy{Allowlist: []string{riskSpender}}, analysis: bounded},
+		{name: "spender not on the allowlist", policy: models.Policy{Allowlist: []string{riskOfferer}}, analysis: bounded, violation: policyRuleAllowlist},
+		{name: "spender on the denylist", policy: models.Policy{Denylist: []string{riskSpender}}, analysis: bounded, violation: policyRuleDenylist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := models.NewUser("user@example.com", "User")
+			user.Policy = tt.policy
+
+			err := evaluateTypedDataPolicy(user, tt.analysis)
+
+			var violation *common.PolicyViolation
+			if tt.violation == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.As(err, &violation) || violation.Rule != tt.violation {
+				t.Fatalf("expected violation of %s, got %v", tt.violation, err)
+			}
+		})
+	}
+}
@@ -1,45 +1,241 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
 	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
 )
 
-func (a *Api) createWallet(name string, public bool, user models.User) (models.Wallet, error) {
-	wallet, err := models.NewWallet(name, public)
+const (
+	walletImportPrivateKey = "private_key"
+	walletImportMnemonic   = "mnemonic"
+	walletImportKeystore   = "keystore"
+
+	// Keystores of other wallets use at most the standard scrypt parameters or about a million pbkdf2 iterations
+	maxKeystorePBKDF2Iterations = 1 << 20
+)
+
+type walletImport struct {
+	Type               string          `json:"type" validate:"required,oneof=private_key mnemonic keystore"`
+	PrivateKey         string          `json:"private_key" validate:"required_if=Type private_key"`
+	Mnemonic           string          `json:"mnemonic" validate:"required_if=Type mnemonic"`
+	MnemonicPassphrase string          `json:"mnemonic_passphrase"`
+	DerivationPath     string          `json:"derivation_path"`
+	Keystore           json.RawMessage `json:"keystore" validate:"required_if=Type keystore"`
+	KeystorePassphrase string          `json:"keystore_passphrase"`
+}
+
+// createWallet derives the wallet at index from the HD seed of the user and publishes it if requested.
+// The index must have been reserved using models.User.ReserveHDIndex.
+func (a *Api) createWallet(name string, public bool, user models.User, index uint32) (models.Wallet, error) {
+	wallet, err := user.HDSeed.DeriveWallet(name, public, index)
 	if err != nil {
-		return models.Wallet{}, fmt.Errorf("failed to create new wallet: %w", err)
+		return models.Wallet{}, fmt.Errorf("failed to derive new wallet: %w", err)
 	}
 
 	if public {
-		b, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+		err = a.publishWallet(wallet, user)
 		if err != nil {
-			return models.Wallet{}, fmt.Errorf("failed to create backend api client: %w", err)
+			return models.Wallet{}, err
+		}
+	}
+
+	return wallet, nil
+}
+
+// publishWallet proves the ownership of the wallet to the backend, which lists it as a public wallet of the user
+func (a *Api) publishWallet(wallet models.Wallet, user models.User) error {
+	b, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create backend api client: %w", err)
+	}
+
+	challenge, err := b.PublishWalletInitialize(wallet)
+	if err != nil {
+		return fmt.Errorf("failed to initalize wallet publication: %w", err)
+	}
+
+	privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+	}
+
+	signature, err := signPersonal(challenge, privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign wallet challenge: %w", err)
+	}
+
+	err = b.PublishWalletFinalize(wallet, signature)
+	if err != nil {
+		return fmt.Errorf("failed to finalize wallet publication: %w", err)
+	}
+
+	return nil
+}
+
+func (a *Api) unpublishWallet(wallet models.Wallet, user models.User) error {
+	b, err := common.NewBackendApiClient(a.cfg.BackendURL, user, a.signingKey.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to create backend api client: %w", err)
+	}
+
+	err = b.UnpublishWallet(wallet)
+	if err != nil {
+		return fmt.Errorf("failed to unpublish wallet: %w", err)
+	}
+
+	return nil
+}
+
+// republishWallet publishes wallet under the name of renamed.
+// The wallet is published under its old name again if the renamed wallet can not be published.
+func (a *Api) republishWallet(wallet, renamed models.Wallet, user models.User) error {
+	err := a.unpublishWallet(wallet, user)
+	if err != nil {
+		return err
+	}
+
+	err = a.publishWallet(renamed, user)
+	if err != nil {
+		if restoreErr := a.publishWallet(wallet, user); restoreErr != nil {
+			log.Error().Caller().Err(restoreErr).Msgf("failed to publish wallet %s again", wallet.Address)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// revertWalletName gives wallet its previous name back, unless it has been renamed or the name has been taken in the meantime
+func (a *Api) revertWalletName(wallet models.Wallet, name string) {
+	_, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		index := user.Wallets.IndexByAddress(wallet.Address)
+		if index == -1 || user.Wallets[index].Name != name || user.Wallets.Exists(wallet.Name) {
+			return nil
 		}
 
-		challenge, err := b.PublishWalletInitialize(wallet)
+		user.Wallets[index].Name = wallet.Name
+		return nil
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to revert the name of wallet %s", wallet.Address)
+	}
+}
+
+// importWallet recovers a wallet from a raw private key, a BIP-39 mnemonic or an encrypted V3 keystore
+func importWallet(name string, public bool, in walletImport) (models.Wallet, error) {
+	switch in.Type {
+	case walletImportPrivateKey:
+		privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(in.PrivateKey, "0x"))
 		if err != nil {
-			return models.Wallet{}, fmt.Errorf("failed to initalize wallet publication: %w", err)
+			return models.Wallet{}, echo.NewHTTPError(http.StatusBadRequest, "Private key is invalid").SetInternal(err)
+		}
+
+		return models.NewWalletFromPrivateKey(name, public, privateKey), nil
+	case walletImportMnemonic:
+		path := in.DerivationPath
+		if path == "" {
+			path = fmt.Sprintf("%s/0", models.BaseDerivationPath)
 		}
 
-		privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+		wallet, err := models.NewWalletFromMnemonic(name, public, in.Mnemonic, in.MnemonicPassphrase, path)
 		if err != nil {
-			log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+			return models.Wallet{}, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
+		// The derivation path refers to a foreign seed and not the HD seed of the user
+		wallet.DerivationPath = ""
 
-		signature, err := signPersonal(challenge, privateKey)
+		return wallet, nil
+	case walletImportKeystore:
+		err := checkKeystoreKDF(in.Keystore)
 		if err != nil {
-			return models.Wallet{}, fmt.Errorf("failed to sign wallet challenge: %w", err)
+			return models.Wallet{}, err
 		}
 
-		err = b.PublishWalletFinalize(wallet, signature)
+		key, err := keystore.DecryptKey(in.Keystore, in.KeystorePassphrase)
 		if err != nil {
-			return models.Wallet{}, fmt.Errorf("failed to finalize wallet publication: %w", err)
+			return models.Wallet{}, echo.NewHTTPError(http.StatusBadRequest, "Keystore is invalid or the passphrase is wrong").SetInternal(err)
 		}
+
+		return models.NewWalletFromPrivateKey(name, public, key.PrivateKey), nil
+	default:
+		return models.Wallet{}, echo.NewHTTPError(http.StatusBadRequest, "Unknown import type")
 	}
+}
 
-	return wallet, nil
+// checkKeystoreKDF rejects keystores whose key derivation would exhaust the memory or the CPU of the enclave.
+// The scrypt parameters are limited to the cost of the largest backups.
+func checkKeystoreKDF(data json.RawMessage) error {
+	var ks struct {
+		Crypto struct {
+			KDF       string `json:"kdf"`
+			KDFParams struct {
+				N     int `json:"n"`
+				R     int `json:"r"`
+				P     int `json:"p"`
+				C     int `json:"c"`
+				DKLen int `json:"dklen"`
+			} `json:"kdfparams"`
+		} `json:"crypto"`
+	}
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Keystore is invalid").SetInternal(err)
+	}
+
+	params := ks.Crypto.KDFParams
+	// The derived key is split into the encryption key and the MAC key, which need 32 bytes
+	if params.DKLen != 32 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Keystore has an unsupported key length")
+	}
+
+	switch ks.Crypto.KDF {
+	case "scrypt":
+		// The memory depends on n and r only, p multiplies the time. Light keystores use a higher p than backups.
+		if params.N < 1 || params.R < 1 || params.P < 1 || params.N > maxBackupScryptN || params.R > maxBackupScryptR ||
+			params.P > maxBackupScryptN*maxBackupScryptR*maxBackupScryptP/(params.N*params.R) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Keystore scrypt parameters exceed the supported maximum")
+		}
+	case "pbkdf2":
+		if params.C > maxKeystorePBKDF2Iterations {
+			return echo.NewHTTPError(http.StatusBadRequest, "Keystore pbkdf2 iterations exceed the supported maximum")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Keystore uses an unsupported key derivation function")
+	}
+
+	return nil
+}
+
+// exportWallet encrypts the private key of the wallet as a V3 keystore using the standard scrypt parameters
+func exportWallet(wallet models.Wallet, passphrase string) ([]byte, error) {
+	privateKey, err := crypto.HexToECDSA(wallet.PrivateKeyHex)
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("failed to convert hex to private key")
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keystore id: %w", err)
+	}
+
+	key := &keystore.Key{
+		Id:         id,
+		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	}
+
+	keyJSON, err := keystore.EncryptKey(key, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt keystore: %w", err)
+	}
+
+	return keyJSON, nil
 }
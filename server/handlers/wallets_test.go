@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Leantar/elonwallet-function/config"
+	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/repository"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckKeystoreKDF(t *testing.T) {
+	tests := []struct {
+		name   string
+		kdf    string
+		params string
+		valid  bool
+	}{
+		{"standard scrypt", "scrypt", `{"n": 262144, "r": 8, "p": 1, "dklen": 32}`, true},
+		{"light scrypt", "scrypt", `{"n": 4096, "r": 8, "p": 6, "dklen": 32}`, true},
+		{"excessive n", "scrypt", `{"n": 1073741824, "r": 8, "p": 1, "dklen": 32}`, false},
+		{"excessive r", "scrypt", `{"n": 262144, "r": 1024, "p": 1, "dklen": 32}`, false},
+		{"excessive p", "scrypt", `{"n": 262144, "r": 8, "p": 64, "dklen": 32}`, false},
+		{"invalid n", "scrypt", `{"n": 0, "r": 8, "p": 1, "dklen": 32}`, false},
+		{"short key", "scrypt", `{"n": 262144, "r": 8, "p": 1, "dklen": 16}`, false},
+		{"pbkdf2", "pbkdf2", `{"c": 262144, "prf": "hmac-sha256", "dklen": 32}`, true},
+		{"excessive iterations", "pbkdf2", `{"c": 1000000000, "prf": "hmac-sha256", "dklen": 32}`, false},
+		{"unknown kdf", "argon2", `{"dklen": 32}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keystore := fmt.Sprintf(`{"version": 3, "crypto": {"kdf": %q, "kdfparams": %s}}`, tt.kdf, tt.params)
+
+			err := checkKeystoreKDF([]byte(keystore))
+			if tt.valid && err != nil {
+				t.Errorf("expected a valid keystore, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an invalid keystore")
+			}
+		})
+	}
+}
+
+func TestCancelWalletPayments(t *testing.T) {
+	repo := repository.NewMemory()
+	a := &Api{repo: repo}
+
+	const wallet = "0xaAaAaAaaAaAaAaaAaAAAAAAAAaaaAaAaAaaAaaAa"
+	const other = "0x2222222222222222222222222222222222222222"
+
+	user := models.NewUser("user@example.com", "User")
+	user.RecurringPayments["paying"] = models.RecurringPayment{ID: "paying", From: wallet, Status: models.RecurringActive}
+	user.RecurringPayments["completed"] = models.RecurringPayment{ID: "completed", From: wallet, Status: models.RecurringCompleted}
+	user.RecurringPayments["other"] = models.RecurringPayment{ID: "other", From: other, Status: models.RecurringActive}
+	if err := repo.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []models.ScheduledTransaction{
+		{ID: "waiting", Params: models.TransactionParams{From: wallet}, Status: models.ScheduledWaiting},
+		{ID: "sent", Params: models.TransactionParams{From: wallet}, Status: models.ScheduledSent},
+		{ID: "other", Params: models.TransactionParams{From: other}, Status: models.ScheduledWaiting},
+	} {
+		if err := repo.SaveScheduledTransaction(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), httptest.NewRecorder())
+	// Addresses are compared regardless of their checksum
+	if err := a.cancelWalletPayments(c, "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, status := range map[string]string{
+		"paying":    models.RecurringCancelled,
+		"completed": models.RecurringCompleted,
+		"other":     models.RecurringActive,
+	} {
+		if got := user.RecurringPayments[id].Status; got != status {
+			t.Errorf("expected recurring payment %s to be %s, got %s", id, status, got)
+		}
+	}
+
+	for id, status := range map[string]string{
+		"waiting": models.ScheduledCancelled,
+		"sent":    models.ScheduledSent,
+		"other":   models.ScheduledWaiting,
+	} {
+		s, err := repo.GetScheduledTransaction(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != status {
+			t.Errorf("expected scheduled transaction %s to be %s, got %s", id, status, s.Status)
+		}
+	}
+}
+
+func TestFailedRenameRestoresPublishedName(t *testing.T) {
+	var published []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/my/wallets/initialize":
+			_, _ = w.Write([]byte(`{"challenge":"challenge"}`))
+		case "/users/my/wallets/finalize":
+			var in struct {
+				Name string `json:"name"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&in)
+			published = append(published, in.Name)
+			if in.Name == "renamed" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+	}))
+	defer backend.Close()
+
+	repo := repository.NewMemory()
+	wallet, err := models.NewWallet("wallet", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.NewUser("user@example.com", "User")
+	user.Wallets = append(user.Wallets, wallet)
+	if err = repo.UpsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Validator = acceptingValidator{}
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"name":"renamed"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("address")
+	c.SetParamValues(wallet.Address)
+	c.Set("user", user)
+
+	a := &Api{cfg: config.Config{BackendURL: backend.URL}, repo: repo, signingKey: testSigningKey(t)}
+	if err = a.HandleRenameWallet()(c); err == nil {
+		t.Fatal("expected the rename to fail")
+	}
+
+	if fmt.Sprint(published) != "[renamed wallet]" {
+		t.Fatalf("expected the wallet to be published with its old name again, got %v", published)
+	}
+
+	stored, err := repo.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Wallets[0].Name != wallet.Name {
+		t.Fatalf("expected name %s, got %s", wallet.Name, stored.Wallets[0].Name)
+	}
+}
@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
+	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/protocol/webauthncose"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func getCreationOptions(credentialExcludeList []protocol.CredentialDescriptor) webauthn.RegistrationOption {
@@ -37,20 +42,40 @@ func (a *Api) loginInitialize(user *models.User, sessionKey string) (*protocol.C
 		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	removePendingTransaction(user, sessionKey)
+	removePendingOperations(user, sessionKey)
 
 	user.WebauthnData.Sessions[sessionKey] = *session
 	return options, nil
 }
 
 func (a *Api) loginFinalize(user *models.User, req *http.Request, sessionKey string) (*webauthn.Credential, *webauthn.SessionData, error) {
+	response, err := parseAssertion(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return a.validateLogin(user, response, sessionKey)
+}
+
+// parseAssertion reads the assertion from the body of req. The body can only be read once,
+// so it is parsed before the ceremony is finished on the latest state of the user.
+func parseAssertion(req *http.Request) (*protocol.ParsedCredentialAssertionData, error) {
+	response, err := protocol.ParseCredentialRequestResponse(req)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return response, nil
+}
+
+func (a *Api) validateLogin(user *models.User, response *protocol.ParsedCredentialAssertionData, sessionKey string) (*webauthn.Credential, *webauthn.SessionData, error) {
 	session, ok := user.WebauthnData.Sessions[sessionKey]
 	if !ok {
 		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Please call the initialize endpoint first")
 	}
 	delete(user.WebauthnData.Sessions, sessionKey)
 
-	cred, err := a.w.FinishLogin(user.WebauthnData, session, req)
+	cred, err := a.w.ValidateLogin(user.WebauthnData, session, response)
 	if err != nil {
 		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
@@ -58,37 +83,122 @@ func (a *Api) loginFinalize(user *models.User, req *http.Request, sessionKey str
 	return cred, &session, nil
 }
 
-func (a *Api) transactionInitialize(user *models.User, params *transactionParams, sessionKey string) (*protocol.CredentialAssertion, error) {
+// initializeCeremony starts the ceremony of sessionKey on the latest state of the user.
+// bind stores the operation approved by the assertion under the challenge of the ceremony, it may be nil.
+func (a *Api) initializeCeremony(sessionKey string, bind func(user *models.User, challenge string) error) (*protocol.CredentialAssertion, models.User, error) {
+	var options *protocol.CredentialAssertion
+	user, err := common.UpdateUser(a.repo, func(user *models.User) error {
+		var err error
+		options, err = a.loginInitialize(user, sessionKey)
+		if err != nil {
+			return err
+		}
+		if bind == nil {
+			return nil
+		}
+
+		return bind(user, user.WebauthnData.Sessions[sessionKey].Challenge)
+	})
+
+	return options, user, err
+}
+
+// finalizeCeremony finishes the ceremony of sessionKey on the latest state of the user.
+// complete applies the operation approved by the assertion, it must not have side effects besides changing the user.
+func (a *Api) finalizeCeremony(req *http.Request, sessionKey string, complete func(user *models.User, cred *webauthn.Credential, session *webauthn.SessionData) error) (models.User, error) {
+	response, err := parseAssertion(req)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return common.UpdateUser(a.repo, func(user *models.User) error {
+		cred, session, err := a.validateLogin(user, response, sessionKey)
+		if err != nil {
+			return err
+		}
+
+		return complete(user, cred, session)
+	})
+}
+
+// transactionInitialize reserves a nonce for the transaction, so the assertion covers the exact transaction that is signed later.
+// Replacements keep the nonce of the transaction they replace, which is reserved already.
+// Transactions rejected by the policy of the user are not started.
+func (a *Api) transactionInitialize(ctx context.Context, user *models.User, params *transactionParams, sessionKey string, replacement bool) (*protocol.CredentialAssertion, error) {
 	options, err := a.loginInitialize(user, sessionKey)
 	if err != nil {
 		return nil, err
 	}
 
-	challenge := user.WebauthnData.Sessions[sessionKey].Challenge
-	user.WebauthnData.PendingTransactions[challenge] = models.TransactionParams(*params)
+	session := user.WebauthnData.Sessions[sessionKey]
+	if !replacement {
+		err = reserveNonce(ctx, user, params, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nonce, err := parseReservedNonce(params)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = evaluatePolicy(user, params, nonce, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	user.WebauthnData.PendingTransactions[session.Challenge] = models.TransactionParams(*params)
 
 	return options, nil
 }
 
-func (a *Api) transactionFinalize(user *models.User, req *http.Request, sessionKey string) (*transactionParams, error) {
-	_, session, err := a.loginFinalize(user, req, sessionKey)
+// transactionFinalize returns the pending transaction and the credential that approved it.
+// The policy is evaluated again, because it or the amounts spent might have changed during the ceremony.
+func (a *Api) transactionFinalize(user *models.User, req *http.Request, sessionKey string) (*transactionParams, *webauthn.Credential, error) {
+	cred, session, err := a.loginFinalize(user, req, sessionKey)
 	if err != nil {
-		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return nil, nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	pending := user.WebauthnData.PendingTransactions[session.Challenge]
+	params := (*transactionParams)(&pending)
+
+	nonce, err := parseReservedNonce(params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	spent, err := evaluatePolicy(user, params, nonce, now)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	params := user.WebauthnData.PendingTransactions[session.Challenge]
 	delete(user.WebauthnData.PendingTransactions, session.Challenge)
+	user.RetainNonce(session.Challenge, now.Add(signedNonceTTL).Unix())
+	user.RecordSpend(params.From, params.ChainID, nonce, spent, now.Unix())
+
+	return params, cred, nil
+}
 
-	return (*transactionParams)(&params), nil
+// boundSessionKey binds a ceremony to a single subject like a wallet address or a transaction hash,
+// so an assertion for one subject can not be used for another
+func boundSessionKey(sessionKey, subject string) string {
+	return fmt.Sprintf("%s:%s", sessionKey, strings.ToLower(subject))
 }
 
-// Deletes a pending transaction corresponding to the sessionKey.
-// Prevents bloating the disk if a user decides to not finish ongoing transactions before starting a new one
-func removePendingTransaction(user *models.User, sessionKey string) {
+// Deletes pending operations corresponding to the sessionKey.
+// Prevents bloating the disk if a user decides to not finish ongoing operations before starting a new one
+func removePendingOperations(user *models.User, sessionKey string) {
 	session, ok := user.WebauthnData.Sessions[sessionKey]
 	if !ok {
 		return
 	}
 
 	delete(user.WebauthnData.PendingTransactions, session.Challenge)
+	delete(user.WebauthnData.PendingExports, session.Challenge)
+	delete(user.WebauthnData.PendingSchedules, session.Challenge)
+	delete(user.WebauthnData.PendingRecurring, session.Challenge)
+	delete(user.WebauthnData.PendingSignatures, session.Challenge)
 }
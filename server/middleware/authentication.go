@@ -10,7 +10,6 @@ import (
 	"github.com/labstack/echo/v4"
 	"golang.org/x/exp/slices"
 	"net/http"
-	"time"
 )
 
 const (
@@ -41,12 +40,12 @@ func CheckStrictAuthentication(repo common.Repository, pk ed25519.PublicKey, all
 				return err
 			}
 
-			iat, err := claims.GetIssuedAt()
+			recent, err := common.IsRecentSession(claims)
 			if err != nil {
 				return echo.NewHTTPError(http.StatusUnauthorized, invalidSession)
 			}
 
-			if time.Now().After(iat.Add(time.Minute * 15)) {
+			if !recent {
 				return echo.NewHTTPError(http.StatusForbidden, "This session is too old to access this resource")
 			}
 
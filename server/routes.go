@@ -1,20 +1,15 @@
 package server
 
 import (
-	"fmt"
 	"github.com/Leantar/elonwallet-function/server/common"
 	"github.com/Leantar/elonwallet-function/server/handlers"
 	customMiddleware "github.com/Leantar/elonwallet-function/server/middleware"
 )
 
-func (s *Server) registerRoutes() error {
-	api, err := handlers.NewApi(s.cfg, s.repo, s.key)
-	if err != nil {
-		return fmt.Errorf("failed to create new api: %w", err)
-	}
-
+func (s *Server) registerRoutes(api *handlers.Api) {
 	s.echo.GET("/register/initialize", api.HandleRegisterInitialize())
 	s.echo.POST("/register/finalize", api.HandleRegisterFinalize())
+	s.echo.POST("/register/restore", api.HandleRegisterRestore())
 
 	s.echo.GET("/login/initialize", api.HandleLoginInitialize())
 	s.echo.POST("/login/finalize", api.HandleLoginFinalize())
@@ -28,23 +23,74 @@ func (s *Server) registerRoutes() error {
 	s.echo.DELETE("/credentials/:name", api.HandleRemoveCredential(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.GET("/credentials", api.HandleGetCredentials(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 
+	s.echo.GET("/audit-log", api.HandleGetAuditLog(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
+	s.echo.POST("/backup/export", api.HandleExportBackup(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
 	s.echo.POST("/wallets", api.HandleCreateWallet(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/import", api.HandleImportWallet(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.GET("/wallets", api.HandleGetWallets(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.GET("/wallets/balances", api.HandleGetBalances(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/export/initialize", api.HandleExportWalletInitialize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/export/finalize", api.HandleExportWalletFinalize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/mnemonic/initialize", api.HandleRevealMnemonicInitialize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/mnemonic/finalize", api.HandleRevealMnemonicFinalize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.PUT("/wallets/:address/name", api.HandleRenameWallet(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.PUT("/wallets/:address/archived", api.HandleArchiveWallet(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.PUT("/wallets/:address/visibility", api.HandleSetWalletVisibility(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/:address/delete/initialize", api.HandleDeleteWalletInitialize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/wallets/:address/delete/finalize", api.HandleDeleteWalletFinalize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 
 	s.echo.GET("/networks", api.HandleGetNetworks(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 
+	s.echo.GET("/policy", api.HandleGetPolicy(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.PUT("/policy", api.HandleUpdatePolicy(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
+	s.echo.GET("/approvals", api.HandleGetApprovals(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/approvals/:id/initialize", api.HandleApproveInitialize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/approvals/:id/finalize", api.HandleApproveFinalize(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.DELETE("/approvals/:id", api.HandleRejectApproval(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
+	s.echo.GET("/abis", api.HandleGetContractABIs(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.PUT("/abis/:chain/:address", api.HandleSaveContractABI(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.DELETE("/abis/:chain/:address", api.HandleRemoveContractABI(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/decode/calldata", api.HandleDecodeCalldata(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/decode/typed-data", api.HandleDecodeTypedData(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
 	s.echo.GET("/jwt-verification-key", api.HandleGetJWTVerificationKey())
 
 	s.echo.GET("/otp", api.HandleGetOTP(), customMiddleware.CheckStrictAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/otp/login", api.HandleLoginWithOTP())
 
+	s.echo.POST("/message/preview", api.HandlePreviewPersonal(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/message/sign", api.HandleSignPersonal(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/typed-data/sign", api.HandleSignTypedData(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/message/sign/initialize", api.HandleSignPersonalInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/message/sign/finalize", api.HandleSignPersonalFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/typed-data/sign/initialize", api.HandleSignTypedDataInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/typed-data/sign/finalize", api.HandleSignTypedDataFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/message/eth-sign/initialize", api.HandleEthSignInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/message/eth-sign/finalize", api.HandleEthSignFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 
 	s.echo.POST("/transaction/sign/initialize", api.HandleSignTransactionInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/transaction/sign/finalize", api.HandleSignTransactionFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/transaction/send/initialize", api.HandleSendTransactionInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.POST("/transaction/send/finalize", api.HandleSendTransactionFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.GET("/transactions", api.HandleGetTransactions(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.GET("/transactions/scheduled", api.HandleGetScheduledTransactions(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/scheduled/initialize", api.HandleScheduleTransactionInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/scheduled/finalize", api.HandleScheduleTransactionFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.DELETE("/transactions/scheduled/:id", api.HandleCancelScheduledTransaction(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.GET("/transactions/:hash", api.HandleGetTransaction(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/:hash/speed-up/initialize", api.HandleSpeedUpTransactionInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/:hash/speed-up/finalize", api.HandleSpeedUpTransactionFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/:hash/cancel/initialize", api.HandleCancelTransactionInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/transactions/:hash/cancel/finalize", api.HandleCancelTransactionFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+
+	s.echo.GET("/recurring-payments", api.HandleGetRecurringPayments(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/recurring-payments/initialize", api.HandleRecurringPaymentInitialize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.POST("/recurring-payments/finalize", api.HandleRecurringPaymentFinalize(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
+	s.echo.DELETE("/recurring-payments/:id", api.HandleCancelRecurringPayment(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 
 	s.echo.POST("/emergency-access/contacts", api.HandleCreateEmergencyContact(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.GET("/emergency-access/contacts", api.HandleGetEmergencyContacts(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
@@ -61,6 +107,4 @@ func (s *Server) registerRoutes() error {
 	s.echo.POST("/emergency-access/grants/request-takeover", api.HandleRequestEmergencyAccessTakeover(), customMiddleware.CheckAuthentication(s.repo, s.key.PublicKey, common.ScopeUser))
 	s.echo.DELETE("/emergency-access/grants", api.HandleEmergencyAccessGrantRemoval(), customMiddleware.CheckEnclaveAuthentication(s.repo, s.cfg))
 	s.echo.POST("/emergency-access/grants/deny-access-request", api.HandleEmergencyAccessRequestDenial(), customMiddleware.CheckEnclaveAuthentication(s.repo, s.cfg))
-
-	return nil
 }
@@ -3,12 +3,15 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"github.com/Leantar/elonwallet-function/models"
 	"github.com/Leantar/elonwallet-function/server/common"
+	"github.com/Leantar/elonwallet-function/server/handlers"
 	customMiddleware "github.com/Leantar/elonwallet-function/server/middleware"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/Leantar/elonwallet-function/config"
@@ -21,16 +24,23 @@ type Server struct {
 	key  models.SigningKey
 	repo common.Repository
 	cc   *CertificateCache
+	// Background jobs run until jobsCtx is cancelled by Stop
+	jobsCtx  context.Context
+	stopJobs context.CancelFunc
+	jobs     sync.WaitGroup
 }
 
 func New(cfg config.Config, key models.SigningKey, repo common.Repository) (*Server, error) {
 	e := echo.New()
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
 	s := &Server{
-		echo: e,
-		cfg:  cfg,
-		key:  key,
-		repo: repo,
-		cc:   nil,
+		echo:     e,
+		cfg:      cfg,
+		key:      key,
+		repo:     repo,
+		cc:       nil,
+		jobsCtx:  jobsCtx,
+		stopJobs: stopJobs,
 	}
 
 	if cfg.UseInsecureHTTP {
@@ -69,6 +79,7 @@ func New(cfg config.Config, key models.SigningKey, repo common.Repository) (*Ser
 	cv := newValidator()
 	e.Validator = &cv
 	e.Binder = &BinderWithURLDecoding{&echo.DefaultBinder{}}
+	e.HTTPErrorHandler = errorHandler(e)
 
 	e.Use(middleware.RequestID())
 	e.Use(customMiddleware.RequestLogger())
@@ -78,11 +89,14 @@ func New(cfg config.Config, key models.SigningKey, repo common.Repository) (*Ser
 }
 
 func (s *Server) Run() (err error) {
-	err = s.registerRoutes()
+	api, err := handlers.NewApi(s.cfg, s.repo, s.key)
 	if err != nil {
-		return
+		return fmt.Errorf("failed to create new api: %w", err)
 	}
 
+	s.registerRoutes(api)
+	s.startJobs(api)
+
 	if s.cfg.UseInsecureHTTP {
 		log.Info().Caller().Msgf("http server started on %s", s.echo.Server.Addr)
 		err = s.echo.Server.ListenAndServe()
@@ -102,5 +116,25 @@ func (s *Server) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	return s.echo.Shutdown(ctx)
+	err := s.echo.Shutdown(ctx)
+
+	s.stopJobs()
+	s.jobs.Wait()
+
+	return err
+}
+
+// startJobs runs the background jobs of api until Stop is called
+func (s *Server) startJobs(api *handlers.Api) {
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		api.PollTransactions(s.jobsCtx)
+	}()
+
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		api.RunScheduler(s.jobsCtx)
+	}()
 }